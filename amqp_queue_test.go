@@ -0,0 +1,425 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/streadway/amqp"
+)
+
+// fakeAMQPChannel is an in-process broker with the queues of a single
+// channel, it honours prefetch counts and requeues nacked deliveries
+type fakeAMQPChannel struct {
+	// rejected are the deliveries nacked without requeue, which the
+	// broker routes to the dead-letter exchange
+	mu        sync.Mutex
+	declared  map[string]amqp.Table
+	ready     map[string][]amqp.Delivery
+	unacked   map[uint64]amqp.Delivery
+	lastTag   uint64
+	prefetch  int
+	consuming string
+	consumer  chan amqp.Delivery
+	closed    bool
+	rejected  []amqp.Delivery
+}
+
+func newFakeAMQPChannel() *fakeAMQPChannel {
+	return &fakeAMQPChannel{
+		declared: map[string]amqp.Table{},
+		ready:    map[string][]amqp.Delivery{},
+		unacked:  map[uint64]amqp.Delivery{},
+	}
+}
+
+func (ch *fakeAMQPChannel) QueueDeclare(name string, durable, autoDelete, exclusive, noWait bool, args amqp.Table) (amqp.Queue, error) {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+	ch.declared[name] = args
+	return amqp.Queue{Name: name}, nil
+}
+
+func (ch *fakeAMQPChannel) Qos(prefetchCount, prefetchSize int, global bool) error {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+	ch.prefetch = prefetchCount
+	return nil
+}
+
+func (ch *fakeAMQPChannel) Consume(queue, consumer string, autoAck, exclusive, noLocal, noWait bool, args amqp.Table) (<-chan amqp.Delivery, error) {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+	ch.consuming = queue
+	ch.consumer = make(chan amqp.Delivery, 100)
+	ch.dispatch()
+	return ch.consumer, nil
+}
+
+func (ch *fakeAMQPChannel) Publish(exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+	if ch.closed {
+		return amqp.ErrClosed
+	}
+	if _, ok := ch.declared[key]; !ok {
+		return errors.Errorf("no queue %s", key)
+	}
+	ch.ready[key] = append(ch.ready[key], amqp.Delivery{
+		Acknowledger: ch,
+		Headers:      msg.Headers,
+		ContentType:  msg.ContentType,
+		DeliveryMode: msg.DeliveryMode,
+		Expiration:   msg.Expiration,
+		MessageId:    msg.MessageId,
+		Timestamp:    msg.Timestamp,
+		Body:         msg.Body,
+		RoutingKey:   key,
+	})
+	ch.dispatch()
+	return nil
+}
+
+func (ch *fakeAMQPChannel) Close() error {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+	if !ch.closed && ch.consumer != nil {
+		close(ch.consumer)
+	}
+	ch.closed = true
+	return nil
+}
+
+// dispatch pushes ready messages to the consumer within the prefetch count.
+// It must be called with ch.mu held.
+func (ch *fakeAMQPChannel) dispatch() {
+	if ch.consumer == nil || ch.closed {
+		return
+	}
+	for len(ch.unacked) < ch.prefetch && len(ch.ready[ch.consuming]) > 0 {
+		d := ch.ready[ch.consuming][0]
+		ch.ready[ch.consuming] = ch.ready[ch.consuming][1:]
+		ch.lastTag++
+		d.DeliveryTag = ch.lastTag
+		ch.unacked[d.DeliveryTag] = d
+		ch.consumer <- d
+	}
+}
+
+func (ch *fakeAMQPChannel) Ack(tag uint64, multiple bool) error {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+	if _, ok := ch.unacked[tag]; !ok {
+		return errors.Errorf("unknown delivery tag %d", tag)
+	}
+	delete(ch.unacked, tag)
+	ch.dispatch()
+	return nil
+}
+
+func (ch *fakeAMQPChannel) Nack(tag uint64, multiple bool, requeue bool) error {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+	d, ok := ch.unacked[tag]
+	if !ok {
+		return errors.Errorf("unknown delivery tag %d", tag)
+	}
+	delete(ch.unacked, tag)
+	if requeue {
+		d.Redelivered = true
+		ch.ready[d.RoutingKey] = append([]amqp.Delivery{d}, ch.ready[d.RoutingKey]...)
+	} else {
+		ch.rejected = append(ch.rejected, d)
+	}
+	ch.dispatch()
+	return nil
+}
+
+func (ch *fakeAMQPChannel) Reject(tag uint64, requeue bool) error {
+	return ch.Nack(tag, false, requeue)
+}
+
+// expire moves the messages of the delay queue back to the queue, like the
+// broker does once their expiration passed
+func (ch *fakeAMQPChannel) expire(delayQueue string) {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+	queue := ch.declared[delayQueue]["x-dead-letter-routing-key"].(string)
+	for _, d := range ch.ready[delayQueue] {
+		d.Expiration = ""
+		d.RoutingKey = queue
+		ch.ready[queue] = append(ch.ready[queue], d)
+	}
+	ch.ready[delayQueue] = nil
+	ch.dispatch()
+}
+
+func (ch *fakeAMQPChannel) len(queue string) int {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+	return len(ch.ready[queue])
+}
+
+func newTestAMQPQueue(t *testing.T, workers int) (*amqpQueue, *[]*fakeAMQPChannel) {
+	t.Helper()
+	var channels []*fakeAMQPChannel
+	dial := func() (amqpChannel, error) {
+		ch := newFakeAMQPChannel()
+		channels = append(channels, ch)
+		return ch, nil
+	}
+	q := newAMQPQueue(dial, "gantry-test", true, TransportOptions{
+		Logger:            noopLogger{},
+		VisibilityTimeout: 30,
+		Workers:           workers,
+	})
+	q.receiveWait = 100 * time.Millisecond
+	return q, &channels
+}
+
+func Test_AMQPQueue_PublishesAndReceivesMessages(t *testing.T) {
+	q, channels := newTestAMQPQueue(t, 2)
+
+	body := messageBody{Env: env{"FOO": "bar"}}
+	if err := q.PublishPayload(body, []byte("payload")); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := q.PublishPayload(messageBody{}, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	msg := receive(t, q)
+	if msg == nil {
+		t.Fatalf("expected to receive a message")
+	}
+	expectedBody := messageBody{Version: messageVersion, Env: env{"FOO": "bar"}}
+	if !reflect.DeepEqual(expectedBody, msg.Body()) {
+		t.Errorf("expected body to equal '%+#v', got '%+#v'", expectedBody, msg.Body())
+	}
+	if string(msg.Payload()) != "payload" {
+		t.Errorf("expected payload to equal %q, got %q", "payload", msg.Payload())
+	}
+	if msg.ReceiveCount() != 1 {
+		t.Errorf("expected receive count to equal 1, got %d", msg.ReceiveCount())
+	}
+
+	ch := (*channels)[0]
+	if ch.prefetch != 2 {
+		t.Errorf("expected prefetch count to equal the number of workers, got %d", ch.prefetch)
+	}
+	if ch.len(q.queue) != 1 {
+		t.Errorf("expected the broker to hold back the message beyond the prefetch count")
+	}
+
+	if err := msg.Delete(); err != nil {
+		t.Fatal(err)
+	}
+	if err := msg.Delete(); err == nil {
+		t.Errorf("expected second delete to fail")
+	}
+	if ch.len(q.queue) != 0 {
+		t.Errorf("expected the broker to push the next message once the first was acked")
+	}
+}
+
+func Test_AMQPQueue_RequeuesMessagesAfterVisibilityTimeout(t *testing.T) {
+	q, _ := newTestAMQPQueue(t, 1)
+	q.visibilityTimeout = 10 * time.Millisecond
+
+	if err := q.PublishPayload(messageBody{}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	first := receive(t, q)
+	if first == nil {
+		t.Fatalf("expected to receive a message")
+	}
+	second := receive(t, q)
+	if second == nil || second.ID() != first.ID() {
+		t.Fatalf("expected message %s to be requeued, got %v", first.ID(), second)
+	}
+	if second.ReceiveCount() != 2 {
+		t.Errorf("expected receive count to equal 2, got %d", second.ReceiveCount())
+	}
+	if err := first.Delete(); err == nil {
+		t.Errorf("expected delete of a requeued message to fail")
+	}
+}
+
+func Test_Gantry_RejectsDeadLettersOfAMQPQueues(t *testing.T) {
+	q, channels := newTestAMQPQueue(t, 1)
+	q.visibilityTimeout = 10 * time.Millisecond
+	if err := q.PublishPayload(messageBody{}, nil); err != nil {
+		t.Fatal(err)
+	}
+	ch := (*channels)[0]
+	// a message without body header, e.g. of another publisher
+	if err := ch.Publish("", q.queue, false, false, amqp.Publishing{MessageId: "malformed"}); err != nil {
+		t.Fatal(err)
+	}
+	first := receive(t, q)
+	if err := first.Delete(); err != nil {
+		t.Fatal(err)
+	}
+
+	metrics := NewMetrics()
+	g := Gantry{ctx: context.TODO(), src: metrics.InstrumentSource(q), logger: noopLogger{}}
+	if err := g.HandleMessageIfExists(); !isDeadLetter(err) {
+		t.Fatalf("expected dead letter, got %v", err)
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+	if len(ch.rejected) != 1 || ch.rejected[0].MessageId != "malformed" {
+		t.Errorf("expected malformed message to be rejected for the dead-letter exchange, got %v", ch.rejected)
+	}
+	if len(ch.ready[q.queue]) != 0 || len(ch.unacked) != 0 {
+		t.Errorf("expected malformed message not to be requeued")
+	}
+}
+
+func Test_DelayBucket(t *testing.T) {
+	for delay, expected := range map[time.Duration]time.Duration{
+		time.Millisecond:        time.Second,
+		time.Second:             time.Second,
+		30 * time.Second:        16 * time.Second,
+		time.Hour:               2048 * time.Second,
+		24 * time.Hour:          65536 * time.Second,
+		100 * 24 * time.Hour:    amqpMaxDelayBucket,
+		1<<20*time.Second + 1:   amqpMaxDelayBucket,
+		1<<20*time.Second - 1e9: 1 << 19 * time.Second,
+	} {
+		if bucket := delayBucket(delay); bucket != expected {
+			t.Errorf("expected delay %s to wait in bucket %s, got %s", delay, expected, bucket)
+		}
+	}
+}
+
+// expireUntilReceived expires the delay queues of q and advances clock by
+// their delay, until a message is received or rounds are over
+func expireUntilReceived(t *testing.T, q *amqpQueue, ch *fakeAMQPChannel, clock *fakeClock, rounds int, buckets ...time.Duration) Message {
+	t.Helper()
+	for i := 0; i < rounds; i++ {
+		for _, bucket := range buckets {
+			if ch.len(q.delayQueue(bucket)) > 0 {
+				clock.Advance(bucket)
+				ch.expire(q.delayQueue(bucket))
+				break
+			}
+		}
+		if msg := receive(t, q); msg != nil {
+			return msg
+		}
+	}
+	return nil
+}
+
+func Test_AMQPQueue_DelaysMessagesInDelayQueues(t *testing.T) {
+	q, channels := newTestAMQPQueue(t, 1)
+	clock := &fakeClock{t: time.Date(2018, time.June, 01, 0, 0, 0, 0, time.UTC)}
+	q.now = clock.Now
+
+	notBefore := clock.Now().Add(time.Hour)
+	if err := q.PublishPayload(messageBody{NotBefore: &notBefore}, nil); err != nil {
+		t.Fatal(err)
+	}
+	ch := (*channels)[0]
+	if ch.len(q.delayQueue(2048*time.Second)) != 1 {
+		t.Fatalf("expected message to be published to the delay queue of 2048s")
+	}
+	if ttl := ch.declared[q.delayQueue(2048*time.Second)]["x-message-ttl"]; ttl != int64(2048000) {
+		t.Errorf("expected delay queue to expire messages after 2048s, got %v", ttl)
+	}
+	if msg := receive(t, q); msg != nil {
+		t.Fatalf("expected no message before it is due")
+	}
+
+	// 3600s wait 2048s, 1024s, 512s and 16s
+	buckets := []time.Duration{2048 * time.Second, 1024 * time.Second, 512 * time.Second, 16 * time.Second}
+	msg := expireUntilReceived(t, q, ch, clock, 3, buckets...)
+	if msg != nil {
+		t.Fatalf("expected message to hop through the delay queues, got it after %s", clock.Now().Sub(notBefore.Add(-time.Hour)))
+	}
+	msg = expireUntilReceived(t, q, ch, clock, 1, buckets...)
+	if msg == nil || clock.Now().Before(notBefore) {
+		t.Fatalf("expected message once it is due, got %v at %s", msg, clock.Now())
+	}
+
+	if err := msg.ChangeVisibility(time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if ch.len(q.delayQueue(32*time.Second)) != 1 {
+		t.Errorf("expected deferred message to be moved to the delay queue of 32s")
+	}
+	if err := msg.Delete(); err == nil {
+		t.Errorf("expected delete of a deferred message to fail")
+	}
+
+	msg = expireUntilReceived(t, q, ch, clock, 5, 32*time.Second, 16*time.Second, 8*time.Second, 4*time.Second)
+	if msg == nil {
+		t.Fatalf("expected deferred message to reappear")
+	}
+	if err := msg.ChangeVisibility(0); err != nil {
+		t.Fatal(err)
+	}
+	if msg := receive(t, q); msg == nil {
+		t.Fatalf("expected message to be requeued right away")
+	}
+}
+
+func Test_AMQPQueue_DoesNotHoldBackShortDelaysBehindLongOnes(t *testing.T) {
+	q, channels := newTestAMQPQueue(t, 1)
+	clock := &fakeClock{t: time.Date(2018, time.June, 01, 0, 0, 0, 0, time.UTC)}
+	q.now = clock.Now
+
+	long := clock.Now().Add(24 * time.Hour)
+	if err := q.PublishPayload(messageBody{NotBefore: &long, Env: env{"DELAY": "long"}}, nil); err != nil {
+		t.Fatal(err)
+	}
+	short := clock.Now().Add(30 * time.Second)
+	if err := q.PublishPayload(messageBody{NotBefore: &short, Env: env{"DELAY": "short"}}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// the broker expires the heads of the delay queues only
+	ch := (*channels)[0]
+	msg := expireUntilReceived(t, q, ch, clock, 5, 16*time.Second, 8*time.Second, 4*time.Second, 2*time.Second)
+	if msg == nil || msg.Body().Env["DELAY"] != "short" {
+		t.Fatalf("expected the short delay to come back first, got %v", msg)
+	}
+	if took := clock.Now().Sub(short.Add(-30 * time.Second)); took != 30*time.Second {
+		t.Errorf("expected the short delay to come back after 30s, took %s", took)
+	}
+	if ch.len(q.delayQueue(65536*time.Second)) != 1 {
+		t.Errorf("expected the long delay to still wait")
+	}
+}
+
+func Test_AMQPQueue_ReopensClosedChannels(t *testing.T) {
+	q, channels := newTestAMQPQueue(t, 1)
+
+	if msg := receive(t, q); msg != nil {
+		t.Fatalf("expected no message")
+	}
+	(*channels)[0].Close()
+
+	if _, err := q.ReceiveMessageWithContext(context.TODO()); err == nil {
+		t.Fatalf("expected receive from a closed channel to fail")
+	}
+
+	if err := q.PublishPayload(messageBody{}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if len(*channels) != 2 {
+		t.Fatalf("expected a new channel to be opened, got %d channels", len(*channels))
+	}
+	if msg := receive(t, q); msg == nil {
+		t.Fatalf("expected message on the new channel")
+	}
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/pkg/errors"
+)
+
+// An ArtifactStore keeps the artifacts collected from payload directories
+// after their entrypoint ran
+type ArtifactStore interface {
+	// PutArtifact stores the tar.gz archive under name, it returns the
+	// reference to the stored archive
+	PutArtifact(name string, archive []byte) (string, error)
+}
+
+// OpenArtifactStore returns the ArtifactStore for rawURL, which is
+// file:///path/to/dir for a local directory or s3://<bucket>/<prefix> for a
+// S3 bucket
+func OpenArtifactStore(rawURL string) (ArtifactStore, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, errors.Wrap(err, "artifacts: can not parse artifact store url")
+	}
+	switch strings.ToLower(u.Scheme) {
+	case "file":
+		return NewLocalArtifactStore(u.Path)
+	case "s3":
+		sess, err := session.NewSession()
+		if err != nil {
+			return nil, errors.Wrap(err, "artifacts: can not create aws session")
+		}
+		return NewS3ArtifactStore(s3.New(sess), u.Host, strings.TrimPrefix(u.Path, "/")), nil
+	}
+	return nil, errors.Errorf("artifacts: unsupported artifact store url scheme %q, supported are file,s3", u.Scheme)
+}
+
+type localArtifactStore struct {
+	dir string
+}
+
+// NewLocalArtifactStore returns an ArtifactStore which writes archives into
+// dir, it is created if missing
+func NewLocalArtifactStore(dir string) (ArtifactStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, errors.Wrap(err, fmt.Sprintf("artifacts: can not create directory %s", dir))
+	}
+	return localArtifactStore{dir: dir}, nil
+}
+
+func (s localArtifactStore) PutArtifact(name string, archive []byte) (string, error) {
+	file := filepath.Join(s.dir, name)
+	// write to a temp file first, so that no partial archives are left
+	tmp := file + ".tmp"
+	if err := ioutil.WriteFile(tmp, archive, 0644); err != nil {
+		return "", errors.Wrap(err, fmt.Sprintf("artifacts: can not write %s", tmp))
+	}
+	if err := os.Rename(tmp, file); err != nil {
+		os.Remove(tmp)
+		return "", errors.Wrap(err, fmt.Sprintf("artifacts: can not write %s", file))
+	}
+	return (&url.URL{Scheme: "file", Path: file}).String(), nil
+}
+
+type s3ArtifactStore struct {
+	client s3iface.S3API
+	bucket string
+	prefix string
+}
+
+// NewS3ArtifactStore returns an ArtifactStore which uploads archives into
+// bucket, below prefix
+func NewS3ArtifactStore(client s3iface.S3API, bucket, prefix string) ArtifactStore {
+	return s3ArtifactStore{client: client, bucket: bucket, prefix: prefix}
+}
+
+func (s s3ArtifactStore) PutArtifact(name string, archive []byte) (string, error) {
+	key := path.Join(s.prefix, name)
+	_, err := s.client.PutObject(&s3.PutObjectInput{
+		Bucket:      aws.String(s.bucket),
+		Key:         aws.String(key),
+		Body:        bytes.NewReader(archive),
+		ContentType: aws.String("application/gzip"),
+	})
+	if err != nil {
+		return "", errors.Wrap(err, fmt.Sprintf("artifacts: can not upload s3://%s/%s", s.bucket, key))
+	}
+	return "s3://" + s.bucket + "/" + key, nil
+}
+
+// validateArtifactPatterns returns an error unless all patterns are valid
+// globs relative to the payload directory
+func validateArtifactPatterns(patterns []string) error {
+	for _, pattern := range patterns {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return errors.Wrap(err, fmt.Sprintf("malformed artifact pattern %q", pattern))
+		}
+		clean := filepath.Clean(pattern)
+		if filepath.IsAbs(clean) || clean == ".." || strings.HasPrefix(clean, ".."+string(filepath.Separator)) {
+			return errors.Errorf("artifact pattern %q must be relative to the payload directory", pattern)
+		}
+	}
+	return nil
+}
+
+// matchArtifacts returns the paths in dir, relative to it, which match any of
+// patterns. Directories which match are included with all their contents.
+func matchArtifacts(dir string, patterns []string) ([]string, error) {
+	if err := validateArtifactPatterns(patterns); err != nil {
+		return nil, err
+	}
+	var (
+		files []string
+		seen  = map[string]bool{}
+	)
+	for _, pattern := range patterns {
+		matches, err := filepath.Glob(filepath.Join(dir, pattern))
+		if err != nil {
+			return nil, errors.Wrap(err, fmt.Sprintf("malformed artifact pattern %q", pattern))
+		}
+		for _, match := range matches {
+			rel, err := filepath.Rel(dir, match)
+			if err != nil {
+				return nil, errors.Wrap(err, fmt.Sprintf("can not match artifact pattern %q", pattern))
+			}
+			if !seen[rel] {
+				seen[rel] = true
+				files = append(files, rel)
+			}
+		}
+	}
+	return files, nil
+}
+
+// FilesToTarGz writes the given paths of root, relative to it, into a
+// gzipped tar. Directories are written with all their contents, only
+// regular files and directories are included. The parent directories of the
+// paths are written first, so that the archive can be extracted with
+// ExtractTarGzToDir.
+func (p Payloader) FilesToTarGz(root string, files []string) ([]byte, error) {
+	var b = new(bytes.Buffer)
+	gzw := gzip.NewWriter(b)
+	tw := tar.NewWriter(gzw)
+
+	written := map[string]bool{}
+	add := func(file string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return errors.Wrap(err, "payloader: can not walk file tree")
+		}
+		if !fi.Mode().IsRegular() && !fi.IsDir() {
+			return nil
+		}
+		name, err := filepath.Rel(root, file)
+		if err != nil {
+			return errors.Wrap(err, fmt.Sprintf("payloader: can not name file in archive (%s)", file))
+		}
+		// directories may be matched alongside their contents
+		if written[name] {
+			return nil
+		}
+		written[name] = true
+
+		header, err := tar.FileInfoHeader(fi, "")
+		if err != nil {
+			return errors.Wrap(err, fmt.Sprintf("payloader: can not create tar file info header (%s)", file))
+		}
+		header.Name = filepath.ToSlash(name)
+		if err := tw.WriteHeader(header); err != nil {
+			return errors.Wrap(err, fmt.Sprintf("payloader: can not write tar file info header (%s)", file))
+		}
+		if fi.IsDir() {
+			return nil
+		}
+
+		f, err := os.Open(file)
+		if err != nil {
+			return errors.Wrap(err, fmt.Sprintf("can not open file for copying body to tar (%s)", file))
+		}
+		defer f.Close()
+		if _, err := io.Copy(tw, f); err != nil {
+			return errors.Wrap(err, fmt.Sprintf("can not write tar file body (%s)", file))
+		}
+		return nil
+	}
+
+	for _, rel := range files {
+		var parents []string
+		for dir := filepath.Dir(rel); dir != "."; dir = filepath.Dir(dir) {
+			parents = append([]string{dir}, parents...)
+		}
+		for _, dir := range parents {
+			fi, err := os.Lstat(filepath.Join(root, dir))
+			if err := add(filepath.Join(root, dir), fi, err); err != nil {
+				return nil, err
+			}
+		}
+		if err := filepath.Walk(filepath.Join(root, rel), add); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		return nil, errors.Wrap(err, "payloader: can not close tar archive")
+	}
+	if err := gzw.Close(); err != nil {
+		return nil, errors.Wrap(err, "payloader: can not close gzip writer")
+	}
+	return b.Bytes(), nil
+}
+
+// A MissingArtifactStoreError is returned by consumers without artifact
+// store for payloads which declare artifacts, they are released to other
+// consumers before they run
+type MissingArtifactStoreError struct{}
+
+func (e MissingArtifactStoreError) Error() string {
+	return "payload declares artifacts, but consumer has no artifact store"
+}
+
+// artifactName returns the name of the artifacts of msg executed at
+// startedAt, unique across retries of msg
+func artifactName(msg Message, startedAt time.Time) string {
+	id := strings.NewReplacer("/", "_", string(filepath.Separator), "_").Replace(msg.ID())
+	return id + "-" + startedAt.UTC().Format("20060102T150405.000000000Z") + ".tar.gz"
+}
+
+// collectArtifacts archives the files of dir matching patterns and puts them
+// into the artifact store. It returns the references of the stored archives,
+// none if nothing matched.
+func (g *Gantry) collectArtifacts(msg Message, patterns []string, dir string, startedAt time.Time) ([]string, error) {
+	if len(patterns) == 0 {
+		return nil, nil
+	}
+	if g.artifacts == nil {
+		return nil, MissingArtifactStoreError{}
+	}
+
+	files, err := matchArtifacts(dir, patterns)
+	if err != nil || len(files) == 0 {
+		return nil, err
+	}
+	archive, err := Payloader{g.logger}.FilesToTarGz(dir, files)
+	if err != nil {
+		return nil, errors.Wrap(err, "can not archive artifacts")
+	}
+	ref, err := g.artifacts.PutArtifact(artifactName(msg, startedAt), archive)
+	if err != nil {
+		return nil, err
+	}
+	return []string{ref}, nil
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+// fakeS3 keeps the objects put into it
+type fakeS3 struct {
+	s3iface.S3API
+	objects map[string][]byte
+}
+
+func (fs *fakeS3) PutObject(input *s3.PutObjectInput) (*s3.PutObjectOutput, error) {
+	b, err := ioutil.ReadAll(input.Body)
+	if err != nil {
+		return nil, err
+	}
+	fs.objects[aws.StringValue(input.Bucket)+"/"+aws.StringValue(input.Key)] = b
+	return &s3.PutObjectOutput{}, nil
+}
+
+// extractedFiles extracts archive and returns the contents of its files by
+// path
+func extractedFiles(t *testing.T, archive []byte) map[string]string {
+	t.Helper()
+	dir := helper{t}.tempDir()
+	defer os.RemoveAll(dir)
+	if err := (Payloader{}).ExtractTarGzToDir(dir, archive); err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]string{}
+	filepath.Walk(dir, func(file string, fi os.FileInfo, err error) error {
+		if err != nil || fi.IsDir() {
+			return err
+		}
+		b, err := ioutil.ReadFile(file)
+		rel, _ := filepath.Rel(dir, file)
+		files[rel] = string(b)
+		return err
+	})
+	return files
+}
+
+func Test_ValidateArtifactPatterns(t *testing.T) {
+	for pattern, valid := range map[string]bool{
+		"reports":         true,
+		"rendered/*.yaml": true,
+		"./out/[a-z]*":    true,
+		"/etc/passwd":     false,
+		"../secrets":      false,
+		"out/../../x":     false,
+		"[":               false,
+	} {
+		if err := validateArtifactPatterns([]string{pattern}); (err == nil) != valid {
+			t.Errorf("expected pattern %q to be valid: %t, got %v", pattern, valid, err)
+		}
+	}
+}
+
+func Test_Gantry_CollectsArtifactsAfterExecution(t *testing.T) {
+	q, _ := newTestQueue(time.Now())
+	publishFixture(t, q, "./fixtures/artifacts", messageBody{
+		Artifacts: []string{"reports", "rendered/*.yaml", "missing/*"},
+	})
+	store := &fakeS3{objects: map[string][]byte{}}
+	history := newTestHistory(t, 0)
+
+	g := Gantry{
+		ctx:       context.TODO(),
+		src:       q,
+		artifacts: NewS3ArtifactStore(store, "artifacts", "gantry"),
+		history:   history,
+		logger:    noopLogger{},
+	}
+	if err := g.HandleMessageIfExists(); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := history.List(HistoryFilter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("uploads the matching files", func(t *testing.T) {
+		if len(store.objects) != 1 {
+			t.Fatalf("expected one archive, got %d", len(store.objects))
+		}
+		var key string
+		for k := range store.objects {
+			key = k
+		}
+		if !strings.HasPrefix(key, "artifacts/gantry/mem-1-") || !strings.HasSuffix(key, ".tar.gz") {
+			t.Errorf("expected archive to be named after the message, got %s", key)
+		}
+		expected := map[string]string{
+			"reports/summary.txt": "all good\n",
+			"rendered/app.yaml":   "kind: Deployment\n",
+		}
+		if files := extractedFiles(t, store.objects[key]); !reflect.DeepEqual(files, expected) {
+			t.Errorf("expected archive to contain %v, got %v", expected, files)
+		}
+	})
+
+	t.Run("references the archive in the result", func(t *testing.T) {
+		var keys []string
+		for k := range store.objects {
+			keys = append(keys, "s3://"+k)
+		}
+		if !reflect.DeepEqual(entries[0].Artifacts, keys) {
+			t.Errorf("expected artifacts %v, got %v", keys, entries[0].Artifacts)
+		}
+	})
+
+	t.Run("removes the payload directory", func(t *testing.T) {
+		dir := strings.TrimSpace(entries[0].Stdout)
+		if _, err := os.Stat(dir); !os.IsNotExist(err) {
+			t.Errorf("expected payload directory %s to be removed, got %v", dir, err)
+		}
+	})
+}
+
+func Test_Gantry_ReleasesPayloadsWithArtifactsWithoutStore(t *testing.T) {
+	for name, tc := range map[string]struct {
+		dir  string
+		body messageBody
+	}{
+		"artifacts of the message":  {"./fixtures/artifacts", messageBody{Artifacts: []string{"reports"}}},
+		"artifacts of the manifest": {writePayloadDir(t, "entrypoint: bin/run.sh\nartifacts: [reports]", "touch ran"), messageBody{}},
+	} {
+		t.Run(name, func(t *testing.T) {
+			q, _ := newTestQueue(time.Now())
+			publishFixture(t, q, tc.dir, tc.body)
+			history := newTestHistory(t, 0)
+
+			g := Gantry{
+				ctx:     context.TODO(),
+				src:     q,
+				history: history,
+				logger:  noopLogger{},
+			}
+			status, _, err := g.HandleMessage(receive(t, q))
+			if status != statusReleased {
+				t.Errorf("expected payload with artifacts to be released without artifact store, got %s %v", status, err)
+			}
+			if q.Len() != 1 {
+				t.Errorf("expected message to be left on the queue")
+			}
+			if entries, _ := history.List(HistoryFilter{}); len(entries) > 0 && entries[0].ExitStatus != -1 {
+				t.Errorf("expected entrypoint not to run, got exit status %d", entries[0].ExitStatus)
+			}
+		})
+	}
+}
+
+func Test_LocalArtifactStore_WritesArchives(t *testing.T) {
+	dir := filepath.Join(helper{t}.tempDir(), "artifacts")
+	store, err := OpenArtifactStore("file://" + dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ref, err := store.PutArtifact("mem-1.tar.gz", []byte("archive"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := "file://" + filepath.Join(dir, "mem-1.tar.gz"); ref != expected {
+		t.Errorf("expected reference %s, got %s", expected, ref)
+	}
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, fi := range files {
+		names = append(names, fi.Name())
+	}
+	sort.Strings(names)
+	if !reflect.DeepEqual(names, []string{"mem-1.tar.gz"}) {
+		t.Errorf("expected only the archive in the store, got %v", names)
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/arn"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/sns"
+	"github.com/pkg/errors"
+)
+
+func init() {
+	// SNS topics are given by their ARN, arn:aws:sns:<region>:<account>:<name>
+	RegisterTransport("arn", Transport{Sink: openAWSSNS})
+}
+
+// openAWSSNS opens a SNS topic for publishing by its ARN. Every queue
+// subscribed to the topic receives the payload, so that one publish executes
+// it on a fleet of consumers.
+func openAWSSNS(u *url.URL, opts TransportOptions) (MessageSink, error) {
+	topicARN, err := arn.Parse(u.String())
+	if err != nil {
+		return nil, errors.Wrap(err, "can not parse topic arn")
+	}
+	if topicARN.Service != "sns" {
+		return nil, errors.Errorf("can not publish to %s resources, only to sns topics", topicARN.Service)
+	}
+
+	client := sns.New(session.Must(session.NewSession()), awsConfig().WithRegion(topicARN.Region))
+	return newAWSSNS(client, topicARN.String(), opts.Logger), nil
+}
+
+func newAWSSNS(client *sns.SNS, topicARN string, logger Logger) MessageSink {
+	return awsSNS{
+		client:   client,
+		topicARN: topicARN,
+		// FIFO topics are named like FIFO queues
+		fifo:   isFIFOQueue(topicARN),
+		logger: logger.WithFields(Fields{"component": "aws-sns-sink"}),
+	}
+}
+
+type awsSNS struct {
+	client   *sns.SNS
+	topicARN string
+	fifo     bool
+
+	logger Logger
+}
+
+// PublishPayload publishes body and payload to the topic, like
+// awsSQS.PublishPayload sends them to a queue. SNS has no delayed delivery,
+// messages with a NotBefore time are deferred by the consumers.
+func (as awsSNS) PublishPayload(body messageBody, b []byte) error {
+	bodyBytes, err := encodeMessageBody(body)
+	if err != nil {
+		return err
+	}
+
+	pi := sns.PublishInput{
+		Message:  aws.String(string(bodyBytes)),
+		TopicArn: aws.String(as.topicARN),
+		MessageAttributes: map[string]*sns.MessageAttributeValue{
+			"data": &sns.MessageAttributeValue{
+				BinaryValue: b,
+				DataType:    aws.String("Binary"),
+			},
+		},
+	}
+
+	if as.fifo {
+		groupID := body.GroupID
+		if groupID == "" {
+			groupID = defaultGroupID
+		}
+		dedupID := body.DeduplicationID
+		if dedupID == "" {
+			dedupID = contentDeduplicationID(bodyBytes, b)
+		}
+		pi.MessageGroupId = aws.String(groupID)
+		pi.MessageDeduplicationId = aws.String(dedupID)
+	} else if body.GroupID != "" || body.DeduplicationID != "" {
+		as.logger.Warnf("topic %s is no FIFO topic, ignoring message group and deduplication id", as.topicARN)
+	}
+
+	po, err := as.client.Publish(&pi)
+	if err != nil {
+		as.logger.WithFields(Fields{
+			"payload_length": len(b),
+			"message_body":   body,
+		}.logError(err)).Errorf("Error sending sns message")
+		return errors.Wrap(err, "could not publish payload to SNS")
+	}
+
+	as.logger.Infof("published payload with message id %s", *po.MessageId)
+
+	return nil
+}
+
+// snsEnvelope is the JSON a SNS notification is wrapped in when it is
+// delivered to a SQS queue without raw message delivery. See
+// https://docs.aws.amazon.com/sns/latest/dg/sns-message-and-json-formats.html
+type snsEnvelope struct {
+	Type              string
+	MessageId         string
+	TopicArn          string
+	Message           string
+	Timestamp         time.Time
+	MessageAttributes map[string]struct {
+		Type  string
+		Value string
+	}
+}
+
+// unwrapSNSEnvelope returns the message and payload of a SNS notification in
+// body, and when it was published. ok is false if body is no SNS
+// notification, as with raw message delivery, where the message attributes
+// are SQS message attributes.
+func unwrapSNSEnvelope(body []byte) (message, payload []byte, publishedAt time.Time, ok bool, err error) {
+	// message bodies are JSON objects as well, tell them apart by the
+	// fields of notifications
+	var envelope snsEnvelope
+	if err := json.Unmarshal(body, &envelope); err != nil || envelope.Type != "Notification" || envelope.TopicArn == "" {
+		return nil, nil, time.Time{}, false, nil
+	}
+
+	message, publishedAt = []byte(envelope.Message), envelope.Timestamp
+	if data, ok := envelope.MessageAttributes["data"]; ok {
+		if data.Type != "Binary" {
+			return message, nil, publishedAt, true, MalformedBodyError{fmt.Sprintf("sns notification %s has a data attribute of type %s", envelope.MessageId, data.Type)}
+		}
+		payload, err = base64.StdEncoding.DecodeString(data.Value)
+		if err != nil {
+			return message, nil, publishedAt, true, MalformedBodyError{fmt.Sprintf("sns notification %s has a malformed data attribute: %s", envelope.MessageId, err)}
+		}
+	}
+	return message, payload, publishedAt, true, nil
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/sns"
+)
+
+func Test_AWSSNS_PublishesBodyAndPayloadToTopic(t *testing.T) {
+	var published url.Values
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			t.Error(err)
+		}
+		published = r.PostForm
+		fmt.Fprint(w, `<PublishResponse><PublishResult><MessageId>sns-1</MessageId></PublishResult></PublishResponse>`)
+	}))
+	defer server.Close()
+
+	client := sns.New(session.Must(session.NewSession(&aws.Config{
+		Endpoint:    aws.String(server.URL),
+		Region:      aws.String("eu-west-1"),
+		Credentials: credentials.NewStaticCredentials("id", "secret", ""),
+	})))
+	topicARN := "arn:aws:sns:eu-west-1:11111111111:deploys"
+	sink := newAWSSNS(client, topicARN, noopLogger{})
+
+	if err := sink.PublishPayload(messageBody{Env: env{"FOO": "bar"}}, []byte("payload")); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]string{
+		"Action":                         "Publish",
+		"TopicArn":                       topicARN,
+		"Message":                        `{"version":1,"env":{"FOO":"bar"}}`,
+		"MessageAttributes.entry.1.Name": "data",
+		"MessageAttributes.entry.1.Value.DataType":    "Binary",
+		"MessageAttributes.entry.1.Value.BinaryValue": base64.StdEncoding.EncodeToString([]byte("payload")),
+	}
+	for k, v := range expected {
+		if published.Get(k) != v {
+			t.Errorf("expected %s to equal %q, got %q", k, v, published.Get(k))
+		}
+	}
+	if published.Get("MessageGroupId") != "" {
+		t.Errorf("expected no message group on a standard topic")
+	}
+}
+
+func Test_OpenSink_OnlyPublishesToSNSTopicARNs(t *testing.T) {
+	opts := TransportOptions{Logger: noopLogger{}}
+
+	_, err := OpenSink("arn:aws:sqs:eu-west-1:11111111111:example", opts)
+	if err == nil || !strings.Contains(err.Error(), "only to sns topics") {
+		t.Errorf("expected publish to a queue arn to fail, got %v", err)
+	}
+	_, err = OpenSource("arn:aws:sns:eu-west-1:11111111111:deploys", opts)
+	if err == nil {
+		t.Errorf("expected consume from a topic to fail")
+	}
+}
+
+func Test_UnwrapSNSEnvelope(t *testing.T) {
+	body := `{"version":1,"env":{"FOO":"bar"}}`
+
+	t.Run("leaves raw messages alone", func(t *testing.T) {
+		_, _, _, ok, err := unwrapSNSEnvelope([]byte(body))
+		if ok || err != nil {
+			t.Errorf("expected raw message not to be unwrapped, got %t, %v", ok, err)
+		}
+	})
+
+	t.Run("unwraps notifications", func(t *testing.T) {
+		notification := fmt.Sprintf(`{
+			"Type": "Notification",
+			"MessageId": "sns-1",
+			"TopicArn": "arn:aws:sns:eu-west-1:11111111111:deploys",
+			"Message": %q,
+			"Timestamp": "2018-06-01T00:00:00.000Z",
+			"SignatureVersion": "1",
+			"MessageAttributes": {"data": {"Type": "Binary", "Value": %q}}
+		}`, body, base64.StdEncoding.EncodeToString([]byte("payload")))
+
+		message, payload, publishedAt, ok, err := unwrapSNSEnvelope([]byte(notification))
+		if !ok || err != nil {
+			t.Fatalf("expected notification to be unwrapped, got %t, %v", ok, err)
+		}
+		if string(message) != body {
+			t.Errorf("expected message to equal %q, got %q", body, message)
+		}
+		if string(payload) != "payload" {
+			t.Errorf("expected payload to equal %q, got %q", "payload", payload)
+		}
+		if !publishedAt.Equal(time.Date(2018, time.June, 01, 0, 0, 0, 0, time.UTC)) {
+			t.Errorf("expected notification to be published at its timestamp, got %s", publishedAt)
+		}
+	})
+
+	t.Run("hands out notifications with malformed payloads for dead-lettering", func(t *testing.T) {
+		notification := fmt.Sprintf(`{
+			"Type": "Notification",
+			"TopicArn": "arn:aws:sns:eu-west-1:11111111111:deploys",
+			"Message": %q,
+			"MessageAttributes": {"data": {"Type": "Binary", "Value": "not base64!"}}
+		}`, body)
+
+		message, _, _, ok, err := unwrapSNSEnvelope([]byte(notification))
+		if !ok || string(message) != body {
+			t.Errorf("expected message of notification, got %t, %q", ok, message)
+		}
+		if !isDeadLetter(err) {
+			t.Errorf("expected dead-letter error, got %v", err)
+		}
+	})
+}
@@ -2,60 +2,173 @@ package main
 
 import (
 	"context"
-	"encoding/json"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/url"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/aws/aws-sdk-go/service/sqs/sqsiface"
 	"github.com/pkg/errors"
 )
 
-type messageBody struct {
-	Env env `json:"env"`
+func init() {
+	sqsTransport := newQueueTransport(openAWSSQS)
+	RegisterTransport("https", sqsTransport)
+	RegisterTransport("http", sqsTransport)
+	RegisterTransport("sqs", sqsTransport)
 }
 
-// NewAWSSQS returns a messageQueue to publish and receive messages over amazon SQS
-// service
-func NewAWSSQS(queueURL string, logger Logger, visibilityTimeout int64) MessageQueue {
+// awsConfig returns the aws config shared by all AWS transports
+func awsConfig() *aws.Config {
 	config := aws.NewConfig()
 	if debug {
 		config = config.WithLogLevel(aws.LogDebug | aws.LogDebugWithRequestErrors | aws.LogDebugWithHTTPBody)
 	}
-	return awsSQS{
-		client: sqs.New(
-			session.Must(session.NewSession()),
-			config,
-		),
-		logger:            logger.WithFields(Fields{"component": "aws-sqs-src"}),
+	return config
+}
+
+// NewAWSSQS returns a messageQueue to publish and receive messages over amazon SQS
+// service
+func NewAWSSQS(queueURL string, logger Logger, visibilityTimeout int64) MessageQueue {
+	return newAWSSQS(
+		sqs.New(session.Must(session.NewSession()), awsConfig()),
+		queueURL, TransportOptions{Logger: logger, VisibilityTimeout: visibilityTimeout},
+	)
+}
+
+// newAWSSQS returns an awsSQS which receives up to opts.BatchSize messages
+// at once
+func newAWSSQS(client sqsiface.SQSAPI, queueURL string, opts TransportOptions) awsSQS {
+	batchSize := int64(opts.BatchSize)
+	if batchSize < 1 {
+		batchSize = 1
+	}
+	if batchSize > sqsMaxBatchSize {
+		batchSize = sqsMaxBatchSize
+	}
+	as := awsSQS{
+		client:            client,
+		logger:            opts.Logger.WithFields(Fields{"component": "aws-sqs-src"}),
 		queueURL:          queueURL,
-		visibilityTimeout: visibilityTimeout,
+		fifo:              isFIFOQueue(queueURL),
+		visibilityTimeout: opts.VisibilityTimeout,
+		batchSize:         batchSize,
+		buffer:            newSQSReceiveBuffer(),
+	}
+	as.deletes = newSQSBatcher(as.deleteBatch)
+	as.visibilityChanges = newSQSBatcher(as.changeVisibilityBatch)
+	return as
+}
+
+// openAWSSQS opens SQS queues by their http(s) queue URL, or by name with
+// sqs://queue-name URLs. The latter are resolved in the region of the AWS
+// session, unless overridden with ?region=, and for the account of the
+// session unless overridden with ?account=.
+func openAWSSQS(u *url.URL, opts TransportOptions) (MessageQueue, error) {
+	if u.Scheme != "sqs" {
+		return newAWSSQS(sqs.New(session.Must(session.NewSession()), awsConfig()), u.String(), opts), nil
+	}
+
+	config := awsConfig()
+	if region := u.Query().Get("region"); region != "" {
+		config = config.WithRegion(region)
+	}
+	client := sqs.New(session.Must(session.NewSession()), config)
+
+	input := sqs.GetQueueUrlInput{QueueName: aws.String(u.Host)}
+	if account := u.Query().Get("account"); account != "" {
+		input.QueueOwnerAWSAccountId = aws.String(account)
+	}
+	out, err := client.GetQueueUrl(&input)
+	if err != nil {
+		return nil, errors.Wrap(err, fmt.Sprintf("can not resolve url of SQS queue %s", u.Host))
 	}
+
+	return newAWSSQS(client, *out.QueueUrl, opts), nil
+}
+
+// isFIFOQueue reports whether queueURL names a SQS FIFO queue, their names
+// must end in .fifo
+func isFIFOQueue(queueURL string) bool {
+	return strings.HasSuffix(queueURL, ".fifo")
+}
+
+// contentDeduplicationID returns a deduplication ID derived from the body
+// and payload of a message. SQS content-based deduplication only hashes the
+// body, which would drop messages with equal env but different payloads.
+func contentDeduplicationID(body, payload []byte) string {
+	h := sha256.New()
+	h.Write(body)
+	h.Write(payload)
+	return hex.EncodeToString(h.Sum(nil))
 }
 
+const (
+	// sqsMaxDelay is the maximum DelaySeconds of SQS messages
+	sqsMaxDelay = 15 * time.Minute
+	// sqsMaxVisibilityTimeout is the maximum visibility timeout of SQS
+	// messages
+	sqsMaxVisibilityTimeout = 12 * time.Hour
+)
+
+// sqsTraceAttributes are the message attributes of the W3C trace context
+var sqsTraceAttributes = []string{"traceparent", "tracestate"}
+
 type awsSQS struct {
 	// Common to publish and consume
-	client   *sqs.SQS
+	client   sqsiface.SQSAPI
 	queueURL string
+	fifo     bool
 
 	// consumer vars
 	visibilityTimeout int64
+	batchSize         int64
+	buffer            *sqsReceiveBuffer
+	deletes           *sqsBatcher
+	visibilityChanges *sqsBatcher
 
 	logger Logger
 }
 
-func (as awsSQS) PublishPayload(env map[string]string, b []byte) error {
-	body := messageBody{Env: env}
-	bodyBytes, err := json.Marshal(body)
+func (as awsSQS) PublishPayload(body messageBody, b []byte) error {
+	smi, err := as.sendMessageInput(body, b)
 	if err != nil {
-		return errors.Wrap(err, "error while marshaling message body")
+		return err
+	}
+
+	smo, err := as.client.SendMessage(smi)
+	if err != nil {
+		as.logger.WithFields(Fields{
+			"payload_length": len(b),
+			"message_body":   body,
+		}.logError(err)).Errorf("Error sending sns message")
+		return errors.Wrap(err, "could not send payload to SQS")
+	}
+
+	as.logger.Infof("published payload with message id %s", *smo.MessageId)
+
+	return nil
+}
+
+// sendMessageInput returns the input to send body and payload b
+func (as awsSQS) sendMessageInput(body messageBody, b []byte) (*sqs.SendMessageInput, error) {
+	bodyBytes, err := encodeMessageBody(body)
+	if err != nil {
+		return nil, err
 	}
 
 	// Add MessageAttributes with debug info like digest maybe
 	smi := sqs.SendMessageInput{
 		MessageBody: aws.String(string(bodyBytes)),
-		QueueUrl:    &as.queueURL,
+		QueueUrl:    aws.String(as.queueURL),
 		MessageAttributes: map[string]*sqs.MessageAttributeValue{
 			"data": &sqs.MessageAttributeValue{
 				BinaryValue: b,
@@ -64,34 +177,157 @@ func (as awsSQS) PublishPayload(env map[string]string, b []byte) error {
 		},
 	}
 
-	smo, err := as.client.SendMessage(&smi)
-	if err != nil {
-		as.logger.WithFields(Fields{
-			"payload_length": len(b),
-			"message_body":   body,
-		}.logError(err)).Errorf("Error sending sns message")
-		return errors.Wrap(err, "could not send payload to SQS")
+	// the trace context is carried in message attributes as well, for
+	// tools which follow traces through SQS
+	for _, key := range sqsTraceAttributes {
+		if v := body.Trace[key]; v != "" {
+			smi.MessageAttributes[key] = &sqs.MessageAttributeValue{
+				StringValue: aws.String(v),
+				DataType:    aws.String("String"),
+			}
+		}
 	}
 
-	as.logger.Infof("published payload with message id %s", *smo.MessageId)
+	if as.fifo {
+		groupID := body.GroupID
+		if groupID == "" {
+			groupID = defaultGroupID
+		}
+		dedupID := body.DeduplicationID
+		if dedupID == "" {
+			dedupID = contentDeduplicationID(bodyBytes, b)
+		}
+		smi.MessageGroupId = aws.String(groupID)
+		smi.MessageDeduplicationId = aws.String(dedupID)
+	} else if body.GroupID != "" || body.DeduplicationID != "" {
+		as.logger.Warnf("queue %s is no FIFO queue, ignoring message group and deduplication id", as.queueURL)
+	}
 
-	return nil
+	// delay delivery for as long as SQS allows, consumers defer the
+	// message for the remaining time. FIFO queues only support delays per
+	// queue, not per message.
+	if body.NotBefore != nil && !as.fifo {
+		delay := time.Until(*body.NotBefore)
+		if delay > sqsMaxDelay {
+			delay = sqsMaxDelay
+		}
+		if delay > 0 {
+			smi.DelaySeconds = aws.Int64(int64((delay + time.Second - 1) / time.Second))
+		}
+	}
+
+	return &smi, nil
 }
 
+// PublishPayloads sends entries with SendMessageBatch, in batches within the
+// limits of SQS. Entries which failed on the side of SQS are sent again, up
+// to sqsMaxBatchAttempts times.
+func (as awsSQS) PublishPayloads(entries []PublishEntry) []PublishResult {
+	results := make([]PublishResult, len(entries))
+	inputs := make([]*sqs.SendMessageInput, len(entries))
+	pending := make([]int, 0, len(entries))
+	for i, entry := range entries {
+		smi, err := as.sendMessageInput(entry.Body, entry.Payload)
+		if err != nil {
+			results[i].Err = err
+			continue
+		}
+		inputs[i] = smi
+		pending = append(pending, i)
+	}
+
+	for attempt := 1; len(pending) > 0; attempt++ {
+		var retry []int
+		for _, batch := range sqsSendBatches(inputs, pending) {
+			smbi := sqs.SendMessageBatchInput{QueueUrl: aws.String(as.queueURL)}
+			for _, i := range batch {
+				smbi.Entries = append(smbi.Entries, &sqs.SendMessageBatchRequestEntry{
+					Id:                     aws.String(strconv.Itoa(i)),
+					MessageBody:            inputs[i].MessageBody,
+					MessageAttributes:      inputs[i].MessageAttributes,
+					MessageGroupId:         inputs[i].MessageGroupId,
+					MessageDeduplicationId: inputs[i].MessageDeduplicationId,
+					DelaySeconds:           inputs[i].DelaySeconds,
+				})
+			}
+
+			smbo, err := as.client.SendMessageBatch(&smbi)
+			if err != nil {
+				as.logger.WithFields(Fields{"batch_size": len(batch)}.logError(err)).Error("Error sending sqs message batch")
+				for _, i := range batch {
+					results[i].Err = errors.Wrap(err, "could not send payload to SQS")
+				}
+				continue
+			}
+			for _, s := range smbo.Successful {
+				i, _ := strconv.Atoi(aws.StringValue(s.Id))
+				results[i].MessageID = aws.StringValue(s.MessageId)
+				as.logger.Infof("published payload with message id %s", results[i].MessageID)
+			}
+			for _, f := range smbo.Failed {
+				i, _ := strconv.Atoi(aws.StringValue(f.Id))
+				if !aws.BoolValue(f.SenderFault) && attempt < sqsMaxBatchAttempts {
+					retry = append(retry, i)
+					continue
+				}
+				results[i].Err = errors.Errorf("could not send payload to SQS: %s: %s", aws.StringValue(f.Code), aws.StringValue(f.Message))
+			}
+		}
+		pending = retry
+	}
+
+	return results
+}
+
+// ReceiveMessageWithContext hands out the next message of the last batch
+// receive, and receives the next batch once all were handed out.
 func (as awsSQS) ReceiveMessageWithContext(ctx context.Context) (Message, error) {
-	var (
-		receivedMsg *sqs.Message
-		msg         Message
-	)
+	for {
+		r, dropped, ok, wait := as.buffer.next()
+		as.requeue(dropped)
+		if ok {
+			return r.msg, r.err
+		}
+		if wait != nil {
+			// the buffered messages wait for their group
+			select {
+			case <-wait:
+				continue
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+		}
+
+		received, err := as.receiveBatch(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if len(received) == 0 {
+			return nil, nil
+		}
+		as.buffer.add(received)
+	}
+}
 
-	as.logger.Debugf("checking for single message on sqs queue %s", as.queueURL)
+// receiveBatch receives up to batchSize messages
+func (as awsSQS) receiveBatch(ctx context.Context) ([]sqsReceived, error) {
+	as.logger.Debugf("checking for up to %d messages on sqs queue %s", as.batchSize, as.queueURL)
 
 	rmi := sqs.ReceiveMessageInput{
-		MaxNumberOfMessages:   aws.Int64(1),
+		MaxNumberOfMessages:   aws.Int64(as.batchSize),
 		QueueUrl:              aws.String(as.queueURL),
 		VisibilityTimeout:     aws.Int64(as.visibilityTimeout),
-		AttributeNames:        []*string{aws.String("SentTimestamp")},
-		MessageAttributeNames: []*string{aws.String("data")},
+		AttributeNames:        []*string{aws.String("SentTimestamp"), aws.String("MessageGroupId"), aws.String("ApproximateReceiveCount")},
+		MessageAttributeNames: aws.StringSlice(append([]string{"data"}, sqsTraceAttributes...)),
+	}
+	if as.fifo {
+		// retries of this receive by the SDK return the same messages,
+		// instead of hiding them for the visibility timeout
+		attemptID, err := randomID()
+		if err != nil {
+			return nil, err
+		}
+		rmi.ReceiveRequestAttemptId = aws.String(attemptID)
 	}
 
 	resp, err := as.client.ReceiveMessageWithContext(ctx, &rmi)
@@ -99,22 +335,22 @@ func (as awsSQS) ReceiveMessageWithContext(ctx context.Context) (Message, error)
 		return nil, errors.Wrap(err, "receive message with context")
 	}
 
-	if len(resp.Messages) > 0 {
-		receivedMsg = resp.Messages[0]
-		as.logger.Debugf("got message, this message will be invisible to other clients for %d sec", as.visibilityTimeout)
-	} else {
+	if len(resp.Messages) == 0 {
 		as.logger.Debugf("no messages on queue")
 		return nil, nil
 	}
+	as.logger.Debugf("got %d messages, they will be invisible to other clients for %d sec", len(resp.Messages), as.visibilityTimeout)
 
-	data := []byte{}
-
-	dataAttr, ok := receivedMsg.MessageAttributes["data"]
-	if ok {
-		data = dataAttr.BinaryValue
-	} else {
-		as.logger.Warnf("received no data attribute")
+	received := make([]sqsReceived, 0, len(resp.Messages))
+	for _, receivedMsg := range resp.Messages {
+		received = append(received, as.message(receivedMsg))
 	}
+	return received, nil
+}
+
+// message converts a received SQS message
+func (as awsSQS) message(receivedMsg *sqs.Message) sqsReceived {
+	r := sqsReceived{receiptHandle: aws.StringValue(receivedMsg.ReceiptHandle)}
 
 	sentAt := time.Time{}
 	sentAtAttr, ok := receivedMsg.Attributes["SentTimestamp"]
@@ -131,40 +367,177 @@ func (as awsSQS) ReceiveMessageWithContext(ctx context.Context) (Message, error)
 		as.logger.Warn("received no SentTimestamp attribute")
 	}
 
-	var body messageBody
-	err = json.Unmarshal([]byte(*receivedMsg.Body), &body)
-	if err != nil {
-		as.logger.WithFields(ErrorFields(err)).Warn("error while unmarshaling SQS message body")
+	receiveCount := 0
+	if countAttr, ok := receivedMsg.Attributes["ApproximateReceiveCount"]; ok {
+		var err error
+		receiveCount, err = strconv.Atoi(*countAttr)
+		if err != nil {
+			as.logger.WithFields(Fields{
+				"approximate_receive_count": countAttr,
+			}.logError(err)).Warn("malformed approximate receive count")
+		}
+	}
+
+	if receivedMsg.Body == nil {
+		as.logger.Debugf("got message with empty payload, message will be deleted")
+		r.err = errors.Errorf("message body was empty %s", *receivedMsg.MessageId)
+		return r
+	}
+
+	rawBody := []byte(*receivedMsg.Body)
+	data := []byte{}
+	dataAttr, hasData := receivedMsg.MessageAttributes["data"]
+	if hasData {
+		data = dataAttr.BinaryValue
+	}
+
+	// messages published to a SNS topic arrive wrapped in a notification,
+	// unless the subscription has raw message delivery enabled
+	message, notificationData, publishedAt, isNotification, notificationErr := unwrapSNSEnvelope(rawBody)
+	if isNotification {
+		as.logger.Debugf("unwrapping sns notification")
+		rawBody = message
+		if !publishedAt.IsZero() {
+			sentAt = publishedAt
+		}
+		if !hasData && notificationData != nil {
+			data = notificationData
+			hasData = true
+		}
+	}
+	if !hasData {
+		as.logger.Warnf("received no data attribute")
+	}
+
+	body, bodyErr := decodeMessageBody(rawBody)
+	if bodyErr == nil {
+		bodyErr = notificationErr
+	}
+	if body.Trace == nil {
+		for _, key := range sqsTraceAttributes {
+			if attr, ok := receivedMsg.MessageAttributes[key]; ok && attr.StringValue != nil {
+				if body.Trace == nil {
+					body.Trace = map[string]string{}
+				}
+				body.Trace[key] = *attr.StringValue
+			}
+		}
+	}
+	if groupAttr, ok := receivedMsg.Attributes["MessageGroupId"]; ok {
+		if body.GroupID == "" {
+			body.GroupID = *groupAttr
+		}
+		// the group of the queue orders the messages, not the one in
+		// the body
+		r.group = *groupAttr
 	}
 
-	msg = awsSQSMessage{
+	// the group is released once the message left the buffer's hands, the
+	// first time only, as the group may be in flight with the next message
+	// afterwards
+	var released sync.Once
+	release := func(deleted bool) {
+		if r.group != "" {
+			released.Do(func() {
+				as.requeue(as.buffer.release(r.group, deleted))
+			})
+		}
+	}
+
+	r.msg = awsSQSMessage{
 		id:            *receivedMsg.MessageId,
 		receiptHandle: *receivedMsg.ReceiptHandle,
 		sentAt:        sentAt,
+		receiveCount:  receiveCount,
 		body:          body,
 		payload:       data,
 		deleteFn: func() error {
-			if _, err := as.client.DeleteMessage(&sqs.DeleteMessageInput{
-				QueueUrl:      &as.queueURL,
-				ReceiptHandle: receivedMsg.ReceiptHandle,
-			}); err != nil {
-				return errors.Errorf("aws-sqs-message: could not delete message with id %s", *receivedMsg.MessageId)
+			err := as.deletes.do(*receivedMsg.ReceiptHandle, 0)
+			release(err == nil)
+			if err != nil {
+				return errors.Wrap(err, fmt.Sprintf("aws-sqs-message: could not delete message with id %s", *receivedMsg.MessageId))
 			}
 			as.logger.WithFields(Fields{
 				"message_id": *receivedMsg.MessageId,
 			}).Infof("aws-sqs-message: deleted message")
 			return nil
 		},
+		changeVisibilityFn: func(timeout time.Duration) error {
+			if timeout > sqsMaxVisibilityTimeout {
+				timeout = sqsMaxVisibilityTimeout
+			}
+			err := as.visibilityChanges.do(*receivedMsg.ReceiptHandle, int64(timeout/time.Second))
+			release(false)
+			if err != nil {
+				return errors.Wrap(err, fmt.Sprintf("aws-sqs-message: could not change visibility of message with id %s", *receivedMsg.MessageId))
+			}
+			return nil
+		},
+		finishFn: func() { release(false) },
 	}
 
-	if receivedMsg.Body == nil {
-		as.logger.Debugf("got message with empty payload, message will be deleted")
-		return nil, errors.Errorf("message body was empty %s", *receivedMsg.MessageId)
+	as.logger.Infof("message body checksum was md5: %s", aws.StringValue(receivedMsg.MD5OfBody))
+
+	if bodyErr != nil {
+		// the message is handed out alongside the error, so that it can
+		// be dead-lettered
+		r.err = errors.Wrap(bodyErr, fmt.Sprintf("can not decode body of message %s", *receivedMsg.MessageId))
 	}
+	return r
+}
 
-	as.logger.Infof("message body checksum was md5: %s", *receivedMsg.MD5OfBody)
+// requeue makes dropped messages visible again right away, so that SQS
+// redelivers them
+func (as awsSQS) requeue(dropped []sqsReceived) {
+	for _, r := range dropped {
+		go func(r sqsReceived) {
+			if err := as.visibilityChanges.do(r.receiptHandle, 0); err != nil {
+				as.logger.WithFields(ErrorFields(err)).Warn("could not make message visible again, it will be redelivered after the visibility timeout")
+			}
+		}(r)
+	}
+}
+
+// deleteBatch deletes the messages of entries
+func (as awsSQS) deleteBatch(entries []*sqsBatchEntry) ([]*sqs.BatchResultErrorEntry, error) {
+	input := sqs.DeleteMessageBatchInput{QueueUrl: aws.String(as.queueURL)}
+	for _, entry := range entries {
+		input.Entries = append(input.Entries, &sqs.DeleteMessageBatchRequestEntry{
+			Id:            aws.String(entry.id),
+			ReceiptHandle: aws.String(entry.receiptHandle),
+		})
+	}
+	out, err := as.client.DeleteMessageBatch(&input)
+	if err != nil {
+		return nil, err
+	}
+	return out.Failed, nil
+}
+
+// changeVisibilityBatch changes the visibility of the messages of entries
+func (as awsSQS) changeVisibilityBatch(entries []*sqsBatchEntry) ([]*sqs.BatchResultErrorEntry, error) {
+	input := sqs.ChangeMessageVisibilityBatchInput{QueueUrl: aws.String(as.queueURL)}
+	for _, entry := range entries {
+		input.Entries = append(input.Entries, &sqs.ChangeMessageVisibilityBatchRequestEntry{
+			Id:                aws.String(entry.id),
+			ReceiptHandle:     aws.String(entry.receiptHandle),
+			VisibilityTimeout: aws.Int64(entry.visibilityTimeout),
+		})
+	}
+	out, err := as.client.ChangeMessageVisibilityBatch(&input)
+	if err != nil {
+		return nil, err
+	}
+	return out.Failed, nil
+}
 
-	return msg, nil
+// randomID returns a random hex encoded 128 bit ID
+func randomID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", errors.Wrap(err, "can not read random bytes")
+	}
+	return hex.EncodeToString(b), nil
 }
 
 // An awsSQSMessage represents a SQS message. See
@@ -174,13 +547,26 @@ type awsSQSMessage struct {
 	id            string
 	receiptHandle string
 	sentAt        time.Time
+	receiveCount  int
 	body          messageBody
 	payload       []byte
 	deleteFn      func() error
+
+	changeVisibilityFn func(time.Duration) error
+	finishFn           func()
 }
 
 func (asm awsSQSMessage) ID() string        { return asm.id }
 func (asm awsSQSMessage) SentAt() time.Time { return asm.sentAt }
 func (asm awsSQSMessage) Body() messageBody { return asm.body }
 func (asm awsSQSMessage) Payload() []byte   { return asm.payload }
+func (asm awsSQSMessage) ReceiveCount() int { return asm.receiveCount }
 func (asm awsSQSMessage) Delete() error     { return asm.deleteFn() }
+
+func (asm awsSQSMessage) ChangeVisibility(timeout time.Duration) error {
+	return asm.changeVisibilityFn(timeout)
+}
+
+// Finish releases the FIFO group of the message, if it was neither deleted
+// nor its visibility changed
+func (asm awsSQSMessage) Finish() { asm.finishFn() }
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/pkg/errors"
+)
+
+const (
+	// sqsMaxBatchSize is the maximum number of messages SQS receives,
+	// deletes or changes the visibility of in one call
+	sqsMaxBatchSize = 10
+	// sqsMaxBatchBytes is the maximum size of the messages sent in one call
+	sqsMaxBatchBytes = 256 << 10
+	// sqsBatchInterval is how long deletes and visibility changes are
+	// collected before they are sent in a batch
+	sqsBatchInterval = 100 * time.Millisecond
+	// sqsMaxBatchAttempts is the number of times an entry which failed for
+	// reasons on the side of SQS is sent
+	sqsMaxBatchAttempts = 3
+)
+
+// sqsSendBatches splits the inputs at indexes into batches within the
+// number and size limits of SendMessageBatch. An input larger than the size
+// limit is sent on its own, for SQS to reject it.
+func sqsSendBatches(inputs []*sqs.SendMessageInput, indexes []int) [][]int {
+	var (
+		batches [][]int
+		batch   []int
+		size    int
+	)
+	for _, i := range indexes {
+		inputSize := len(aws.StringValue(inputs[i].MessageBody))
+		for name, attr := range inputs[i].MessageAttributes {
+			inputSize += len(name) + len(aws.StringValue(attr.DataType)) + len(attr.BinaryValue) + len(aws.StringValue(attr.StringValue))
+		}
+		if len(batch) == sqsMaxBatchSize || (len(batch) > 0 && size+inputSize > sqsMaxBatchBytes) {
+			batches = append(batches, batch)
+			batch, size = nil, 0
+		}
+		batch = append(batch, i)
+		size += inputSize
+	}
+	if len(batch) > 0 {
+		batches = append(batches, batch)
+	}
+	return batches
+}
+
+// A sqsReceived is a message of a batch receive, or the error it could not
+// be handed out with
+type sqsReceived struct {
+	msg           Message
+	receiptHandle string
+	// group is the message group on FIFO queues
+	group string
+	err   error
+}
+
+// sqsReceiveBuffer holds the messages of a batch receive until workers ask
+// for them. On FIFO queues it hands out one message per message group at a
+// time, so that the messages of a group are still executed in order.
+type sqsReceiveBuffer struct {
+	mu       sync.Mutex
+	received []sqsReceived
+	inFlight map[string]bool
+	// released is closed when a group is released, and replaced
+	released chan struct{}
+}
+
+func newSQSReceiveBuffer() *sqsReceiveBuffer {
+	return &sqsReceiveBuffer{
+		inFlight: map[string]bool{},
+		released: make(chan struct{}),
+	}
+}
+
+func (rb *sqsReceiveBuffer) add(received []sqsReceived) {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+	rb.received = append(rb.received, received...)
+}
+
+// next returns the first buffered message whose group isn't in flight. If
+// there is none, but the buffer isn't empty, it returns a channel which is
+// closed once a group is released. Messages handed out with an error aren't
+// handled, the remaining messages of their group are dropped and returned
+// with them, to be made visible again.
+func (rb *sqsReceiveBuffer) next() (r sqsReceived, dropped []sqsReceived, ok bool, wait <-chan struct{}) {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+
+	for i, r := range rb.received {
+		if r.group != "" && rb.inFlight[r.group] {
+			continue
+		}
+		rb.received = append(rb.received[:i:i], rb.received[i+1:]...)
+		if r.group != "" {
+			if r.err != nil {
+				dropped = rb.drop(r.group)
+			} else {
+				rb.inFlight[r.group] = true
+			}
+		}
+		return r, dropped, true, nil
+	}
+	if len(rb.received) > 0 {
+		return sqsReceived{}, nil, false, rb.released
+	}
+	return sqsReceived{}, nil, false, nil
+}
+
+// release ends the flight of group. Unless the message of the group was
+// deleted, the remaining messages of the group are dropped and returned, as
+// SQS redelivers them after the message which is still on the queue.
+func (rb *sqsReceiveBuffer) release(group string, deleted bool) (dropped []sqsReceived) {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+
+	delete(rb.inFlight, group)
+	if !deleted {
+		dropped = rb.drop(group)
+	}
+	close(rb.released)
+	rb.released = make(chan struct{})
+	return dropped
+}
+
+// drop removes the buffered messages of group. It must be called with rb.mu
+// held.
+func (rb *sqsReceiveBuffer) drop(group string) (dropped []sqsReceived) {
+	kept := rb.received[:0]
+	for _, r := range rb.received {
+		if r.group == group {
+			dropped = append(dropped, r)
+		} else {
+			kept = append(kept, r)
+		}
+	}
+	rb.received = kept
+	return dropped
+}
+
+// A sqsBatchEntry is a delete or visibility change waiting to be sent in a
+// batch
+type sqsBatchEntry struct {
+	// id identifies the entry within the batch it is sent in
+	id                string
+	receiptHandle     string
+	visibilityTimeout int64
+	attempts          int
+	result            chan error
+}
+
+// sqsBatcher collects entries for sqsBatchInterval, or until there are
+// sqsMaxBatchSize of them, and sends them in one call. Entries which failed
+// because of SQS are sent again with the next batch, up to
+// sqsMaxBatchAttempts times, entries which failed because of the request
+// fail right away.
+type sqsBatcher struct {
+	// send sends a batch and returns its failed entries
+	send     func([]*sqsBatchEntry) ([]*sqs.BatchResultErrorEntry, error)
+	interval time.Duration
+
+	mu      sync.Mutex
+	pending []*sqsBatchEntry
+	timer   *time.Timer
+}
+
+func newSQSBatcher(send func([]*sqsBatchEntry) ([]*sqs.BatchResultErrorEntry, error)) *sqsBatcher {
+	return &sqsBatcher{send: send, interval: sqsBatchInterval}
+}
+
+// do sends an entry for receiptHandle with the next batch, and waits for its
+// result
+func (b *sqsBatcher) do(receiptHandle string, visibilityTimeout int64) error {
+	entry := &sqsBatchEntry{
+		receiptHandle:     receiptHandle,
+		visibilityTimeout: visibilityTimeout,
+		result:            make(chan error, 1),
+	}
+	b.add(entry)
+	return <-entry.result
+}
+
+func (b *sqsBatcher) add(entries ...*sqsBatchEntry) {
+	b.mu.Lock()
+	b.pending = append(b.pending, entries...)
+	var full [][]*sqsBatchEntry
+	for len(b.pending) >= sqsMaxBatchSize {
+		full = append(full, b.pending[:sqsMaxBatchSize:sqsMaxBatchSize])
+		b.pending = b.pending[sqsMaxBatchSize:]
+	}
+	if len(b.pending) > 0 && b.timer == nil {
+		b.timer = time.AfterFunc(b.interval, b.flushPending)
+	}
+	b.mu.Unlock()
+
+	for _, batch := range full {
+		b.flush(batch)
+	}
+}
+
+// flushPending sends the entries collected since the last flush
+func (b *sqsBatcher) flushPending() {
+	b.mu.Lock()
+	pending := b.pending
+	b.pending = nil
+	b.timer = nil
+	b.mu.Unlock()
+
+	if len(pending) > 0 {
+		b.flush(pending)
+	}
+}
+
+// flush sends batch, which holds at most sqsMaxBatchSize entries
+func (b *sqsBatcher) flush(batch []*sqsBatchEntry) {
+	for i, entry := range batch {
+		entry.id = strconv.Itoa(i)
+		entry.attempts++
+	}
+
+	failed, err := b.send(batch)
+	if err != nil {
+		// the SDK already retried the call
+		for _, entry := range batch {
+			entry.result <- err
+		}
+		return
+	}
+
+	failures := make(map[string]*sqs.BatchResultErrorEntry, len(failed))
+	for _, f := range failed {
+		failures[aws.StringValue(f.Id)] = f
+	}
+	var retry []*sqsBatchEntry
+	for _, entry := range batch {
+		f, ok := failures[entry.id]
+		switch {
+		case !ok:
+			entry.result <- nil
+		case !aws.BoolValue(f.SenderFault) && entry.attempts < sqsMaxBatchAttempts:
+			retry = append(retry, entry)
+		default:
+			entry.result <- errors.Errorf("%s: %s", aws.StringValue(f.Code), aws.StringValue(f.Message))
+		}
+	}
+	if len(retry) > 0 {
+		b.add(retry...)
+	}
+}
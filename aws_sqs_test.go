@@ -0,0 +1,445 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/aws/aws-sdk-go/service/sqs/sqsiface"
+)
+
+func Test_IsFIFOQueue(t *testing.T) {
+	tests := map[string]bool{
+		"https://sqs.eu-west-1.amazonaws.com/11111111111/example":      false,
+		"https://sqs.eu-west-1.amazonaws.com/11111111111/example.fifo": true,
+		"https://sqs.eu-west-1.amazonaws.com/11111111111/fifo":         false,
+	}
+
+	for queueURL, expected := range tests {
+		if actual := isFIFOQueue(queueURL); actual != expected {
+			t.Errorf("expected isFIFOQueue(%q) to equal %t, got %t", queueURL, expected, actual)
+		}
+	}
+}
+
+func Test_ContentDeduplicationID_DependsOnBodyAndPayload(t *testing.T) {
+	id := contentDeduplicationID([]byte(`{"env":{}}`), []byte("payload"))
+
+	if len(id) > 128 {
+		t.Errorf("expected deduplication id to be at most 128 characters, got %d", len(id))
+	}
+	if id != contentDeduplicationID([]byte(`{"env":{}}`), []byte("payload")) {
+		t.Errorf("expected deduplication id to be deterministic")
+	}
+	if id == contentDeduplicationID([]byte(`{"env":{}}`), []byte("other payload")) {
+		t.Errorf("expected deduplication id to depend on the payload")
+	}
+	if id == contentDeduplicationID([]byte(`{"env":{"FOO":"bar"}}`), []byte("payload")) {
+		t.Errorf("expected deduplication id to depend on the body")
+	}
+}
+
+// fakeSQS hands out queued batches of messages, and records batch deletes
+// and visibility changes. failures maps receipt handles to the errors their
+// entries fail with once.
+type fakeSQS struct {
+	sqsiface.SQSAPI
+
+	mu                sync.Mutex
+	batches           [][]*sqs.Message
+	receives          []*sqs.ReceiveMessageInput
+	deletes           [][]string
+	sends             [][]string
+	visibilityChanges map[string]int64
+	failures          map[string]*sqs.BatchResultErrorEntry
+}
+
+func (fs *fakeSQS) ReceiveMessageWithContext(ctx aws.Context, input *sqs.ReceiveMessageInput, opts ...request.Option) (*sqs.ReceiveMessageOutput, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.receives = append(fs.receives, input)
+	if len(fs.batches) == 0 {
+		return &sqs.ReceiveMessageOutput{}, nil
+	}
+	batch := fs.batches[0]
+	fs.batches = fs.batches[1:]
+	return &sqs.ReceiveMessageOutput{Messages: batch}, nil
+}
+
+// fail returns the failure of receiptHandle, if there is one left. It must
+// be called with fs.mu held.
+func (fs *fakeSQS) fail(id, receiptHandle string) *sqs.BatchResultErrorEntry {
+	f, ok := fs.failures[receiptHandle]
+	if !ok {
+		return nil
+	}
+	delete(fs.failures, receiptHandle)
+	failure := *f
+	failure.Id = aws.String(id)
+	return &failure
+}
+
+func (fs *fakeSQS) DeleteMessageBatch(input *sqs.DeleteMessageBatchInput) (*sqs.DeleteMessageBatchOutput, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	out := &sqs.DeleteMessageBatchOutput{}
+	var deleted []string
+	for _, entry := range input.Entries {
+		if f := fs.fail(*entry.Id, *entry.ReceiptHandle); f != nil {
+			out.Failed = append(out.Failed, f)
+			continue
+		}
+		deleted = append(deleted, *entry.ReceiptHandle)
+	}
+	fs.deletes = append(fs.deletes, deleted)
+	return out, nil
+}
+
+// SendMessageBatch fails the entries whose payload is in failures, and
+// assigns the others the message id msg-<payload>
+func (fs *fakeSQS) SendMessageBatch(input *sqs.SendMessageBatchInput) (*sqs.SendMessageBatchOutput, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	out := &sqs.SendMessageBatchOutput{}
+	var sent []string
+	for _, entry := range input.Entries {
+		payload := string(entry.MessageAttributes["data"].BinaryValue)
+		sent = append(sent, payload)
+		if f := fs.fail(*entry.Id, payload); f != nil {
+			out.Failed = append(out.Failed, f)
+			continue
+		}
+		out.Successful = append(out.Successful, &sqs.SendMessageBatchResultEntry{
+			Id:        entry.Id,
+			MessageId: aws.String("msg-" + payload),
+		})
+	}
+	fs.sends = append(fs.sends, sent)
+	return out, nil
+}
+
+func (fs *fakeSQS) ChangeMessageVisibilityBatch(input *sqs.ChangeMessageVisibilityBatchInput) (*sqs.ChangeMessageVisibilityBatchOutput, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	out := &sqs.ChangeMessageVisibilityBatchOutput{}
+	for _, entry := range input.Entries {
+		if f := fs.fail(*entry.Id, *entry.ReceiptHandle); f != nil {
+			out.Failed = append(out.Failed, f)
+			continue
+		}
+		fs.visibilityChanges[*entry.ReceiptHandle] = *entry.VisibilityTimeout
+	}
+	return out, nil
+}
+
+// fakeSQSMessage returns a received SQS message of group, whose receipt
+// handle is its id
+func fakeSQSMessage(id, group string) *sqs.Message {
+	msg := &sqs.Message{
+		MessageId:     aws.String(id),
+		ReceiptHandle: aws.String(id),
+		Body:          aws.String(`{"version":1,"env":{}}`),
+		MD5OfBody:     aws.String("md5"),
+		Attributes: map[string]*string{
+			"SentTimestamp":           aws.String("1527811200000"),
+			"ApproximateReceiveCount": aws.String("1"),
+		},
+	}
+	if group != "" {
+		msg.Attributes["MessageGroupId"] = aws.String(group)
+	}
+	return msg
+}
+
+func newTestAWSSQS(queueURL string, batchSize int, batches ...[]*sqs.Message) (awsSQS, *fakeSQS) {
+	client := &fakeSQS{
+		batches:           batches,
+		visibilityChanges: map[string]int64{},
+		failures:          map[string]*sqs.BatchResultErrorEntry{},
+	}
+	as := newAWSSQS(client, queueURL, TransportOptions{
+		Logger:            noopLogger{},
+		VisibilityTimeout: 30,
+		BatchSize:         batchSize,
+	})
+	return as, client
+}
+
+func Test_AWSSQS_ReceivesAndDeletesMessagesInBatches(t *testing.T) {
+	as, client := newTestAWSSQS("https://sqs.eu-west-1.amazonaws.com/11111111111/example", 3,
+		[]*sqs.Message{fakeSQSMessage("a", ""), fakeSQSMessage("b", ""), fakeSQSMessage("c", "")},
+	)
+
+	var msgs []Message
+	for i := 0; i < 3; i++ {
+		msg, err := as.ReceiveMessageWithContext(context.TODO())
+		if err != nil || msg == nil {
+			t.Fatalf("expected message, got %v, %v", msg, err)
+		}
+		msgs = append(msgs, msg)
+	}
+	if len(client.receives) != 1 || *client.receives[0].MaxNumberOfMessages != 3 {
+		t.Fatalf("expected one receive of 3 messages, got %d receives", len(client.receives))
+	}
+
+	var wg sync.WaitGroup
+	for _, msg := range msgs {
+		wg.Add(1)
+		go func(msg Message) {
+			defer wg.Done()
+			if err := msg.Delete(); err != nil {
+				t.Error(err)
+			}
+		}(msg)
+	}
+	wg.Wait()
+
+	if len(client.deletes) != 1 || len(client.deletes[0]) != 3 {
+		t.Errorf("expected messages to be deleted in one batch, got %v", client.deletes)
+	}
+
+	msg, err := as.ReceiveMessageWithContext(context.TODO())
+	if msg != nil || err != nil {
+		t.Errorf("expected no message once the queue is empty, got %v, %v", msg, err)
+	}
+}
+
+func Test_AWSSQS_HandsOutOneMessagePerFIFOGroup(t *testing.T) {
+	queueURL := "https://sqs.eu-west-1.amazonaws.com/11111111111/example.fifo"
+
+	receive := func(t *testing.T, as awsSQS, expectedID string) Message {
+		t.Helper()
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		msg, err := as.ReceiveMessageWithContext(ctx)
+		if expectedID == "" {
+			if err != context.DeadlineExceeded {
+				t.Fatalf("expected receive to wait for the group, got %v, %v", msg, err)
+			}
+			return nil
+		}
+		if err != nil || msg == nil || msg.ID() != expectedID {
+			t.Fatalf("expected message %s, got %v, %v", expectedID, msg, err)
+		}
+		return msg
+	}
+
+	t.Run("hands out the next message of a group once the previous one was deleted", func(t *testing.T) {
+		as, _ := newTestAWSSQS(queueURL, 10,
+			[]*sqs.Message{fakeSQSMessage("a1", "a"), fakeSQSMessage("a2", "a"), fakeSQSMessage("b1", "b")},
+		)
+
+		a1 := receive(t, as, "a1")
+		b1 := receive(t, as, "b1")
+		receive(t, as, "")
+		if err := a1.Delete(); err != nil {
+			t.Fatal(err)
+		}
+		receive(t, as, "a2")
+		if err := b1.Delete(); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("drops the remaining messages of a group whose message stays on the queue", func(t *testing.T) {
+		as, client := newTestAWSSQS(queueURL, 10,
+			[]*sqs.Message{fakeSQSMessage("a1", "a"), fakeSQSMessage("a2", "a"), fakeSQSMessage("a3", "a")},
+		)
+
+		a1 := receive(t, as, "a1")
+		if err := a1.ChangeVisibility(time.Minute); err != nil {
+			t.Fatal(err)
+		}
+		msg, err := as.ReceiveMessageWithContext(context.TODO())
+		if msg != nil || err != nil {
+			t.Fatalf("expected no message, got %v, %v", msg, err)
+		}
+		if len(client.receives) != 2 {
+			t.Errorf("expected a new receive once the group was dropped, got %d receives", len(client.receives))
+		}
+
+		// the dropped messages are made visible in the background
+		time.Sleep(2 * sqsBatchInterval)
+		client.mu.Lock()
+		defer client.mu.Unlock()
+		expected := map[string]int64{"a1": 60, "a2": 0, "a3": 0}
+		if !reflect.DeepEqual(expected, client.visibilityChanges) {
+			t.Errorf("expected visibility changes %v, got %v", expected, client.visibilityChanges)
+		}
+	})
+}
+
+func Test_Gantry_ReleasesFIFOGroupsOfMessagesLeftOnTheQueue(t *testing.T) {
+	as, client := newTestAWSSQS("https://sqs.eu-west-1.amazonaws.com/11111111111/example.fifo", 10,
+		[]*sqs.Message{fakeSQSMessage("a1", "a"), fakeSQSMessage("a2", "a")},
+	)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	// the messages were sent in 2018, they are left for the dead-letter
+	// queue without deleting them or changing their visibility
+	g := Gantry{ctx: ctx, src: as, maxMessageAge: time.Hour, deadLetterExpired: true, logger: noopLogger{}}
+	if _, err := g.handleNext(); !isDeadLetter(err) {
+		t.Fatalf("expected expired message to be dead-lettered, got %v", err)
+	}
+	msg, err := as.ReceiveMessageWithContext(ctx)
+	if msg != nil || err != nil {
+		t.Fatalf("expected the rest of the group to be dropped, got %v, %v", msg, err)
+	}
+	if len(client.receives) != 2 {
+		t.Errorf("expected a new receive once the group was released, got %d receives", len(client.receives))
+	}
+}
+
+func Test_SQSBatcher_RetriesEntriesWhichFailedOnTheSideOfSQS(t *testing.T) {
+	as, client := newTestAWSSQS("https://sqs.eu-west-1.amazonaws.com/11111111111/example", 1)
+	client.failures["transient"] = &sqs.BatchResultErrorEntry{
+		Code:        aws.String("InternalError"),
+		SenderFault: aws.Bool(false),
+	}
+	client.failures["invalid"] = &sqs.BatchResultErrorEntry{
+		Code:        aws.String("ReceiptHandleIsInvalid"),
+		Message:     aws.String("the receipt handle is invalid"),
+		SenderFault: aws.Bool(true),
+	}
+
+	results := map[string]error{}
+	var (
+		mu sync.Mutex
+		wg sync.WaitGroup
+	)
+	for _, receiptHandle := range []string{"ok", "transient", "invalid"} {
+		wg.Add(1)
+		go func(receiptHandle string) {
+			defer wg.Done()
+			err := as.deletes.do(receiptHandle, 0)
+			mu.Lock()
+			results[receiptHandle] = err
+			mu.Unlock()
+		}(receiptHandle)
+	}
+	wg.Wait()
+
+	if results["ok"] != nil {
+		t.Errorf("expected delete to succeed, got %v", results["ok"])
+	}
+	if results["transient"] != nil {
+		t.Errorf("expected delete to succeed once retried, got %v", results["transient"])
+	}
+	if err := results["invalid"]; err == nil || err.Error() != "ReceiptHandleIsInvalid: the receipt handle is invalid" {
+		t.Errorf("expected delete to fail without retry, got %v", err)
+	}
+	if len(client.deletes) != 2 || !reflect.DeepEqual(client.deletes[1], []string{"transient"}) {
+		t.Errorf("expected only the transient failure to be retried, got %v", client.deletes)
+	}
+
+	t.Run("gives up after the maximum number of attempts", func(t *testing.T) {
+		calls := 0
+		b := newSQSBatcher(func(entries []*sqsBatchEntry) ([]*sqs.BatchResultErrorEntry, error) {
+			calls++
+			return []*sqs.BatchResultErrorEntry{
+				{Id: aws.String(entries[0].id), Code: aws.String("InternalError"), SenderFault: aws.Bool(false)},
+			}, nil
+		})
+		b.interval = time.Millisecond
+
+		if err := b.do("transient", 0); err == nil {
+			t.Errorf("expected entry to fail eventually")
+		}
+		if calls != sqsMaxBatchAttempts {
+			t.Errorf("expected %d attempts, got %d", sqsMaxBatchAttempts, calls)
+		}
+	})
+}
+
+func Test_AWSSQS_PublishesPayloadsInBatches(t *testing.T) {
+	as, client := newTestAWSSQS("https://sqs.eu-west-1.amazonaws.com/11111111111/example", 1)
+	client.failures["transient"] = &sqs.BatchResultErrorEntry{
+		Code:        aws.String("InternalError"),
+		SenderFault: aws.Bool(false),
+	}
+	client.failures["too large"] = &sqs.BatchResultErrorEntry{
+		Code:        aws.String("BatchEntryTooLong"),
+		Message:     aws.String("the message is too long"),
+		SenderFault: aws.Bool(true),
+	}
+
+	var entries []PublishEntry
+	for _, payload := range []string{"transient", "too large", "1", "2", "3", "4", "5", "6", "7", "8", "9"} {
+		entries = append(entries, PublishEntry{Payload: []byte(payload)})
+	}
+	results := as.PublishPayloads(entries)
+
+	for i, result := range results {
+		switch i {
+		case 1:
+			if result.Err == nil || !strings.Contains(result.Err.Error(), "BatchEntryTooLong") {
+				t.Errorf("expected entry to fail without retry, got %+v", result)
+			}
+		default:
+			if result.Err != nil || result.MessageID != "msg-"+string(entries[i].Payload) {
+				t.Errorf("expected entry %d to be published, got %+v", i, result)
+			}
+		}
+	}
+
+	expected := [][]string{
+		{"transient", "too large", "1", "2", "3", "4", "5", "6", "7", "8"},
+		{"9"},
+		{"transient"},
+	}
+	if !reflect.DeepEqual(expected, client.sends) {
+		t.Errorf("expected batches %v, got %v", expected, client.sends)
+	}
+}
+
+func Test_SQSSendBatches_StaysWithinTheLimitsOfSQS(t *testing.T) {
+	input := func(size int) *sqs.SendMessageInput {
+		return &sqs.SendMessageInput{
+			MessageBody: aws.String("{}"),
+			MessageAttributes: map[string]*sqs.MessageAttributeValue{
+				"data": {DataType: aws.String("Binary"), BinaryValue: make([]byte, size)},
+			},
+		}
+	}
+	inputs := []*sqs.SendMessageInput{input(100 << 10), input(100 << 10), input(100 << 10), input(300 << 10), input(1)}
+
+	batches := sqsSendBatches(inputs, []int{0, 1, 2, 3, 4})
+	expected := [][]int{{0, 1}, {2}, {3}, {4}}
+	if !reflect.DeepEqual(expected, batches) {
+		t.Errorf("expected batches %v, got %v", expected, batches)
+	}
+}
+
+func Test_AWSSQS_CarriesTraceInMessageAttributes(t *testing.T) {
+	as, _ := newTestAWSSQS("https://sqs.eu-west-1.amazonaws.com/11111111111/example", 1)
+	traceparent := "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01"
+
+	smi, err := as.sendMessageInput(messageBody{Trace: map[string]string{"traceparent": traceparent}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if attr := smi.MessageAttributes["traceparent"]; attr == nil || *attr.StringValue != traceparent {
+		t.Errorf("expected traceparent message attribute, got %v", attr)
+	}
+
+	// consumers pick up the trace of publishers which only set the
+	// attributes
+	received := fakeSQSMessage("a", "")
+	received.MessageAttributes = map[string]*sqs.MessageAttributeValue{
+		"traceparent": {DataType: aws.String("String"), StringValue: aws.String(traceparent)},
+	}
+	r := as.message(received)
+	if r.err != nil {
+		t.Fatal(r.err)
+	}
+	if r.msg.Body().Trace["traceparent"] != traceparent {
+		t.Errorf("expected trace of message attributes, got %v", r.msg.Body().Trace)
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"text/tabwriter"
+
+	"github.com/pkg/errors"
+)
+
+// expandDirs returns the directories of patterns, which are paths or globs.
+// Globs must match at least one directory, files they match are skipped.
+// Every directory is returned once.
+func expandDirs(patterns []string) ([]string, error) {
+	var (
+		dirs []string
+		seen = map[string]bool{}
+	)
+	for _, pattern := range patterns {
+		matches := []string{pattern}
+		if hasGlobMeta(pattern) {
+			globbed, err := filepath.Glob(pattern)
+			if err != nil {
+				return nil, errors.Wrap(err, fmt.Sprintf("malformed -dir pattern %q", pattern))
+			}
+			matches = nil
+			for _, match := range globbed {
+				if fi, err := os.Stat(match); err == nil && fi.IsDir() {
+					matches = append(matches, match)
+				}
+			}
+			if len(matches) == 0 {
+				return nil, errors.Errorf("-dir pattern %q matches no directory", pattern)
+			}
+		}
+
+		for _, dir := range matches {
+			if seen[filepath.Clean(dir)] {
+				continue
+			}
+			seen[filepath.Clean(dir)] = true
+			dirs = append(dirs, dir)
+		}
+	}
+	return dirs, nil
+}
+
+// hasGlobMeta reports whether pattern contains glob meta characters
+func hasGlobMeta(pattern string) bool {
+	for _, c := range pattern {
+		switch c {
+		case '*', '?', '[', '\\':
+			return true
+		}
+	}
+	return false
+}
+
+// packDirs packs dirs into payloads, several at the same time
+func packDirs(dirs []string) ([][]byte, []error) {
+	payloads := make([][]byte, len(dirs))
+	errs := make([]error, len(dirs))
+
+	workers := runtime.NumCPU()
+	if workers > len(dirs) {
+		workers = len(dirs)
+	}
+	indexes := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				payloads[i], errs[i] = Payloader{}.DirToTarGz(dirs[i])
+			}
+		}()
+	}
+	for i := range dirs {
+		indexes <- i
+	}
+	close(indexes)
+	wg.Wait()
+
+	return payloads, errs
+}
+
+// publishPayloads publishes entries to sink, in batches if the sink supports
+// them
+func publishPayloads(sink MessageSink, entries []PublishEntry) []PublishResult {
+	if bs, ok := sink.(MessageBatchSink); ok {
+		return bs.PublishPayloads(entries)
+	}
+	results := make([]PublishResult, len(entries))
+	for i, entry := range entries {
+		results[i].Err = sink.PublishPayload(entry.Body, entry.Payload)
+	}
+	return results
+}
+
+// A publishedDir is the outcome of publishing a directory, as printed by
+// publish
+type publishedDir struct {
+	Dir       string `json:"dir"`
+	MessageID string `json:"message_id,omitempty"`
+	Size      int    `json:"size"`
+	Error     string `json:"error,omitempty"`
+}
+
+// printPublishedDirs writes published as a table, or as JSON
+func printPublishedDirs(w io.Writer, published []publishedDir, asJSON bool) error {
+	if asJSON {
+		return errors.Wrap(json.NewEncoder(w).Encode(published), "can not write published directories")
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "DIR\tMESSAGE ID\tSIZE\tERROR")
+	for _, p := range published {
+		messageID, errMsg := p.MessageID, p.Error
+		if messageID == "" {
+			messageID = "-"
+		}
+		if errMsg == "" {
+			errMsg = "-"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%s\n", p.Dir, messageID, p.Size, errMsg)
+	}
+	return errors.Wrap(tw.Flush(), "can not write published directories")
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func Test_ExpandDirs(t *testing.T) {
+	t.Run("expands globs to directories, once each", func(t *testing.T) {
+		dirs, err := expandDirs([]string{"./fixtures/greet", "./fixtures/*-path", "fixtures/g*"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := []string{"./fixtures/greet", "fixtures/happy-path"}
+		if !reflect.DeepEqual(expected, dirs) {
+			t.Errorf("expected dirs %v, got %v", expected, dirs)
+		}
+	})
+
+	t.Run("fails for globs which match no directory", func(t *testing.T) {
+		if _, err := expandDirs([]string{"./fixtures/greet/*"}); err == nil {
+			t.Errorf("expected glob matching only files to fail")
+		}
+	})
+
+	t.Run("leaves paths to DirToTarGz", func(t *testing.T) {
+		dirs, err := expandDirs([]string{"./does-not-exist"})
+		if err != nil || !reflect.DeepEqual([]string{"./does-not-exist"}, dirs) {
+			t.Errorf("expected path to be returned as is, got %v, %v", dirs, err)
+		}
+	})
+}
+
+func Test_PackDirs_PacksEveryDir(t *testing.T) {
+	dirs := []string{"./fixtures/greet", "./fixtures/happy-path", "./does-not-exist"}
+	payloads, errs := packDirs(dirs)
+
+	for i, dir := range dirs[:2] {
+		expected, _ := Payloader{}.DirToTarGz(dir)
+		if errs[i] != nil || !bytes.Equal(expected, payloads[i]) {
+			t.Errorf("expected payload of %s, got %v", dir, errs[i])
+		}
+	}
+	if errs[2] == nil {
+		t.Errorf("expected missing dir to fail")
+	}
+}
+
+func Test_PublishPayloads_PublishesOneByOneToSinksWithoutBatches(t *testing.T) {
+	q := NewMemoryQueue(0)
+	results := publishPayloads(q, []PublishEntry{
+		{Body: messageBody{}, Payload: []byte("one")},
+		{Body: messageBody{Env: env{"A=B": "c"}}, Payload: []byte("two")},
+	})
+
+	if results[0].Err != nil || results[0].MessageID != "" {
+		t.Errorf("expected first payload to be published without id, got %+v", results[0])
+	}
+	if results[1].Err == nil {
+		t.Errorf("expected payload with invalid env to fail")
+	}
+	if q.Len() != 1 {
+		t.Errorf("expected one message on the queue, got %d", q.Len())
+	}
+}
+
+func Test_PrintPublishedDirs(t *testing.T) {
+	published := []publishedDir{
+		{Dir: "./payloads/a", MessageID: "id-1", Size: 120},
+		{Dir: "./payloads/bb", Size: 80, Error: "throttled"},
+	}
+
+	t.Run("as table", func(t *testing.T) {
+		var buf bytes.Buffer
+		if err := printPublishedDirs(&buf, published, false); err != nil {
+			t.Fatal(err)
+		}
+		expected := strings.Join([]string{
+			"DIR            MESSAGE ID  SIZE  ERROR",
+			"./payloads/a   id-1        120   -",
+			"./payloads/bb  -           80    throttled",
+			"",
+		}, "\n")
+		if buf.String() != expected {
+			t.Errorf("expected table\n%s\ngot\n%s", expected, buf.String())
+		}
+	})
+
+	t.Run("as json", func(t *testing.T) {
+		var buf bytes.Buffer
+		if err := printPublishedDirs(&buf, published, true); err != nil {
+			t.Fatal(err)
+		}
+		expected := `[{"dir":"./payloads/a","message_id":"id-1","size":120},{"dir":"./payloads/bb","size":80,"error":"throttled"}]` + "\n"
+		if buf.String() != expected {
+			t.Errorf("expected %s, got %s", expected, buf.String())
+		}
+	})
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// loadEnvFiles reads the dotenv formatted files in order, values of later
+// files override values of earlier ones. If lookup is not nil ${VAR}
+// references are expanded with it, see parseDotenv.
+func loadEnvFiles(paths []string, lookup func(string) (string, bool)) (env, error) {
+	out := env{}
+	for _, path := range paths {
+		src, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, errors.Wrap(err, "env-file: can not read file")
+		}
+		fileEnv, err := parseDotenv(src, lookup)
+		if err != nil {
+			return nil, errors.Wrap(err, fmt.Sprintf("env-file: %s", path))
+		}
+		for k, v := range fileEnv {
+			out[k] = v
+		}
+	}
+	return out, nil
+}
+
+// parseDotenv parses src in dotenv format: one KEY=VALUE per line with an
+// optional "export " prefix. Lines starting with # are comments, as is
+// anything after a # preceded by whitespace in unquoted values. Single quoted
+// values are taken literally, double quoted values support the escapes \n,
+// \r, \t, \", \\ and \$. Both kinds of quoted values may span multiple lines.
+//
+// If lookup is not nil, ${VAR} references in unquoted and double quoted
+// values are replaced with the value lookup returns, references which can't
+// be resolved are an error. If lookup is nil references are kept as is.
+func parseDotenv(src []byte, lookup func(string) (string, bool)) (env, error) {
+	p := dotenvParser{src: string(src), line: 1, lookup: lookup}
+	out := env{}
+	for {
+		p.skipBlankLines()
+		if p.eof() {
+			return out, nil
+		}
+		key, value, err := p.entry()
+		if err != nil {
+			return nil, errors.Errorf("line %d: %s", p.line, err)
+		}
+		out[key] = value
+	}
+}
+
+type dotenvParser struct {
+	src    string
+	pos    int
+	line   int
+	lookup func(string) (string, bool)
+}
+
+func (p *dotenvParser) eof() bool { return p.pos >= len(p.src) }
+
+func (p *dotenvParser) peek() byte {
+	if p.eof() {
+		return 0
+	}
+	return p.src[p.pos]
+}
+
+func (p *dotenvParser) next() byte {
+	c := p.src[p.pos]
+	p.pos++
+	if c == '\n' {
+		p.line++
+	}
+	return c
+}
+
+func (p *dotenvParser) skipSpaces() {
+	for !p.eof() && (p.peek() == ' ' || p.peek() == '\t') {
+		p.next()
+	}
+}
+
+// skipBlankLines skips whitespace, empty lines and comment lines
+func (p *dotenvParser) skipBlankLines() {
+	for !p.eof() {
+		switch p.peek() {
+		case ' ', '\t', '\r', '\n':
+			p.next()
+		case '#':
+			p.skipLine()
+		default:
+			return
+		}
+	}
+}
+
+func (p *dotenvParser) skipLine() {
+	for !p.eof() && p.next() != '\n' {
+	}
+}
+
+// endOfLine expects nothing but whitespace or a comment until the end of the
+// line
+func (p *dotenvParser) endOfLine() error {
+	p.skipSpaces()
+	switch p.peek() {
+	case 0, '\n', '\r', '#':
+		p.skipLine()
+		return nil
+	}
+	return errors.Errorf("unexpected character %q after value", p.peek())
+}
+
+func isKeyChar(c byte, first bool) bool {
+	switch {
+	case c == '_', 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z':
+		return true
+	case '0' <= c && c <= '9':
+		return !first
+	}
+	return false
+}
+
+// isEnvKey reports whether s is a portable env key, i.e. it consists of
+// letters, digits and underscores and does not start with a digit
+func isEnvKey(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		if !isKeyChar(s[i], i == 0) {
+			return false
+		}
+	}
+	return true
+}
+
+func (p *dotenvParser) key() string {
+	start := p.pos
+	for !p.eof() && isKeyChar(p.peek(), p.pos == start) {
+		p.next()
+	}
+	return p.src[start:p.pos]
+}
+
+func (p *dotenvParser) entry() (string, string, error) {
+	key := p.key()
+	if key == "export" && (p.peek() == ' ' || p.peek() == '\t') {
+		p.skipSpaces()
+		key = p.key()
+	}
+	if key == "" {
+		return "", "", errors.Errorf("expected env key, got %q", p.peek())
+	}
+	p.skipSpaces()
+	if p.eof() || p.next() != '=' {
+		return "", "", errors.Errorf("key values must be separated with '=': %q", key)
+	}
+	p.skipSpaces()
+
+	var (
+		value string
+		err   error
+	)
+	switch p.peek() {
+	case '\'':
+		value, err = p.singleQuoted()
+	case '"':
+		value, err = p.doubleQuoted()
+	default:
+		value, err = p.unquoted()
+	}
+	if err != nil {
+		return "", "", errors.Wrap(err, key)
+	}
+	return key, value, p.endOfLine()
+}
+
+func (p *dotenvParser) singleQuoted() (string, error) {
+	start := p.line
+	p.next()
+	var b bytes.Buffer
+	for !p.eof() {
+		c := p.next()
+		if c == '\'' {
+			return b.String(), nil
+		}
+		b.WriteByte(c)
+	}
+	return "", errors.Errorf("unterminated single quoted value starting on line %d", start)
+}
+
+func (p *dotenvParser) doubleQuoted() (string, error) {
+	start := p.line
+	p.next()
+	var b bytes.Buffer
+	for !p.eof() {
+		c := p.next()
+		switch {
+		case c == '"':
+			return b.String(), nil
+		case c == '\\' && !p.eof():
+			switch e := p.next(); e {
+			case 'n':
+				b.WriteByte('\n')
+			case 'r':
+				b.WriteByte('\r')
+			case 't':
+				b.WriteByte('\t')
+			case '"', '\\', '$':
+				b.WriteByte(e)
+			default:
+				b.WriteByte('\\')
+				b.WriteByte(e)
+			}
+		case c == '$' && p.peek() == '{':
+			s, err := p.reference()
+			if err != nil {
+				return "", err
+			}
+			b.WriteString(s)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return "", errors.Errorf("unterminated double quoted value starting on line %d", start)
+}
+
+func (p *dotenvParser) unquoted() (string, error) {
+	var (
+		b          bytes.Buffer
+		afterSpace = true
+	)
+	for !p.eof() {
+		c := p.peek()
+		// a # starts a comment only if preceded by whitespace
+		if c == '\n' || c == '\r' || (c == '#' && afterSpace) {
+			break
+		}
+		p.next()
+		afterSpace = c == ' ' || c == '\t'
+		if c == '$' && p.peek() == '{' {
+			s, err := p.reference()
+			if err != nil {
+				return "", err
+			}
+			b.WriteString(s)
+			continue
+		}
+		b.WriteByte(c)
+	}
+	return strings.TrimRight(b.String(), " \t"), nil
+}
+
+// reference reads a ${VAR} reference, the leading $ has been consumed already
+func (p *dotenvParser) reference() (string, error) {
+	end := strings.IndexByte(p.src[p.pos:], '}')
+	if end < 0 || strings.IndexByte(p.src[p.pos:p.pos+end], '\n') >= 0 {
+		return "", errors.Errorf("unterminated reference")
+	}
+	ref := p.src[p.pos : p.pos+end+1]
+	name := ref[1 : len(ref)-1]
+	p.pos += len(ref)
+	if p.lookup == nil {
+		return "$" + ref, nil
+	}
+	if !isEnvKey(name) {
+		return "", errors.Errorf("malformed reference %q", "$"+ref)
+	}
+	value, ok := p.lookup(name)
+	if !ok {
+		return "", errors.Errorf("undefined reference %q", "$"+ref)
+	}
+	return value, nil
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func Test_ParseDotenv(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		env   env
+		err   string
+	}{
+		{
+			name:  "happy path",
+			input: "FOO=bar\nQUX=42\n",
+			env:   env{"FOO": "bar", "QUX": "42"},
+			err:   "<nil>",
+		},
+		{
+			name:  "comments and blank lines",
+			input: "# leading comment\n\nFOO=bar # trailing comment\n  # indented comment\nURL=http://example.com/#anchor\n",
+			env:   env{"FOO": "bar", "URL": "http://example.com/#anchor"},
+			err:   "<nil>",
+		},
+		{
+			name:  "export prefix and whitespace around =",
+			input: "export FOO = bar\nexport\tQUX=42",
+			env:   env{"FOO": "bar", "QUX": "42"},
+			err:   "<nil>",
+		},
+		{
+			name:  "key named export",
+			input: "export=yes",
+			env:   env{"export": "yes"},
+			err:   "<nil>",
+		},
+		{
+			name:  "single quoted values are literal",
+			input: `FOO='b\na"r ${HOME} # no comment'`,
+			env:   env{"FOO": `b\na"r ${HOME} # no comment`},
+			err:   "<nil>",
+		},
+		{
+			name:  "double quoted values with escapes",
+			input: `FOO="line1\nline2\t\"quoted\" \\ \$ \x"`,
+			env:   env{"FOO": "line1\nline2\t\"quoted\" \\ $ \\x"},
+			err:   "<nil>",
+		},
+		{
+			name:  "multi-line values",
+			input: "CERT=\"-----BEGIN-----\nabc\n-----END-----\"\nKEY='one\ntwo'\nNEXT=1",
+			env:   env{"CERT": "-----BEGIN-----\nabc\n-----END-----", "KEY": "one\ntwo", "NEXT": "1"},
+			err:   "<nil>",
+		},
+		{
+			name:  "empty values",
+			input: "FOO=\nBAR=''\nBAZ=\"\"",
+			env:   env{"FOO": "", "BAR": "", "BAZ": ""},
+			err:   "<nil>",
+		},
+		{
+			name:  "CRLF line endings",
+			input: "FOO=bar\r\nQUX=\"42\"\r\n",
+			env:   env{"FOO": "bar", "QUX": "42"},
+			err:   "<nil>",
+		},
+		{
+			name:  "references are kept without lookup",
+			input: "FOO=${HOME}/bin",
+			env:   env{"FOO": "${HOME}/bin"},
+			err:   "<nil>",
+		},
+		{
+			name:  "missing =",
+			input: "FOO=bar\nQUX 42",
+			err:   "line 2: key values must be separated with '=': \"QUX\"",
+		},
+		{
+			name:  "malformed key",
+			input: "1FOO=bar",
+			err:   "line 1: expected env key, got '1'",
+		},
+		{
+			name:  "unterminated quote",
+			input: "FOO=bar\nQUX=\"42\n",
+			err:   "line 3: QUX: unterminated double quoted value starting on line 2",
+		},
+		{
+			name:  "garbage after quoted value",
+			input: "FOO='bar'baz",
+			err:   "line 1: unexpected character 'b' after value",
+		},
+	}
+
+	for _, testCase := range tests {
+		t.Run(testCase.name, func(t *testing.T) {
+			actual, err := parseDotenv([]byte(testCase.input), nil)
+
+			errStr := fmt.Sprintf("%v", err)
+			if errStr != testCase.err {
+				t.Fatalf("expected error to equal %q, got %v", testCase.err, err)
+			}
+
+			if !reflect.DeepEqual(testCase.env, actual) {
+				t.Fatalf("expected env to equal '%v', got '%v'", testCase.env, actual)
+			}
+		})
+	}
+}
+
+func Test_ParseDotenv_ExpandsReferences(t *testing.T) {
+	lookup := func(key string) (string, bool) {
+		v, ok := map[string]string{"HOME": "/home/gantry", "EMPTY": ""}[key]
+		return v, ok
+	}
+
+	tests := []struct {
+		name  string
+		input string
+		env   env
+		err   string
+	}{
+		{
+			name:  "unquoted",
+			input: "FOO=${HOME}/bin",
+			env:   env{"FOO": "/home/gantry/bin"},
+			err:   "<nil>",
+		},
+		{
+			name:  "double quoted",
+			input: `FOO="${HOME} \${HOME} $HOME ${EMPTY}"`,
+			env:   env{"FOO": "/home/gantry ${HOME} $HOME "},
+			err:   "<nil>",
+		},
+		{
+			name:  "single quoted",
+			input: "FOO='${HOME}'",
+			env:   env{"FOO": "${HOME}"},
+			err:   "<nil>",
+		},
+		{
+			name:  "undefined reference",
+			input: "FOO=${NOPE}",
+			err:   "line 1: FOO: undefined reference \"${NOPE}\"",
+		},
+		{
+			name:  "malformed reference",
+			input: "FOO=${NO-PE}",
+			err:   "line 1: FOO: malformed reference \"${NO-PE}\"",
+		},
+		{
+			name:  "unterminated reference",
+			input: "FOO=${HOME\nBAR=}",
+			err:   "line 1: FOO: unterminated reference",
+		},
+	}
+
+	for _, testCase := range tests {
+		t.Run(testCase.name, func(t *testing.T) {
+			actual, err := parseDotenv([]byte(testCase.input), lookup)
+
+			errStr := fmt.Sprintf("%v", err)
+			if errStr != testCase.err {
+				t.Fatalf("expected error to equal %q, got %v", testCase.err, err)
+			}
+
+			if !reflect.DeepEqual(testCase.env, actual) {
+				t.Fatalf("expected env to equal '%v', got '%v'", testCase.env, actual)
+			}
+		})
+	}
+}
+
+func Test_LoadEnvFiles_LaterFilesOverrideEarlierOnes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gantry-env-files")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	first := filepath.Join(dir, "first.env")
+	second := filepath.Join(dir, "second.env")
+	if err := ioutil.WriteFile(first, []byte("FOO=first\nBAR=first\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(second, []byte("FOO=second\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	actual, err := loadEnvFiles([]string{first, second}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := env{"FOO": "second", "BAR": "first"}
+	if !reflect.DeepEqual(expected, actual) {
+		t.Fatalf("expected env to equal '%v', got '%v'", expected, actual)
+	}
+
+	t.Run("reports the file of a parse error", func(t *testing.T) {
+		broken := filepath.Join(dir, "broken.env")
+		if err := ioutil.WriteFile(broken, []byte("FOO"), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		_, err := loadEnvFiles([]string{first, broken}, nil)
+
+		expected := fmt.Sprintf("env-file: %s: line 1: key values must be separated with '=': \"FOO\"", broken)
+		if fmt.Sprintf("%v", err) != expected {
+			t.Fatalf("expected error to equal %q, got %v", expected, err)
+		}
+	})
+}
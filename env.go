@@ -37,3 +37,13 @@ func (e env) ToEnviron() []string {
 	}
 	return out
 }
+
+// Keys returns the keys of the env in lexical order
+func (e env) Keys() []string {
+	keys := make([]string, 0, len(e))
+	for k := range e {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
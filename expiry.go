@@ -0,0 +1,48 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// A MessageExpiredError is returned for messages which must not be executed
+// anymore, as they are past their not-after time or older than the maximum
+// message age of the consumer.
+type MessageExpiredError struct {
+	Reason string
+
+	// deadLetter is set if expired messages should be left for the
+	// dead-letter queue, instead of being deleted
+	deadLetter bool
+}
+
+func (e MessageExpiredError) Error() string {
+	return fmt.Sprintf("message expired: %s", e.Reason)
+}
+
+// DeadLetter reports whether the expired message should be dead-lettered
+func (e MessageExpiredError) DeadLetter() bool { return e.deadLetter }
+
+// checkExpiry returns a MessageExpiredError if msg is expired at now, either
+// by the not-after time of its body, or because it was sent longer than
+// maxAge ago. The age of delayed messages counts from their not-before time.
+// A maxAge of 0 disables the age check.
+func checkExpiry(msg Message, maxAge time.Duration, now time.Time, deadLetter bool) error {
+	if notAfter := msg.Body().NotAfter; notAfter != nil && now.After(*notAfter) {
+		return MessageExpiredError{
+			Reason:     fmt.Sprintf("not after %s", notAfter.Format(time.RFC3339)),
+			deadLetter: deadLetter,
+		}
+	}
+	dueAt := msg.SentAt()
+	if notBefore := msg.Body().NotBefore; notBefore != nil && notBefore.After(dueAt) {
+		dueAt = *notBefore
+	}
+	if maxAge > 0 && !dueAt.IsZero() && now.Sub(dueAt) > maxAge {
+		return MessageExpiredError{
+			Reason:     fmt.Sprintf("due at %s, older than the maximum age of %s", dueAt.Format(time.RFC3339), maxAge),
+			deadLetter: deadLetter,
+		}
+	}
+	return nil
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+func init() {
+	RegisterTransport("file", newQueueTransport(func(u *url.URL, opts TransportOptions) (MessageQueue, error) {
+		return NewFileQueue(u.Path, opts.Logger, opts.VisibilityTimeout)
+	}))
+}
+
+// NewFileQueue returns a MessageQueue which keeps its messages as files in
+// dir, for running gantry without network e.g. in development and tests.
+// Several processes may share the same dir, as long as it is on a local
+// filesystem with atomic renames.
+//
+// Each message is a file in dir/messages, whose name starts with the time it
+// becomes visible, followed by its receive count and id. Receiving a message
+// claims it by renaming it to the end of its visibility timeout, only one of
+// many competing consumers succeeds with the rename. Messages are written to
+// dir/tmp first, so that they appear atomically.
+func NewFileQueue(dir string, logger Logger, visibilityTimeout int64) (MessageQueue, error) {
+	fq := &fileQueue{
+		dir:               dir,
+		visibilityTimeout: time.Duration(visibilityTimeout) * time.Second,
+		logger:            logger.WithFields(Fields{"component": "file-queue"}),
+		now:               time.Now,
+	}
+	for _, d := range []string{fq.messagesDir(), fq.tmpDir()} {
+		if err := os.MkdirAll(d, 0755); err != nil {
+			return nil, errors.Wrap(err, "file-queue: can not create queue directory")
+		}
+	}
+	return fq, nil
+}
+
+type fileQueue struct {
+	dir               string
+	visibilityTimeout time.Duration
+
+	logger Logger
+	now    func() time.Time
+}
+
+// fileQueueEntry is the content of a message file
+type fileQueueEntry struct {
+	ID      string          `json:"id"`
+	SentAt  time.Time       `json:"sent_at"`
+	Body    json.RawMessage `json:"body"`
+	Payload []byte          `json:"payload"`
+}
+
+func (fq *fileQueue) messagesDir() string { return filepath.Join(fq.dir, "messages") }
+func (fq *fileQueue) tmpDir() string      { return filepath.Join(fq.dir, "tmp") }
+
+// fileQueueName is the parsed name of a message file
+type fileQueueName struct {
+	visibleAt    time.Time
+	receiveCount int
+	id           string
+}
+
+func (n fileQueueName) String() string {
+	// zero padded, so that lexical order is the order of visibility
+	return fmt.Sprintf("%020d.%d.%s", n.visibleAt.UnixNano(), n.receiveCount, n.id)
+}
+
+func parseFileQueueName(name string) (fileQueueName, error) {
+	parts := strings.SplitN(name, ".", 3)
+	if len(parts) != 3 {
+		return fileQueueName{}, errors.Errorf("file-queue: malformed message file name %q", name)
+	}
+	visibleAt, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return fileQueueName{}, errors.Wrap(err, fmt.Sprintf("file-queue: malformed message file name %q", name))
+	}
+	receiveCount, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return fileQueueName{}, errors.Wrap(err, fmt.Sprintf("file-queue: malformed message file name %q", name))
+	}
+	return fileQueueName{
+		visibleAt:    time.Unix(0, visibleAt),
+		receiveCount: receiveCount,
+		id:           parts[2],
+	}, nil
+}
+
+func (fq *fileQueue) PublishPayload(body messageBody, b []byte) error {
+	bodyBytes, err := encodeMessageBody(body)
+	if err != nil {
+		return err
+	}
+	id, err := randomID()
+	if err != nil {
+		return err
+	}
+
+	now := fq.now()
+	entry, err := json.Marshal(fileQueueEntry{
+		ID:      id,
+		SentAt:  now,
+		Body:    bodyBytes,
+		Payload: b,
+	})
+	if err != nil {
+		return errors.Wrap(err, "file-queue: can not marshal message")
+	}
+
+	name := fileQueueName{visibleAt: now, id: id}
+	if body.NotBefore != nil && body.NotBefore.After(now) {
+		name.visibleAt = *body.NotBefore
+	}
+
+	tmp, err := ioutil.TempFile(fq.tmpDir(), id)
+	if err != nil {
+		return errors.Wrap(err, "file-queue: can not create message file")
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(entry); err != nil {
+		tmp.Close()
+		return errors.Wrap(err, "file-queue: can not write message file")
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return errors.Wrap(err, "file-queue: can not sync message file")
+	}
+	if err := tmp.Close(); err != nil {
+		return errors.Wrap(err, "file-queue: can not close message file")
+	}
+	if err := os.Rename(tmp.Name(), filepath.Join(fq.messagesDir(), name.String())); err != nil {
+		return errors.Wrap(err, "file-queue: can not move message file into queue")
+	}
+
+	fq.logger.Infof("published payload with message id %s", id)
+
+	return nil
+}
+
+func (fq *fileQueue) ReceiveMessageWithContext(ctx context.Context) (Message, error) {
+	fq.logger.Debugf("checking for single message in %s", fq.messagesDir())
+
+	names, err := readDirNames(fq.messagesDir())
+	if err != nil {
+		return nil, errors.Wrap(err, "file-queue: can not list messages")
+	}
+
+	now := fq.now()
+	for _, n := range names {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		name, err := parseFileQueueName(n)
+		if err != nil {
+			fq.logger.WithFields(ErrorFields(err)).Warn("ignoring foreign file in queue directory")
+			continue
+		}
+		if name.visibleAt.After(now) {
+			// names are sorted by visibility, no later message is visible
+			break
+		}
+
+		claimed := fileQueueName{
+			visibleAt:    now.Add(fq.visibilityTimeout),
+			receiveCount: name.receiveCount + 1,
+			id:           name.id,
+		}
+		err = os.Rename(filepath.Join(fq.messagesDir(), n), filepath.Join(fq.messagesDir(), claimed.String()))
+		if os.IsNotExist(err) {
+			// claimed by another consumer in the meantime
+			continue
+		}
+		if err != nil {
+			return nil, errors.Wrap(err, "file-queue: can not claim message")
+		}
+
+		fq.logger.Debugf("got message, this message will be invisible to other clients for %s", fq.visibilityTimeout)
+		return fq.readMessage(claimed)
+	}
+
+	fq.logger.Debugf("no messages on queue")
+	return nil, nil
+}
+
+func (fq *fileQueue) readMessage(name fileQueueName) (Message, error) {
+	b, err := ioutil.ReadFile(filepath.Join(fq.messagesDir(), name.String()))
+	if err != nil {
+		return nil, errors.Wrap(err, "file-queue: can not read message file")
+	}
+
+	msg := &fileQueueMessage{queue: fq, name: name}
+
+	var entry fileQueueEntry
+	if err := json.Unmarshal(b, &entry); err != nil {
+		// the file can't be repaired, hand it out for dead-lettering
+		return msg, MalformedBodyError{fmt.Sprintf("file-queue: malformed message file: %s", err)}
+	}
+	msg.sentAt = entry.SentAt
+	msg.payload = entry.Payload
+
+	body, err := decodeMessageBody(entry.Body)
+	msg.body = body
+	if err != nil {
+		return msg, errors.Wrap(err, fmt.Sprintf("can not decode body of message %s", name.id))
+	}
+	return msg, nil
+}
+
+// readDirNames returns the sorted names of the entries in dir
+func readDirNames(dir string) ([]string, error) {
+	f, err := os.Open(dir)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	names, err := f.Readdirnames(-1)
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// A fileQueueMessage is a message claimed from a fileQueue
+type fileQueueMessage struct {
+	queue   *fileQueue
+	name    fileQueueName
+	sentAt  time.Time
+	body    messageBody
+	payload []byte
+}
+
+func (fqm *fileQueueMessage) ID() string        { return fqm.name.id }
+func (fqm *fileQueueMessage) SentAt() time.Time { return fqm.sentAt }
+func (fqm *fileQueueMessage) Body() messageBody { return fqm.body }
+func (fqm *fileQueueMessage) Payload() []byte   { return fqm.payload }
+func (fqm *fileQueueMessage) ReceiveCount() int { return fqm.name.receiveCount }
+
+func (fqm *fileQueueMessage) path() string {
+	return filepath.Join(fqm.queue.messagesDir(), fqm.name.String())
+}
+
+// Delete removes the message from the queue. It fails if the visibility
+// timeout expired and the message was claimed by another consumer since.
+func (fqm *fileQueueMessage) Delete() error {
+	if err := os.Remove(fqm.path()); err != nil {
+		return errors.Wrap(err, fmt.Sprintf("file-queue-message: could not delete message with id %s", fqm.name.id))
+	}
+	fqm.queue.logger.WithFields(Fields{
+		"message_id": fqm.name.id,
+	}).Infof("file-queue-message: deleted message")
+	return nil
+}
+
+// ChangeVisibility hides the message for timeout from now on
+func (fqm *fileQueueMessage) ChangeVisibility(timeout time.Duration) error {
+	name := fqm.name
+	name.visibleAt = fqm.queue.now().Add(timeout)
+	if err := os.Rename(fqm.path(), filepath.Join(fqm.queue.messagesDir(), name.String())); err != nil {
+		return errors.Wrap(err, fmt.Sprintf("file-queue-message: could not change visibility of message with id %s", fqm.name.id))
+	}
+	fqm.name = name
+	return nil
+}
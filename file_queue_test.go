@@ -0,0 +1,258 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeClock is a settable clock for queues with a now func
+type fakeClock struct {
+	mu sync.Mutex
+	t  time.Time
+}
+
+func (fc *fakeClock) Now() time.Time {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	return fc.t
+}
+
+func (fc *fakeClock) Advance(d time.Duration) {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	fc.t = fc.t.Add(d)
+}
+
+func newTestFileQueue(t *testing.T) (*fileQueue, *fakeClock) {
+	t.Helper()
+	dir := helper{t}.tempDir()
+	q, err := NewFileQueue(dir, noopLogger{}, 30)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clock := &fakeClock{t: time.Date(2018, time.June, 01, 0, 0, 0, 0, time.UTC)}
+	fq := q.(*fileQueue)
+	fq.now = clock.Now
+	return fq, clock
+}
+
+func receive(t *testing.T, src MessageSource) Message {
+	t.Helper()
+	msg, err := src.ReceiveMessageWithContext(context.TODO())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return msg
+}
+
+func Test_FileQueue_PublishesAndReceivesMessages(t *testing.T) {
+	q, clock := newTestFileQueue(t)
+	defer os.RemoveAll(q.dir)
+
+	body := messageBody{Env: env{"FOO": "bar"}}
+	if err := q.PublishPayload(body, []byte("payload")); err != nil {
+		t.Fatal(err)
+	}
+
+	msg := receive(t, q)
+	if msg == nil {
+		t.Fatalf("expected to receive a message")
+	}
+
+	expectedBody := messageBody{Version: messageVersion, Env: env{"FOO": "bar"}}
+	if !reflect.DeepEqual(expectedBody, msg.Body()) {
+		t.Errorf("expected body to equal '%+#v', got '%+#v'", expectedBody, msg.Body())
+	}
+	if string(msg.Payload()) != "payload" {
+		t.Errorf("expected payload to equal %q, got %q", "payload", msg.Payload())
+	}
+	if !msg.SentAt().Equal(clock.Now()) {
+		t.Errorf("expected message to be sent at %s, got %s", clock.Now(), msg.SentAt())
+	}
+
+	t.Run("hides received messages for the visibility timeout", func(t *testing.T) {
+		if msg := receive(t, q); msg != nil {
+			t.Fatalf("expected no message while the first is in flight, got %s", msg.ID())
+		}
+
+		clock.Advance(31 * time.Second)
+
+		redelivered := receive(t, q)
+		if redelivered == nil || redelivered.ID() != msg.ID() {
+			t.Fatalf("expected message %s to be redelivered, got %v", msg.ID(), redelivered)
+		}
+
+		t.Run("and fails to delete messages with a lost lease", func(t *testing.T) {
+			if err := msg.Delete(); err == nil {
+				t.Errorf("expected delete of a redelivered message to fail")
+			}
+		})
+
+		msg = redelivered
+	})
+
+	t.Run("deletes messages", func(t *testing.T) {
+		if err := msg.Delete(); err != nil {
+			t.Fatal(err)
+		}
+
+		clock.Advance(time.Hour)
+
+		if msg := receive(t, q); msg != nil {
+			t.Fatalf("expected queue to be empty, got %s", msg.ID())
+		}
+	})
+}
+
+func Test_FileQueue_ChangesVisibility(t *testing.T) {
+	q, clock := newTestFileQueue(t)
+	defer os.RemoveAll(q.dir)
+
+	if err := q.PublishPayload(messageBody{}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	msg := receive(t, q)
+	if err := msg.ChangeVisibility(0); err != nil {
+		t.Fatal(err)
+	}
+	if msg := receive(t, q); msg == nil {
+		t.Fatalf("expected message to be visible again")
+	}
+	if err := msg.ChangeVisibility(time.Hour); err == nil {
+		t.Errorf("expected change of visibility of a redelivered message to fail")
+	}
+
+	clock.Advance(time.Minute)
+
+	msg = receive(t, q)
+	if err := msg.ChangeVisibility(time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	clock.Advance(59 * time.Minute)
+	if msg := receive(t, q); msg != nil {
+		t.Fatalf("expected message to be invisible for an hour")
+	}
+	clock.Advance(time.Minute)
+	if msg := receive(t, q); msg == nil {
+		t.Fatalf("expected message to be visible after an hour")
+	}
+}
+
+func Test_FileQueue_DelaysMessagesUntilNotBefore(t *testing.T) {
+	q, clock := newTestFileQueue(t)
+	defer os.RemoveAll(q.dir)
+
+	notBefore := clock.Now().Add(time.Hour)
+	if err := q.PublishPayload(messageBody{NotBefore: &notBefore}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if msg := receive(t, q); msg != nil {
+		t.Fatalf("expected no message before it is due")
+	}
+
+	clock.Advance(time.Hour)
+
+	if msg := receive(t, q); msg == nil {
+		t.Fatalf("expected message when it is due")
+	}
+}
+
+func Test_FileQueue_DeliversMessagesOnceToConcurrentConsumers(t *testing.T) {
+	q, _ := newTestFileQueue(t)
+	defer os.RemoveAll(q.dir)
+
+	const n = 20
+	for i := 0; i < n; i++ {
+		if err := q.PublishPayload(messageBody{}, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var (
+		mu       sync.Mutex
+		received = map[string]int{}
+		wg       sync.WaitGroup
+	)
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				msg, err := q.ReceiveMessageWithContext(context.TODO())
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if msg == nil {
+					return
+				}
+				mu.Lock()
+				received[msg.ID()]++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if len(received) != n {
+		t.Errorf("expected %d messages to be received, got %d", n, len(received))
+	}
+	for id, count := range received {
+		if count != 1 {
+			t.Errorf("expected message %s to be received once, got %d", id, count)
+		}
+	}
+}
+
+func Test_FileQueue_HandsOutMalformedMessagesForDeadLettering(t *testing.T) {
+	q, _ := newTestFileQueue(t)
+	defer os.RemoveAll(q.dir)
+
+	name := fileQueueName{visibleAt: time.Unix(0, 0), id: "broken"}
+	if err := ioutil.WriteFile(filepath.Join(q.messagesDir(), name.String()), []byte("{"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	msg, err := q.ReceiveMessageWithContext(context.TODO())
+	if msg == nil || msg.ID() != "broken" {
+		t.Fatalf("expected malformed message to be returned, got %v", msg)
+	}
+	if !isDeadLetter(err) {
+		t.Fatalf("expected dead-letter error, got %v", err)
+	}
+}
+
+func Test_Gantry_RunsPayloadsFromFileQueue(t *testing.T) {
+	q, clock := newTestFileQueue(t)
+	defer os.RemoveAll(q.dir)
+
+	payload, err := Payloader{}.DirToTarGz("./fixtures/env-propagation")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := q.PublishPayload(messageBody{Env: env{"TEST_VAR": "is set"}}, payload); err != nil {
+		t.Fatal(err)
+	}
+
+	g := Gantry{
+		ctx:    context.TODO(),
+		src:    q,
+		logger: noopLogger{},
+	}
+	if err := g.HandleMessageIfExists(); err != nil {
+		t.Fatal(err)
+	}
+
+	clock.Advance(time.Hour)
+	if msg := receive(t, q); msg != nil {
+		t.Fatalf("expected executed message to be deleted, got %s", msg.ID())
+	}
+}
@@ -0,0 +1,7 @@
+#!/bin/sh
+
+mkdir -p reports rendered
+echo "all good" > reports/summary.txt
+echo "kind: Deployment" > rendered/app.yaml
+echo "not collected" > rendered/notes.txt
+pwd
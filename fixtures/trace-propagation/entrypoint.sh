@@ -0,0 +1,4 @@
+#!/bin/bash
+
+# continue the trace of gantry
+echo "$TRACEPARENT" >&2
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// stringSlice is a flag.Value which collects the values of a repeated flag
+type stringSlice []string
+
+func (s *stringSlice) Set(v string) error {
+	*s = append(*s, v)
+	return nil
+}
+
+func (s stringSlice) String() string {
+	return strings.Join(s, ",")
+}
+
+// labelSet is a flag.Value which collects the key=value labels of a
+// repeated flag
+type labelSet map[string]string
+
+func (l *labelSet) Set(s string) error {
+	if *l == nil {
+		*l = make(labelSet)
+	}
+	kv := strings.SplitN(s, "=", 2)
+	if len(kv) != 2 || kv[0] == "" {
+		return errors.Errorf("malformed label: key and value must be separated with '=': %q", s)
+	}
+	(*l)[kv[0]] = kv[1]
+	return nil
+}
+
+func (l labelSet) String() string {
+	out := make([]string, 0, len(l))
+	for k, v := range l {
+		out = append(out, k+"="+v)
+	}
+	sort.Strings(out)
+	return strings.Join(out, ",")
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/pkg/errors"
+)
+
+// A FollowUp is a payload which is published when the payload declaring it
+// in its manifest completed, see Manifest.OnSuccess and Manifest.OnFailure.
+// It is either embedded as a directory of the declaring payload, or
+// referenced by the URL of a tar.gz archive.
+type FollowUp struct {
+	// Dir is the directory of an embedded payload, relative to the
+	// payload root
+	Dir string `yaml:"dir"`
+	// PayloadURL is the URL of a referenced payload, file:///path/to/file
+	// or s3://<bucket>/<key>
+	PayloadURL string `yaml:"payload_url"`
+	// QueueURL is the queue the payload is published to, see -queue-url
+	QueueURL string `yaml:"queue_url"`
+	// InheritEnv are the env keys copied from the message, keys which are
+	// not set are skipped
+	InheritEnv []string `yaml:"inherit_env"`
+	// Env is set in addition to the inherited env, it overrides it
+	Env map[string]string `yaml:"env"`
+	// Selector selects the consumers which run the payload
+	Selector string `yaml:"selector"`
+}
+
+// The outcomes follow-ups are published for, they name the manifest keys
+const (
+	followUpOnSuccess = "on_success"
+	followUpOnFailure = "on_failure"
+)
+
+// validate returns an error if f is inconsistent, or doesn't fit the
+// payload in dir. Embedded payloads are validated against their manifest.
+func (f FollowUp) validate(dir string) error {
+	switch {
+	case f.Dir == "" && f.PayloadURL == "":
+		return errors.New("either dir or payload_url must be set")
+	case f.Dir != "" && f.PayloadURL != "":
+		return errors.New("only one of dir or payload_url may be set")
+	case f.QueueURL == "":
+		return errors.New("queue_url must be set")
+	}
+	if _, _, err := queueTransport(f.QueueURL); err != nil {
+		return err
+	}
+	for _, key := range f.InheritEnv {
+		if key == "" {
+			return errors.New("inherit_env must not contain empty keys")
+		}
+	}
+	for key := range f.Env {
+		if !isEnvKey(key) {
+			return errors.Errorf("invalid env key %q", key)
+		}
+	}
+	if _, err := ParseSelector(f.Selector); err != nil {
+		return err
+	}
+
+	if f.PayloadURL != "" {
+		u, err := url.Parse(f.PayloadURL)
+		if err != nil {
+			return errors.Wrap(err, "can not parse payload_url")
+		}
+		if scheme := strings.ToLower(u.Scheme); scheme != "file" && scheme != "s3" {
+			return errors.Errorf("unsupported payload_url scheme %q, supported are file,s3", u.Scheme)
+		}
+		return nil
+	}
+
+	// the payload itself is not a follow-up, so that embedded payloads
+	// can't declare each other in a loop
+	if !isWithinRoot(f.Dir) || filepath.Clean(f.Dir) == "." {
+		return errors.Errorf("dir %q must be a directory within the payload", f.Dir)
+	}
+	sub := filepath.Join(dir, f.Dir)
+	if fi, err := os.Stat(sub); err != nil || !fi.IsDir() {
+		return errors.Errorf("payload does not contain directory %s", f.Dir)
+	}
+	m, err := loadManifest(sub)
+	if err != nil {
+		return errors.Wrap(err, f.Dir)
+	}
+	return errors.Wrap(m.Validate(sub), f.Dir)
+}
+
+// body returns the message body of f, for a follow-up of parent
+func (f FollowUp) body(parent messageBody) messageBody {
+	body := messageBody{Env: env{}, Selector: f.Selector}
+	sensitive := map[string]bool{}
+	for _, key := range parent.Sensitive {
+		sensitive[key] = true
+	}
+	for _, key := range f.InheritEnv {
+		if v, ok := parent.Env[key]; ok {
+			body.Env[key] = v
+			if sensitive[key] {
+				body.Sensitive = append(body.Sensitive, key)
+			}
+		}
+	}
+	for k, v := range f.Env {
+		body.Env[k] = v
+	}
+	if f.Selector != "" {
+		body.Required = append(body.Required, "selector")
+	}
+	return body
+}
+
+// fetchPayload reads the referenced payload at rawURL
+func fetchPayload(rawURL string) ([]byte, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, errors.Wrap(err, "can not parse payload url")
+	}
+	switch strings.ToLower(u.Scheme) {
+	case "file":
+		b, err := ioutil.ReadFile(u.Path)
+		return b, errors.Wrap(err, fmt.Sprintf("can not read payload %s", rawURL))
+	case "s3":
+		sess, err := session.NewSession()
+		if err != nil {
+			return nil, errors.Wrap(err, "can not create aws session")
+		}
+		out, err := s3.New(sess).GetObject(&s3.GetObjectInput{
+			Bucket: aws.String(u.Host),
+			Key:    aws.String(strings.TrimPrefix(u.Path, "/")),
+		})
+		if err != nil {
+			return nil, errors.Wrap(err, fmt.Sprintf("can not get payload %s", rawURL))
+		}
+		defer out.Body.Close()
+		b, err := ioutil.ReadAll(out.Body)
+		return b, errors.Wrap(err, fmt.Sprintf("can not read payload %s", rawURL))
+	}
+	return nil, errors.Errorf("unsupported payload url scheme %q, supported are file,s3", u.Scheme)
+}
+
+// sinkCache keeps the sinks of follow-ups open by queue URL, so that
+// consumers don't open a connection for every follow-up. The sinks
+// reconnect on their own. The zero value is ready to use.
+type sinkCache struct {
+	mu    sync.Mutex
+	sinks map[string]MessageSink
+}
+
+// get returns the sink of queueURL, it is opened with open the first time
+func (sc *sinkCache) get(queueURL string, open func(string) (MessageSink, error)) (MessageSink, error) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	if sink, ok := sc.sinks[queueURL]; ok {
+		return sink, nil
+	}
+	sink, err := open(queueURL)
+	if err != nil {
+		return nil, err
+	}
+	if sc.sinks == nil {
+		sc.sinks = map[string]MessageSink{}
+	}
+	sc.sinks[queueURL] = sink
+	return sink, nil
+}
+
+// close closes the sinks which hold a connection, the cache is empty
+// afterwards. It returns the last error.
+func (sc *sinkCache) close() error {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	var err error
+	for queueURL, sink := range sc.sinks {
+		if c, ok := sink.(io.Closer); ok {
+			if closeErr := c.Close(); closeErr != nil {
+				err = errors.Wrap(closeErr, fmt.Sprintf("can not close follow-up queue %s", queueURL))
+			}
+		}
+	}
+	sc.sinks = nil
+	return err
+}
+
+// messageCorrelationID returns the correlation ID of msg, which is the ID
+// of the first message of a workflow
+func messageCorrelationID(msg Message) string {
+	if id := msg.Body().CorrelationID; id != "" {
+		return id
+	}
+	return msg.ID()
+}
+
+// publishFollowUps publishes the follow-ups of msg for outcome, dir is the
+// extracted payload of msg. It returns the follow-ups published before an
+// error, described by their key in the manifest and queue.
+func (g *Gantry) publishFollowUps(ctx context.Context, msg Message, dir, outcome string, followUps []FollowUp) ([]string, error) {
+	if len(followUps) == 0 {
+		return nil, nil
+	}
+	if g.openSink == nil {
+		return nil, errors.New("payload declares follow-ups, but consumer can not publish")
+	}
+	ctx, span := tracer.Start(ctx, "follow-ups")
+	var (
+		published []string
+		err       error
+	)
+	defer func() { endSpan(span, err) }()
+
+	for i, f := range followUps {
+		name := fmt.Sprintf("%s[%d]", outcome, i)
+		if err = g.publishFollowUp(ctx, msg, dir, f, name); err != nil {
+			return published, errors.Wrap(err, fmt.Sprintf("can not publish follow-up %s", name))
+		}
+		published = append(published, name+" "+f.QueueURL)
+	}
+	return published, nil
+}
+
+func (g *Gantry) publishFollowUp(ctx context.Context, msg Message, dir string, f FollowUp, name string) error {
+	var (
+		payload    []byte
+		payloadDir = filepath.Join(dir, f.Dir)
+		err        error
+	)
+	if f.PayloadURL == "" {
+		payload, err = Payloader{g.logger}.DirToTarGz(payloadDir)
+		if err != nil {
+			return err
+		}
+	} else {
+		if payload, err = fetchPayload(f.PayloadURL); err != nil {
+			return err
+		}
+		// referenced payloads are extracted to read their manifest
+		if payloadDir, err = ioutil.TempDir("", "gantry-follow-up"); err != nil {
+			return errors.Wrap(err, "can not create temp dir")
+		}
+		defer os.RemoveAll(payloadDir)
+		if err := (Payloader{g.logger}).ExtractTarGzToDir(payloadDir, payload); err != nil {
+			return err
+		}
+	}
+
+	body, err := payloadBody(payloadDir, f.body(msg.Body()))
+	if err != nil {
+		return err
+	}
+	body.CorrelationID = messageCorrelationID(msg)
+	// duplicate deliveries of msg publish the same follow-ups, which are
+	// skipped like their parent. The message ID tells a republished
+	// parent apart, whose key isn't recorded if it failed.
+	if key := msg.Body().IdempotencyKey; key != "" {
+		body.IdempotencyKey = key + "/" + msg.ID() + "/" + name
+	}
+
+	sink, err := g.sinks.get(f.QueueURL, g.openSink)
+	if err != nil {
+		return err
+	}
+	return sink.PublishPayload(injectTrace(ctx, body), payload)
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// writeFollowUpDir writes a follow-up payload with entrypoint.sh into
+// dir/name
+func writeFollowUpDir(t *testing.T, dir, name string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Join(dir, name), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, name, defaultEntrypoint), []byte("#!/bin/sh\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// testSinks returns a func opening the queues of sinks by URL
+func testSinks(sinks map[string]*MemoryQueue) func(string) (MessageSink, error) {
+	return func(queueURL string) (MessageSink, error) {
+		return sinks[queueURL], nil
+	}
+}
+
+func Test_SinkCache_OpensSinksOnce(t *testing.T) {
+	var (
+		sc     sinkCache
+		opened []string
+	)
+	open := func(queueURL string) (MessageSink, error) {
+		opened = append(opened, queueURL)
+		if queueURL == "mem://broken" {
+			return nil, errors.New("can not connect")
+		}
+		return NewMemoryQueue(time.Minute), nil
+	}
+	for _, queueURL := range []string{"mem://deploy", "mem://rollback", "mem://deploy", "mem://broken", "mem://broken"} {
+		sc.get(queueURL, open)
+	}
+	expected := []string{"mem://deploy", "mem://rollback", "mem://broken", "mem://broken"}
+	if !reflect.DeepEqual(opened, expected) {
+		t.Errorf("expected sinks to be opened once, unless opening failed, got %v", opened)
+	}
+}
+
+// closingSink records that it was closed
+type closingSink struct {
+	MessageSink
+	closed *int
+}
+
+func (cs closingSink) Close() error {
+	*cs.closed++
+	return nil
+}
+
+func Test_SinkCache_ClosesSinks(t *testing.T) {
+	var (
+		sc     sinkCache
+		closed int
+	)
+	open := func(queueURL string) (MessageSink, error) {
+		if queueURL == "mem://plain" {
+			return NewMemoryQueue(time.Minute), nil
+		}
+		return closingSink{MessageSink: NewMemoryQueue(time.Minute), closed: &closed}, nil
+	}
+	for _, queueURL := range []string{"mem://deploy", "mem://rollback", "mem://plain"} {
+		sc.get(queueURL, open)
+	}
+	if err := sc.close(); err != nil {
+		t.Fatal(err)
+	}
+	if closed != 2 {
+		t.Errorf("expected the 2 closable sinks to be closed, got %d", closed)
+	}
+	if len(sc.sinks) != 0 {
+		t.Errorf("expected closed sinks to be dropped, got %v", sc.sinks)
+	}
+}
+
+func Test_Manifest_ValidatesFollowUps(t *testing.T) {
+	for _, tc := range []struct {
+		name, followUp, err string
+	}{
+		{"missing payload", "{queue_url: 'mem://deploy'}", "gantry.yaml: on_success[0]: either dir or payload_url must be set"},
+		{"both payloads", "{dir: deploy, payload_url: 'file:///deploy.tar.gz', queue_url: 'mem://deploy'}", "gantry.yaml: on_success[0]: only one of dir or payload_url may be set"},
+		{"missing queue", "{dir: deploy}", "gantry.yaml: on_success[0]: queue_url must be set"},
+		{"payload itself", "{dir: ., queue_url: 'mem://deploy'}", `gantry.yaml: on_success[0]: dir "." must be a directory within the payload`},
+		{"outside payload", "{dir: ../deploy, queue_url: 'mem://deploy'}", `gantry.yaml: on_success[0]: dir "../deploy" must be a directory within the payload`},
+		{"missing dir", "{dir: rollback, queue_url: 'mem://deploy'}", "gantry.yaml: on_success[0]: payload does not contain directory rollback"},
+		{"invalid env", "{dir: deploy, queue_url: 'mem://deploy', env: {'A-B': x}}", `gantry.yaml: on_success[0]: invalid env key "A-B"`},
+		{"unsupported payload url", "{payload_url: 'http://example.com/deploy.tar.gz', queue_url: 'mem://deploy'}", `gantry.yaml: on_success[0]: unsupported payload_url scheme "http", supported are file,s3`},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := writePayloadDir(t, "entrypoint: bin/run.sh\non_success: ["+tc.followUp+"]", "")
+			writeFollowUpDir(t, dir, "deploy")
+			_, err := payloadBody(dir, messageBody{})
+			if err == nil || err.Error() != tc.err {
+				t.Errorf("expected error %q, got %v", tc.err, err)
+			}
+		})
+	}
+
+	t.Run("validates manifests of embedded payloads", func(t *testing.T) {
+		dir := writePayloadDir(t, "entrypoint: bin/run.sh\non_success: [{dir: deploy, queue_url: 'mem://deploy'}]", "")
+		writeFollowUpDir(t, dir, "deploy")
+		if err := ioutil.WriteFile(filepath.Join(dir, "deploy", manifestFile), []byte("entrypoint: missing.sh"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		expected := "gantry.yaml: on_success[0]: deploy: payload does not contain entrypoint missing.sh"
+		if _, err := payloadBody(dir, messageBody{}); err == nil || err.Error() != expected {
+			t.Errorf("expected error %q, got %v", expected, err)
+		}
+	})
+}
+
+func Test_Gantry_PublishesFollowUpsOnSuccess(t *testing.T) {
+	q, _ := newTestQueue(time.Now())
+	dir := writePayloadDir(t, `entrypoint: bin/run.sh
+on_success:
+  - dir: deploy
+    queue_url: mem://deploy
+    inherit_env: [CLUSTER, TOKEN, UNSET]
+    env: {STEP: deploy}
+    selector: region=eu-west-1
+on_failure:
+  - dir: rollback
+    queue_url: mem://rollback
+`, "")
+	writeFollowUpDir(t, dir, "deploy")
+	writeFollowUpDir(t, dir, "rollback")
+	publishFixture(t, q, dir, messageBody{
+		Env:            env{"CLUSTER": "prod", "TOKEN": "secret", "OTHER": "x"},
+		Sensitive:      []string{"TOKEN"},
+		IdempotencyKey: "migrate-1",
+	})
+
+	deploy, rollback := NewMemoryQueue(time.Minute), NewMemoryQueue(time.Minute)
+	g := Gantry{
+		ctx:      context.TODO(),
+		src:      q,
+		openSink: testSinks(map[string]*MemoryQueue{"mem://deploy": deploy, "mem://rollback": rollback}),
+		logger:   noopLogger{},
+	}
+	msg := receive(t, q)
+	if _, _, err := g.HandleMessage(msg); err != nil {
+		t.Fatal(err)
+	}
+	if rollback.Len() != 0 {
+		t.Errorf("expected no follow-ups on failure to be published")
+	}
+
+	followUp := receive(t, deploy)
+	if followUp == nil {
+		t.Fatal("expected follow-up on success to be published")
+	}
+	body := followUp.Body()
+
+	t.Run("inherits the selected env", func(t *testing.T) {
+		expected := env{"CLUSTER": "prod", "TOKEN": "secret", "STEP": "deploy"}
+		if !reflect.DeepEqual(body.Env, expected) {
+			t.Errorf("expected env %v, got %v", expected, body.Env)
+		}
+		if !reflect.DeepEqual(body.Sensitive, []string{"TOKEN"}) {
+			t.Errorf("expected inherited sensitive keys, got %v", body.Sensitive)
+		}
+	})
+
+	t.Run("carries the correlation id of the parent", func(t *testing.T) {
+		if body.CorrelationID != msg.ID() {
+			t.Errorf("expected correlation id %s, got %s", msg.ID(), body.CorrelationID)
+		}
+		if expected := "migrate-1/" + msg.ID() + "/on_success[0]"; body.IdempotencyKey != expected {
+			t.Errorf("expected idempotency key %s derived from parent, got %s", expected, body.IdempotencyKey)
+		}
+	})
+
+	t.Run("runs on the selected consumers", func(t *testing.T) {
+		g := Gantry{ctx: context.TODO(), src: deploy, labels: labelSet{"region": "eu-west-1"}, logger: noopLogger{}}
+		status, _, err := g.HandleMessage(followUp)
+		if status != statusCompleted || err != nil {
+			t.Errorf("expected follow-up to run, got %s %v", status, err)
+		}
+	})
+}
+
+func Test_Gantry_PublishesFollowUpsAfterLastFailedAttempt(t *testing.T) {
+	q, clock := newTestQueue(time.Now())
+	archive, err := Payloader{}.DirToTarGz("./fixtures/greet")
+	if err != nil {
+		t.Fatal(err)
+	}
+	archivePath := filepath.Join(helper{t}.tempDir(), "rollback.tar.gz")
+	if err := ioutil.WriteFile(archivePath, archive, 0644); err != nil {
+		t.Fatal(err)
+	}
+	dir := writePayloadDir(t, `entrypoint: bin/run.sh
+retry: {max_attempts: 2, backoff: 1m}
+on_failure:
+  - payload_url: file://`+archivePath+`
+    queue_url: mem://rollback
+`, "exit 1")
+	publishFixture(t, q, dir, messageBody{CorrelationID: "release-42"})
+
+	rollback := NewMemoryQueue(time.Minute)
+	g := Gantry{
+		ctx:      context.TODO(),
+		src:      q,
+		openSink: testSinks(map[string]*MemoryQueue{"mem://rollback": rollback}),
+		logger:   noopLogger{},
+	}
+	if err := g.HandleMessageIfExists(); err == nil {
+		t.Fatal("expected first attempt to fail")
+	}
+	if rollback.Len() != 0 {
+		t.Fatal("expected no follow-ups before the last attempt")
+	}
+
+	clock.Advance(time.Minute)
+	if err := g.HandleMessageIfExists(); err == nil {
+		t.Fatal("expected last attempt to fail")
+	}
+	followUp := receive(t, rollback)
+	if followUp == nil {
+		t.Fatal("expected follow-up on failure to be published")
+	}
+	if !reflect.DeepEqual(followUp.Payload(), archive) {
+		t.Errorf("expected referenced payload to be published")
+	}
+	if id := followUp.Body().CorrelationID; id != "release-42" {
+		t.Errorf("expected correlation id of the parent, got %s", id)
+	}
+}
+
+func Test_Gantry_ChoosesFollowUpsByTheEntrypointOnly(t *testing.T) {
+	q, _ := newTestQueue(time.Now())
+	dir := writePayloadDir(t, `entrypoint: bin/run.sh
+artifacts: [reports]
+on_success: [{dir: deploy, queue_url: 'mem://deploy'}]
+on_failure: [{dir: rollback, queue_url: 'mem://rollback'}]
+`, "mkdir reports && touch reports/summary.txt")
+	writeFollowUpDir(t, dir, "deploy")
+	writeFollowUpDir(t, dir, "rollback")
+	publishFixture(t, q, dir, messageBody{})
+
+	deploy, rollback := NewMemoryQueue(time.Minute), NewMemoryQueue(time.Minute)
+	g := Gantry{
+		ctx:       context.TODO(),
+		src:       q,
+		artifacts: failingArtifactStore{},
+		openSink:  testSinks(map[string]*MemoryQueue{"mem://deploy": deploy, "mem://rollback": rollback}),
+		logger:    noopLogger{},
+	}
+	if err := g.HandleMessageIfExists(); err != nil {
+		t.Fatalf("expected the execution to have the outcome of the entrypoint, got %v", err)
+	}
+	if deploy.Len() != 1 || rollback.Len() != 0 {
+		t.Errorf("expected follow-ups on success despite failing artifacts, got %d on success and %d on failure", deploy.Len(), rollback.Len())
+	}
+}
+
+// failingArtifactStore fails to store any archive
+type failingArtifactStore struct{}
+
+func (failingArtifactStore) PutArtifact(string, []byte) (string, error) {
+	return "", errors.New("artifact store is down")
+}
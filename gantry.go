@@ -3,13 +3,19 @@ package main
 import (
 	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
 	"io/ioutil"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"sync"
 	"time"
 
 	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 // Gantry represents a polling listener for a given MessageSource
@@ -17,6 +23,51 @@ type Gantry struct {
 	ctx context.Context
 	src MessageSource
 
+	// maxMessageAge is the age after which messages are not executed
+	// anymore, 0 disables the check
+	maxMessageAge time.Duration
+	// deadLetterExpired leaves expired messages for the dead-letter queue
+	// instead of deleting them
+	deadLetterExpired bool
+	// workers is the number of messages handled at the same time
+	workers int
+	// metrics records executions, it may be nil
+	metrics *Metrics
+	// health records running executions, it may be nil
+	health *Health
+	// history records executions, it may be nil
+	history *History
+	// artifacts stores the artifacts of payloads, it may be nil if they
+	// don't declare any
+	artifacts ArtifactStore
+	// labels are matched against the selectors of messages and the labels
+	// required by payloads
+	labels labelSet
+	// redactPatterns are the env key patterns whose values are masked in
+	// the output of entrypoints, in addition to the sensitive keys of
+	// messages, see -redact
+	redactPatterns []string
+	// bounces tracks the released messages
+	bounces bounceTracker
+	// attempts tracks the attempts of retried messages
+	attempts attemptTracker
+	// idempotency records the idempotency keys of completed executions
+	// for idempotencyTTL, it may be nil
+	idempotency    IdempotencyStore
+	idempotencyTTL time.Duration
+	// locker grants the locks of messages, whose lease lasts lockTTL
+	// and is renewed while the payload runs. Messages whose lock is held
+	// are received again after lockDelay.
+	locker    Locker
+	lockTTL   time.Duration
+	lockDelay time.Duration
+	// openSink opens the queues follow-ups are published to, it may be nil
+	openSink func(queueURL string) (MessageSink, error)
+	// sinks keeps the opened sinks of follow-ups
+	sinks sinkCache
+	// stop is closed to stop receiving messages, see Stop
+	stop chan struct{}
+
 	logger Logger
 }
 
@@ -26,7 +77,7 @@ func (g *Gantry) loop() {
 
 	// Ticker fires *after* the duration, not *every* duration, fire once to
 	// avoid wait on first run
-	g.HandleMessageIfExists()
+	g.drain()
 
 	for {
 		select {
@@ -34,22 +85,107 @@ func (g *Gantry) loop() {
 			g.logger.Info("stopping context cancelled")
 			ticker.Stop()
 			return
+		case <-g.stop:
+			g.logger.Info("stopping, no more messages are received")
+			ticker.Stop()
+			return
 		case <-ticker.C:
-			g.HandleMessageIfExists()
+			g.drain()
 		}
 	}
 
 }
 
+// drain handles messages with g.workers workers, until there are no more
+// messages or receiving fails
+func (g *Gantry) drain() {
+	workers := g.workers
+	if workers < 1 {
+		workers = 1
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for g.ctx.Err() == nil && !g.stopped() {
+				if received, _ := g.handleNext(); !received {
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// Stop makes Run return once the messages being handled are finished,
+// without receiving any more. Gantry must have been created with a stop
+// channel, Stop may only be called once.
+func (g *Gantry) Stop() {
+	close(g.stop)
+}
+
+// stopped reports whether Stop was called
+func (g *Gantry) stopped() bool {
+	select {
+	case <-g.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+// deadLetterMessage leaves msg on the queue for its dead-letter policy, or
+// rejects it if its source dead-letters messages itself
+func (g *Gantry) deadLetterMessage(msg Message, err error) {
+	if rejectErr := rejectMessage(msg); rejectErr != nil {
+		g.logger.WithFields(Fields{"message": map[string]interface{}{"id": msg.ID()}}.logError(rejectErr)).Warn("can not reject message")
+	}
+	g.logger.WithFields(Fields{
+		"message": map[string]interface{}{
+			"id":        msg.ID(),
+			"queued_at": msg.SentAt().Format(time.RFC3339),
+		},
+		"status": statusDeadLetter,
+	}.logError(err)).Errorf("message id: %s can not be handled, leaving it for the dead-letter queue", msg.ID())
+}
+
 // Run starts the polling loop
 func (g *Gantry) Run() {
 	g.loop()
 }
 
+// Close closes the queues follow-ups were published to, once no more
+// messages are handled
+func (g *Gantry) Close() {
+	if err := g.sinks.close(); err != nil {
+		g.logger.WithFields(ErrorFields(err)).Warn("can not close follow-up queues")
+	}
+}
+
+// The outcomes of handling a message, they are logged as status
+const (
+	statusDeadLetter = "dead letter"
+	statusExpired    = "expired"
+	statusDeferred   = "deferred"
+	statusReleased   = "released"
+	statusDuplicate  = "duplicate"
+	statusLocked     = "locked"
+	statusCompleted  = "completed"
+)
+
 // HandleMessageIfExists executes the payload from the message is one
 // available. It returns the output of the execution. If there happens any
 // error in between, it returns an empty string and the error.
 func (g *Gantry) HandleMessageIfExists() error {
+	_, err := g.handleNext()
+	return err
+}
+
+// handleNext is HandleMessageIfExists, it reports whether a message was
+// received as well
+func (g *Gantry) handleNext() (bool, error) {
 	g.logger.Debugf("checking for message")
 
 	// TODO:
@@ -57,18 +193,258 @@ func (g *Gantry) HandleMessageIfExists() error {
 	//   (nil msg, nil err = empty inbox)
 	//   (msg nil error = message available)
 	//   (err nil msg = error)
+	//   (msg and err = message can not be handled, see isDeadLetter)
+	receivedSince := time.Now()
 	msg, err := g.src.ReceiveMessageWithContext(g.ctx)
+	if err != nil && msg != nil && isDeadLetter(err) {
+		_, span := g.startReceiveSpan(msg, receivedSince)
+		g.deadLetterMessage(msg, err)
+		span.SetAttributes(attribute.String("gantry.status", statusDeadLetter))
+		endSpan(span, err)
+		return true, err
+	}
 	if err != nil {
 		g.logger.WithFields(
 			ErrorFields(err),
 		).Error("receive message failed")
-		return err
+		return false, err
 	}
 	if msg == nil {
 		g.logger.Debugf("no messages available for receipt")
-		return nil
+		return false, nil
 	}
-	defer msg.Delete()
+
+	_, _, err = g.handleMessage(msg, receivedSince)
+	return true, err
+}
+
+// startReceiveSpan starts the span of handling msg, which continues the
+// trace of its publisher
+func (g *Gantry) startReceiveSpan(msg Message, receivedSince time.Time) (context.Context, trace.Span) {
+	return tracer.Start(extractTrace(g.ctx, msg.Body()), "receive",
+		trace.WithSpanKind(trace.SpanKindConsumer),
+		trace.WithTimestamp(receivedSince),
+		trace.WithAttributes(messageAttributes(msg)...),
+	)
+}
+
+// HandleMessage executes the payload of msg, unless it expired or is not due
+// yet. It returns the status of msg, which is statusCompleted once the
+// entrypoint ran, the references of the collected artifacts and the error of
+// the execution.
+func (g *Gantry) HandleMessage(msg Message) (string, []string, error) {
+	return g.handleMessage(msg, time.Now())
+}
+
+// handleMessage is HandleMessage for a message received since
+// receivedSince
+func (g *Gantry) handleMessage(msg Message, receivedSince time.Time) (status string, artifacts []string, err error) {
+	ctx, span := g.startReceiveSpan(msg, receivedSince)
+	defer func() {
+		finishMessage(msg)
+		span.SetAttributes(attribute.String("gantry.status", status))
+		endSpan(span, err)
+	}()
+
+	if err := checkExpiry(msg, g.maxMessageAge, time.Now(), g.deadLetterExpired); err != nil {
+		if isDeadLetter(err) {
+			g.deadLetterMessage(msg, err)
+			return statusDeadLetter, nil, err
+		}
+		g.logger.WithFields(Fields{
+			"message": map[string]interface{}{
+				"id":        msg.ID(),
+				"queued_at": msg.SentAt().Format(time.RFC3339),
+			},
+			"status": statusExpired,
+		}.logError(err)).Warnf("message id: %s expired, will be deleted without execution", msg.ID())
+		return statusExpired, nil, g.deleteMessage(ctx, msg)
+	}
+
+	if notBefore := msg.Body().NotBefore; notBefore != nil && time.Now().Before(*notBefore) {
+		g.logger.WithFields(Fields{
+			"message": map[string]interface{}{
+				"id":         msg.ID(),
+				"queued_at":  msg.SentAt().Format(time.RFC3339),
+				"not_before": notBefore.Format(time.RFC3339),
+			},
+			"status": statusDeferred,
+		}).Infof("message id: %s is not due yet, deferring it", msg.ID())
+		return statusDeferred, nil, msg.ChangeVisibility(time.Until(*notBefore))
+	}
+
+	// the selector was validated when the body was decoded
+	if sel, _ := ParseSelector(msg.Body().Selector); !sel.Matches(g.labels) {
+		return statusReleased, nil, g.releaseMessage(ctx, msg, SelectorMismatchError{msg.Body().Selector, g.labels})
+	}
+	// other consumers may have an artifact store, the artifacts of the
+	// manifest are checked once the payload is extracted
+	if len(msg.Body().Artifacts) > 0 && g.artifacts == nil {
+		return statusReleased, nil, g.releaseMessage(ctx, msg, MissingArtifactStoreError{})
+	}
+
+	// the lock is held while duplicates are looked up, so that a
+	// duplicate waiting for the lock sees the key of the completed one
+	var l *lease
+	if lock := msg.Body().Lock; lock != "" {
+		if g.locker == nil {
+			return statusReleased, nil, g.releaseMessage(ctx, msg, errors.Errorf("message requires lock %q, but consumer has no lock store", lock))
+		}
+		var err error
+		l, err = acquireLease(g.locker, lock, g.lockTTL, g.logger)
+		if err != nil {
+			g.logger.WithFields(Fields{
+				"message": map[string]interface{}{"id": msg.ID()},
+				"lock":    lock,
+			}.logError(err)).Error("can not acquire lock, leaving message on the queue")
+			return "", nil, err
+		}
+		if l == nil {
+			g.metrics.messageLocked()
+			g.logger.WithFields(Fields{
+				"message": map[string]interface{}{
+					"id":        msg.ID(),
+					"queued_at": msg.SentAt().Format(time.RFC3339),
+				},
+				"lock":       lock,
+				"status":     statusLocked,
+				"visible_in": g.lockDelay.String(),
+			}).Infof("message id: %s waits for lock %q held by another execution", msg.ID(), lock)
+			return statusLocked, nil, msg.ChangeVisibility(g.lockDelay)
+		}
+		defer l.release()
+	}
+
+	key := msg.Body().IdempotencyKey
+	if key != "" && g.idempotency != nil {
+		completed, err := g.idempotency.Completed(key)
+		if err != nil {
+			// without the store duplicates can't be told apart, the
+			// message is received again after its visibility timeout
+			g.logger.WithFields(Fields{
+				"message": map[string]interface{}{"id": msg.ID()},
+			}.logError(err)).Error("can not look up idempotency key, leaving message on the queue")
+			return "", nil, err
+		}
+		if completed {
+			g.metrics.messageDuplicate()
+			g.logger.WithFields(Fields{
+				"message": map[string]interface{}{
+					"id":              msg.ID(),
+					"queued_at":       msg.SentAt().Format(time.RFC3339),
+					"idempotency_key": key,
+				},
+				"status": statusDuplicate,
+			}).Infof("message id: %s is a duplicate of a completed execution, will be deleted without execution", msg.ID())
+			return statusDuplicate, nil, g.deleteMessage(ctx, msg)
+		}
+	}
+
+	finished, healthFinished := g.metrics.executionStarted(), g.health.executionStarted()
+	artifacts, err = g.execute(ctx, msg, l)
+	finished(err)
+	healthFinished()
+	if isReleased(err) {
+		return statusReleased, nil, err
+	}
+	if key != "" && g.idempotency != nil && err == nil {
+		if err := g.idempotency.Complete(key, g.idempotencyTTL); err != nil {
+			g.logger.WithFields(Fields{
+				"message": map[string]interface{}{"id": msg.ID()},
+			}.logError(err)).Warn("can not record idempotency key, duplicates of the message will be executed")
+		}
+	}
+	return statusCompleted, artifacts, err
+}
+
+// isReleased reports whether err of execute released the message to other
+// consumers
+func isReleased(err error) bool {
+	switch errors.Cause(err).(type) {
+	case UnsatisfiedLabelsError, MissingArtifactStoreError:
+		return true
+	}
+	return false
+}
+
+// releaseMessage makes msg visible to other consumers, as this one doesn't
+// match it for reason. Messages which bounce back are hidden from this
+// consumer for a while, see bounceTracker.
+func (g *Gantry) releaseMessage(ctx context.Context, msg Message, reason error) error {
+	_, span := tracer.Start(ctx, "release")
+	visibility := g.bounces.release(msg.ID(), time.Now())
+	err := msg.ChangeVisibility(visibility)
+	endSpan(span, err)
+	g.metrics.messageReleased(msg.ReceiveCount())
+
+	g.logger.WithFields(Fields{
+		"message": map[string]interface{}{
+			"id":            msg.ID(),
+			"queued_at":     msg.SentAt().Format(time.RFC3339),
+			"receive_count": msg.ReceiveCount(),
+		},
+		"status":     statusReleased,
+		"reason":     reason.Error(),
+		"visible_in": visibility.String(),
+	}).Infof("message id: %s is not for this consumer, releasing it", msg.ID())
+	return errors.Wrap(err, "can not release message")
+}
+
+// retryMessage makes msg visible again after backoff, for another attempt
+func (g *Gantry) retryMessage(ctx context.Context, msg Message, backoff time.Duration) {
+	_, span := tracer.Start(ctx, "retry")
+	err := msg.ChangeVisibility(backoff)
+	endSpan(span, err)
+	if err != nil {
+		g.logger.WithFields(Fields{"message": map[string]interface{}{"id": msg.ID()}}.logError(err)).Warn("can not retry message")
+	}
+}
+
+// deleteMessage deletes msg in a span of its own
+func (g *Gantry) deleteMessage(ctx context.Context, msg Message) error {
+	_, span := tracer.Start(ctx, "delete")
+	err := msg.Delete()
+	endSpan(span, err)
+	return err
+}
+
+// execute extracts the payload of msg and runs its entrypoint as declared by
+// its manifest, then it collects the artifacts. The payload dir is deleted
+// afterwards, and so is msg unless it is retried or released to other
+// consumers.
+func (g *Gantry) execute(ctx context.Context, msg Message, held *lease) (artifacts []string, err error) {
+	var (
+		// release is set to release msg to other consumers
+		release error
+		// retry is set to retry msg after backoff
+		retry   bool
+		backoff time.Duration
+	)
+	defer func() {
+		switch {
+		case release != nil:
+			g.releaseMessage(ctx, msg, release)
+		case retry:
+			g.retryMessage(ctx, msg, backoff)
+		default:
+			g.deleteMessage(ctx, msg)
+		}
+	}()
+
+	var (
+		stdErr    bytes.Buffer
+		stdOut    = tailBuffer{max: maxHistoryOutput}
+		startedAt = time.Now()
+		// ran is set once the entrypoint ran, messages which are
+		// released or invalid are no executions
+		ran bool
+	)
+	defer func() {
+		if ran {
+			g.recordExecution(msg, startedAt, err, artifacts, stdOut.String(), stdErr.String())
+		}
+	}()
+
 	messageLogger := g.logger.WithFields(Fields{
 		"message": map[string]interface{}{
 			"body":      msg.Body(),
@@ -87,57 +463,181 @@ func (g *Gantry) HandleMessageIfExists() error {
 		).Fatal("can not create temp dir")
 		os.Exit(1)
 	}
+	defer os.RemoveAll(dest)
 
+	_, extractSpan := tracer.Start(ctx, "extract")
 	err = Payloader{messageLogger}.ExtractTarGzToDir(dest, msg.Payload())
+	endSpan(extractSpan, err)
 	// TODO: write test for error case
 
-	entrypointFI, err := os.Stat(filepath.Join(dest, "entrypoint.sh"))
+	manifest, err := loadManifest(dest)
+	if err == nil {
+		err = manifest.Validate(dest)
+	}
 	if err != nil {
-		err = errors.Errorf("message with id %s does contain entrypoint.sh in root directory, will be deleted", msg.ID())
-		messageLogger.WithFields(ErrorFields(err)).Error("could not find entrypoint.sh")
-		return err
+		messageLogger.WithFields(ErrorFields(err)).Error("invalid payload, will be deleted")
+		return nil, err
 	}
-	if entrypointFI.Mode()&0111 == 0 { // check for executable bit for owner
-		err = errors.Errorf("expected payload to contain executable entrypoint.sh check the filemode")
-		messageLogger.WithFields(ErrorFields(err)).Error("entrypoint.sh is not executable")
-		return err
+	// publishers add the required labels to the selector, this only
+	// catches payloads of older publishers
+	if err := manifest.CheckLabels(g.labels); err != nil {
+		release = err
+		return nil, err
 	}
-
-	// Get the current working dir, and restore it once we're done with the script
-	pwd, err := os.Getwd()
-	if err != nil {
-		messageLogger.WithFields(ErrorFields(err)).Error("cannot get working directory")
-		return errors.Wrap(err, "cannot get working directory")
+	if len(manifest.Artifacts) > 0 && g.artifacts == nil {
+		release = MissingArtifactStoreError{}
+		return nil, release
+	}
+	if err := manifest.CheckEnv(msg.Body().Env); err != nil {
+		messageLogger.WithFields(ErrorFields(err)).Error("missing required env, will be deleted")
+		return nil, err
 	}
-	defer func(old string) {
-		os.Chdir(old)
-	}(pwd)
 
-	var stdErr bytes.Buffer
+	// the entrypoint is killed when the lease of its lock is lost, as
+	// another payload with the same lock may start
+	leaseCtx, cancelLease := context.WithCancel(g.ctx)
+	defer cancelLease()
+	if held != nil {
+		go func() {
+			select {
+			case <-held.Done():
+				cancelLease()
+			case <-leaseCtx.Done():
+			}
+		}()
+	}
+	runCtx := leaseCtx
+	if manifest.Timeout > 0 {
+		var cancel context.CancelFunc
+		runCtx, cancel = context.WithTimeout(leaseCtx, manifest.Timeout)
+		defer cancel()
+	}
 
-	// Move into temp dir and run the entrypoint.sh
-	os.Chdir(dest)
-	cmd := exec.CommandContext(g.ctx, "./entrypoint.sh")
-	cmd.Env = msg.Body().Env.ToEnviron()
+	// Run the entrypoint in the temp dir, without changing the working
+	// dir of gantry, so that several payloads may run at the same time
+	execCtx, execSpan := tracer.Start(ctx, "execute")
+	cmd := exec.CommandContext(runCtx, filepath.Join(dest, manifest.Entrypoint), manifest.Args...)
+	cmd.Dir = dest
+	// the entrypoint may continue the trace with TRACEPARENT
+	cmd.Env = append(msg.Body().Env.ToEnviron(), traceEnviron(execCtx)...)
 	cmd.Stderr = &stdErr
+	cmd.Stdout = &stdOut
 
 	err = cmd.Run()
+	ran = true
+	if err != nil && runCtx.Err() == context.DeadlineExceeded {
+		err = errors.Wrap(err, fmt.Sprintf("entrypoint timed out after %s", manifest.Timeout))
+	}
+	// runs which lost their lock fail, even if the entrypoint completed
+	// before it was killed
+	select {
+	case <-held.Done():
+		err = errors.Wrap(LockLostError{Key: held.key}, "entrypoint can not run without its lock")
+	default:
+	}
+	endSpan(execSpan, err)
+	attempt := g.attempts.attempt(msg.ID(), time.Now())
+	if err != nil {
+		backoff, retry = manifest.Retry.retryAfter(attempt)
+	}
+	if !retry {
+		g.attempts.forget(msg.ID())
+	}
+
+	// The execution has the outcome of the entrypoint, errors collecting
+	// artifacts or publishing follow-ups are reported on their own. They
+	// must not publish the follow-ups on failure of a successful run.
+
+	// artifacts of failed runs are collected as well, they may tell why
+	patterns := append(append([]string{}, msg.Body().Artifacts...), manifest.Artifacts...)
+	artifacts, artifactsErr := g.collectArtifacts(msg, patterns, dest, startedAt)
+	if artifactsErr != nil {
+		messageLogger.WithFields(ErrorFields(artifactsErr)).Error("can not collect artifacts")
+	}
+
+	// follow-ups of failures are published once the message isn't retried
+	outcome, followUps := followUpOnSuccess, manifest.OnSuccess
+	if err != nil {
+		outcome, followUps = followUpOnFailure, manifest.OnFailure
+	}
+	var (
+		published   []string
+		followUpErr error
+	)
+	if !retry {
+		published, followUpErr = g.publishFollowUps(ctx, msg, dest, outcome, followUps)
+		if followUpErr != nil {
+			messageLogger.WithFields(ErrorFields(followUpErr)).Error("can not publish follow-ups")
+		}
+	}
 
-	l := messageLogger.WithFields(Fields{
+	fields := Fields{
 		"success":           err == nil,
-		"status":            "completed",
+		"status":            statusCompleted,
 		"command_env":       map[string]string(msg.Body().Env),
-		"command_stderr":    stdErr.String(),
+		"command_stderr":    g.redactOutput(msg, stdErr.String()),
 		"message_queued_at": msg.SentAt().Format(time.RFC3339),
-	})
+	}
+	if len(artifacts) > 0 {
+		fields["artifacts"] = artifacts
+	}
+	if artifactsErr != nil {
+		fields["artifacts_error"] = artifactsErr.Error()
+	}
+	if len(published) > 0 {
+		fields["follow_ups"] = published
+	}
+	if followUpErr != nil {
+		fields["follow_ups_error"] = followUpErr.Error()
+	}
+	l := messageLogger.WithFields(fields)
 
-	if err != nil {
+	switch {
+	case err != nil && retry:
+		l.WithFields(
+			Fields{"error": err.Error(), "retry_in": backoff.String()},
+		).Errorf("executed entrypoint, retrying attempt %d of %d", attempt, manifest.Retry.MaxAttempts)
+	case err != nil:
 		l.WithFields(
 			Fields{"error": err.Error()},
 		).Error("executed entrypoint")
-	} else {
+	default:
 		l.Info("executed entrypoint")
 	}
 
-	return err
+	return artifacts, err
+}
+
+// redactOutput masks the sensitive env values of msg in the output s of its
+// entrypoint, the logger only masks them in env fields
+func (g *Gantry) redactOutput(msg Message, s string) string {
+	r := redactor{patterns: g.redactPatterns}.withSensitiveKeys(msg.Body().Sensitive)
+	return r.redactOutput(s, msg.Body().Env)
+}
+
+// recordExecution adds the execution of msg to the history, failing to
+// record it doesn't fail the execution
+func (g *Gantry) recordExecution(msg Message, startedAt time.Time, err error, artifacts []string, stdout, stderr string) {
+	if g.history == nil {
+		return
+	}
+	digest := sha256.Sum256(msg.Payload())
+	e := HistoryEntry{
+		MessageID:     msg.ID(),
+		EnvKeys:       msg.Body().Env.Keys(),
+		PayloadDigest: hex.EncodeToString(digest[:]),
+		StartedAt:     startedAt.UTC(),
+		Duration:      time.Since(startedAt),
+		Success:       err == nil,
+		ExitStatus:    exitStatus(err),
+		Artifacts:     artifacts,
+		Stdout:        g.redactOutput(msg, stdout),
+		Stderr:        tail(g.redactOutput(msg, stderr), maxHistoryOutput),
+	}
+	if err != nil {
+		e.Error = err.Error()
+	}
+	if err := g.history.Record(e); err != nil {
+		g.logger.WithFields(Fields{"message": map[string]interface{}{"id": msg.ID()}}.logError(err)).Warn("can not record execution in history")
+	}
 }
@@ -6,38 +6,28 @@ import (
 	"reflect"
 	"testing"
 	"time"
-)
-
-type mockMsg struct{}
-
-func (mm mockMsg) ID() string        { return "mock-msg-id-123" }
-func (mm mockMsg) SentAt() time.Time { return time.Now() }
-func (mm mockMsg) Body() messageBody { return messageBody{} }
-func (mm mockMsg) Payload() []byte   { return []byte("mock message payload bytes") }
-func (mm mockMsg) Delete() error     { return nil }
-
-type fixtureMessage struct {
-	mockMsg
-	payload []byte
-	body    messageBody
-	sentAt  time.Time
-}
 
-func (fm fixtureMessage) Payload() []byte   { return fm.payload }
-func (fm fixtureMessage) Body() messageBody { return fm.body }
-func (fm fixtureMessage) SentAt() time.Time { return fm.sentAt }
+	"github.com/pkg/errors"
+)
 
-type mockSrc struct {
-	mockErr  error
-	messages []Message
+// newTestQueue returns a MemoryQueue whose clock is controlled by the test
+func newTestQueue(now time.Time) (*MemoryQueue, *fakeClock) {
+	clock := &fakeClock{t: now}
+	q := NewMemoryQueue(time.Minute)
+	q.Now = clock.Now
+	return q, clock
 }
 
-func (ms mockSrc) ReceiveMessageWithContext(context.Context) (Message, error) {
-	if returnErr := ms.mockErr; returnErr != nil {
-		ms.mockErr = nil
-		return nil, returnErr
+// publishFixture publishes the payload of the fixture dir with body to q
+func publishFixture(t *testing.T, q MessageSink, dir string, body messageBody) {
+	t.Helper()
+	payload, err := Payloader{}.DirToTarGz(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := q.PublishPayload(body, payload); err != nil {
+		t.Fatal(err)
 	}
-	return ms.messages[0], nil
 }
 
 type logSpy struct {
@@ -74,28 +64,236 @@ func Test_Gantry_DeletesMalformedMessages(t *testing.T) {
 	t.Skip("not implemented yet")
 }
 
-func Test_Gantry_RunsEntrypointScriptInMessagesWithSanePayloads(t *testing.T) {
-	payload, err := Payloader{}.DirToTarGz("./fixtures/greet")
+func Test_Gantry_LeavesDeadLetterMessagesOnTheQueue(t *testing.T) {
+	logger := NewRecorder()
+	q, clock := newTestQueue(time.Now())
+	q.publish([]byte(`{"version":42,"env":{}}`), nil, time.Time{})
+
+	g := Gantry{
+		ctx:    context.TODO(),
+		src:    q,
+		logger: logger,
+	}
+
+	err := g.HandleMessageIfExists()
+	if _, ok := errors.Cause(err).(UnsupportedVersionError); !ok {
+		t.Fatalf("expected unsupported version error, got %v", err)
+	}
+
+	errorLogs := Logs(logger.Logs).ByLevel()["error"]
+	if len(errorLogs) != 1 {
+		t.Fatalf("expected 1 error log, got %d", len(errorLogs))
+	}
+	if status := errorLogs[0].Fields()["status"]; status != "dead letter" {
+		t.Errorf("expected log field 'status' to equal 'dead letter', got '%v'", status)
+	}
+
+	t.Run("redelivers them after the visibility timeout", func(t *testing.T) {
+		if q.Len() != 1 {
+			t.Fatalf("expected dead-letter message not to be deleted")
+		}
+
+		clock.Advance(time.Minute)
+
+		msg, _ := q.ReceiveMessageWithContext(context.TODO())
+		if msg == nil {
+			t.Fatalf("expected dead-letter message to be redelivered")
+		}
+		if msg.ReceiveCount() != 2 {
+			t.Errorf("expected receive count to equal 2, got %d", msg.ReceiveCount())
+		}
+	})
+}
+
+func Test_Gantry_SkipsExpiredMessages(t *testing.T) {
+	past := time.Now().Add(-time.Minute)
+
+	tests := []struct {
+		name          string
+		body          messageBody
+		sentAt        time.Time
+		maxMessageAge time.Duration
+	}{
+		{
+			name:   "past not-after time",
+			body:   messageBody{NotAfter: &past},
+			sentAt: time.Now(),
+		},
+		{
+			name:          "older than max message age",
+			sentAt:        time.Now().Add(-time.Hour),
+			maxMessageAge: time.Minute,
+		},
+	}
+
+	for _, testCase := range tests {
+		t.Run(testCase.name, func(t *testing.T) {
+			// env-propagation fails without TEST_VAR, so execution
+			// would surface as an error
+			q, _ := newTestQueue(testCase.sentAt)
+			publishFixture(t, q, "./fixtures/env-propagation", testCase.body)
+			logger := NewRecorder()
+
+			g := Gantry{
+				ctx:           context.TODO(),
+				src:           q,
+				maxMessageAge: testCase.maxMessageAge,
+				logger:        logger,
+			}
+
+			if err := g.HandleMessageIfExists(); err != nil {
+				t.Fatal(err)
+			}
+
+			if q.Len() != 0 {
+				t.Errorf("expected expired message to be deleted")
+			}
+
+			warnLogs := Logs(logger.Logs).ByLevel()["warn"]
+			if len(warnLogs) != 1 {
+				t.Fatalf("expected 1 warn log, got %d", len(warnLogs))
+			}
+			if status := warnLogs[0].Fields()["status"]; status != "expired" {
+				t.Errorf("expected log field 'status' to equal 'expired', got '%v'", status)
+			}
+		})
+	}
+
+	t.Run("dead-letters expired messages if configured", func(t *testing.T) {
+		q, _ := newTestQueue(time.Now())
+		publishFixture(t, q, "./fixtures/env-propagation", messageBody{NotAfter: &past})
+
+		g := Gantry{
+			ctx:               context.TODO(),
+			src:               q,
+			deadLetterExpired: true,
+			logger:            noopLogger{},
+		}
+
+		err := g.HandleMessageIfExists()
+		if _, ok := err.(MessageExpiredError); !ok {
+			t.Fatalf("expected message expired error, got %v", err)
+		}
+		if q.Len() != 1 {
+			t.Errorf("expected dead-letter message not to be deleted")
+		}
+	})
+}
+
+func Test_Gantry_DefersMessagesWhichAreNotDue(t *testing.T) {
+	notBefore := time.Now().Add(time.Hour)
+	q := NewMemoryQueue(time.Minute)
+	logger := NewRecorder()
+
+	// visible right away, like messages delivered by SQS after its maximum
+	// delay of 15 minutes
+	body, err := encodeMessageBody(messageBody{NotBefore: &notBefore})
 	if err != nil {
 		t.Fatal(err)
 	}
+	q.publish(body, nil, time.Time{})
+
+	g := Gantry{
+		ctx:           context.TODO(),
+		src:           q,
+		maxMessageAge: time.Minute,
+		logger:        logger,
+	}
+
+	if err := g.HandleMessageIfExists(); err != nil {
+		t.Fatal(err)
+	}
+
+	if q.Len() != 1 {
+		t.Errorf("expected deferred message not to be deleted")
+	}
+
+	q.Now = func() time.Time { return time.Now().Add(59 * time.Minute) }
+	if msg, _ := q.ReceiveMessageWithContext(context.TODO()); msg != nil {
+		t.Errorf("expected message to be deferred until it is due")
+	}
+	q.Now = func() time.Time { return time.Now().Add(time.Hour) }
+	if msg, _ := q.ReceiveMessageWithContext(context.TODO()); msg == nil {
+		t.Errorf("expected message to be visible once it is due")
+	}
+
+	infoLogs := Logs(logger.Logs).ByLevel()["info"]
+	if len(infoLogs) != 1 {
+		t.Fatalf("expected 1 info log, got %d", len(infoLogs))
+	}
+	if status := infoLogs[0].Fields()["status"]; status != "deferred" {
+		t.Errorf("expected log field 'status' to equal 'deferred', got '%v'", status)
+	}
+}
+
+func Test_Gantry_HandlesMessagesInOrder(t *testing.T) {
+	q, _ := newTestQueue(time.Now())
+	for _, v := range []string{"one", "two", "three"} {
+		publishFixture(t, q, "./fixtures/env-propagation", messageBody{Env: env{"TEST_VAR": v}})
+	}
 	logger := NewRecorder()
 
 	g := Gantry{
-		ctx: context.TODO(),
-		src: mockSrc{messages: []Message{
-			fixtureMessage{
-				payload: payload,
-				body: messageBody{
-					Env: map[string]string{"test": "out"},
-				},
-				sentAt: time.Date(2018, time.June, 01, 0, 0, 0, 0, time.UTC),
-			},
-		}},
+		ctx:    context.TODO(),
+		src:    q,
 		logger: logger,
 	}
 
-	err = g.HandleMessageIfExists()
+	for i := 0; i < 3; i++ {
+		if err := g.HandleMessageIfExists(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var executed []string
+	for _, entry := range Logs(logger.Logs).ByLevel()["info"] {
+		if entry.Fields()["status"] == "completed" {
+			executed = append(executed, entry.Fields()["command_env"].(map[string]string)["TEST_VAR"])
+		}
+	}
+
+	expected := []string{"one", "two", "three"}
+	if !reflect.DeepEqual(expected, executed) {
+		t.Errorf("expected payloads to be executed in order %v, got %v", expected, executed)
+	}
+	if q.Len() != 0 {
+		t.Errorf("expected all messages to be deleted, %d left", q.Len())
+	}
+}
+
+func Test_Gantry_DrainsTheQueueWithWorkers(t *testing.T) {
+	q, _ := newTestQueue(time.Now())
+	for i := 0; i < 5; i++ {
+		publishFixture(t, q, "./fixtures/env-propagation", messageBody{Env: env{"TEST_VAR": "is set"}})
+	}
+
+	g := Gantry{
+		ctx:     context.TODO(),
+		src:     q,
+		workers: 2,
+		logger:  noopLogger{},
+	}
+	g.drain()
+
+	if q.Len() != 0 {
+		t.Errorf("expected all messages to be handled, %d left", q.Len())
+	}
+}
+
+func Test_Gantry_RunsEntrypointScriptInMessagesWithSanePayloads(t *testing.T) {
+	q, _ := newTestQueue(time.Date(2018, time.June, 01, 0, 0, 0, 0, time.UTC))
+	publishFixture(t, q, "./fixtures/greet", messageBody{
+		Env: map[string]string{"test": "out"},
+	})
+	logger := NewRecorder()
+
+	g := Gantry{
+		ctx:    context.TODO(),
+		src:    q,
+		logger: logger,
+	}
+
+	err := g.HandleMessageIfExists()
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -114,8 +312,8 @@ func Test_Gantry_RunsEntrypointScriptInMessagesWithSanePayloads(t *testing.T) {
 			expectedFields := map[string]interface{}{
 				"status": "message received",
 				"message": map[string]interface{}{
-					"id":        "mock-msg-id-123",
-					"body":      messageBody{Env: env{"test": "out"}},
+					"id":        "mem-1",
+					"body":      messageBody{Version: messageVersion, Env: env{"test": "out"}},
 					"queued_at": "2018-06-01T00:00:00Z",
 				},
 			}
@@ -147,54 +345,39 @@ func Test_Gantry_RunsEntrypointScriptInMessagesWithSanePayloads(t *testing.T) {
 }
 
 func Test_Gantry_PropagatesEnvToEntrypoint(t *testing.T) {
-	payload, err := Payloader{}.DirToTarGz("./fixtures/env-propagation")
-	if err != nil {
-		t.Fatal(err)
-	}
+	q, _ := newTestQueue(time.Now())
+	publishFixture(t, q, "./fixtures/env-propagation", messageBody{
+		Env: env{"TEST_VAR": "is set"},
+	})
 	logger := NewRecorder()
 
 	g := Gantry{
-		ctx: context.TODO(),
-		src: mockSrc{messages: []Message{
-			fixtureMessage{
-				payload: payload,
-				body: messageBody{
-					Env: env{"TEST_VAR": "is set"},
-				},
-			},
-		}},
+		ctx:    context.TODO(),
+		src:    q,
 		logger: logger,
 	}
 
-	err = g.HandleMessageIfExists()
+	err := g.HandleMessageIfExists()
 	if err != nil {
 		t.Fatal(err)
 	}
 }
 
 func Test_Gantry_RunsExecutableEntrypointScriptWithoutShebang(t *testing.T) {
-	payload, err := Payloader{}.DirToTarGz("./fixtures/executable-script-no-shebang")
-	if err != nil {
-		t.Fatal(err)
-	}
+	q, _ := newTestQueue(time.Date(2018, time.June, 01, 0, 0, 0, 0, time.UTC))
+	publishFixture(t, q, "./fixtures/executable-script-no-shebang", messageBody{
+		Env: map[string]string{"test": "out"},
+	})
 
 	logger := NewRecorder()
 
 	g := Gantry{
-		ctx: context.TODO(),
-		src: mockSrc{messages: []Message{
-			fixtureMessage{
-				payload: payload,
-				body: messageBody{
-					Env: map[string]string{"test": "out"},
-				},
-				sentAt: time.Date(2018, time.June, 01, 0, 0, 0, 0, time.UTC),
-			},
-		}},
+		ctx:    context.TODO(),
+		src:    q,
 		logger: logger,
 	}
 
-	err = g.HandleMessageIfExists()
+	err := g.HandleMessageIfExists()
 	pathErr, ok := err.(*os.PathError)
 	if !ok {
 		t.Fatalf("expected path error, got %v", err)
@@ -239,18 +422,16 @@ func Test_Gantry_RunsExecutableEntrypointScriptWithoutShebang(t *testing.T) {
 }
 
 func Test_Gantry_RaisesErrOnNonExecutableEntrypointScript(t *testing.T) {
-	payload, err := Payloader{}.DirToTarGz("./fixtures/non-executable-entrypoint")
-	if err != nil {
-		t.Fatal(err)
-	}
+	q, _ := newTestQueue(time.Now())
+	publishFixture(t, q, "./fixtures/non-executable-entrypoint", messageBody{})
 
 	g := Gantry{
 		ctx:    context.TODO(),
-		src:    mockSrc{messages: []Message{fixtureMessage{payload: payload}}},
+		src:    q,
 		logger: noopLogger{},
 	}
 
-	err = g.HandleMessageIfExists()
+	err := g.HandleMessageIfExists()
 	if err == nil {
 		t.Fatalf("expected non executable entrypoint to raise an error")
 	}
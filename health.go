@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Health tracks the polls of a consumer for liveness and readiness probes.
+// A nil *Health records nothing.
+//
+// The consumer is alive as long as a poll succeeded within MaxPollAge, or a
+// payload is running, as no polls happen while all workers are busy. It is
+// ready unless the last MaxFailedPolls polls failed, or it is draining.
+type Health struct {
+	// MaxPollAge is the time after the last successful poll after which
+	// the consumer is considered dead
+	MaxPollAge time.Duration
+	// MaxFailedPolls is the number of consecutive failed polls after
+	// which the consumer is not ready
+	MaxFailedPolls int
+	// Now returns the current time, it can be replaced in tests
+	Now func() time.Time
+
+	mu                 sync.Mutex
+	startedAt          time.Time
+	lastPollAt         time.Time
+	lastPollErr        error
+	lastSuccessfulPoll time.Time
+	failedPolls        int
+	inFlight           int
+	draining           bool
+}
+
+// NewHealth returns a Health which counts the poll age from now
+func NewHealth(maxPollAge time.Duration, maxFailedPolls int) *Health {
+	return &Health{
+		MaxPollAge:     maxPollAge,
+		MaxFailedPolls: maxFailedPolls,
+		Now:            time.Now,
+		startedAt:      time.Now(),
+	}
+}
+
+// healthStatus is the body of health and readiness responses
+type healthStatus struct {
+	Status                 string     `json:"status"`
+	Reason                 string     `json:"reason,omitempty"`
+	LastPollAt             *time.Time `json:"last_poll_at,omitempty"`
+	LastPollError          string     `json:"last_poll_error,omitempty"`
+	LastSuccessfulPollAt   *time.Time `json:"last_successful_poll_at,omitempty"`
+	ConsecutiveFailedPolls int        `json:"consecutive_failed_polls"`
+	InFlight               int        `json:"in_flight"`
+	Draining               bool       `json:"draining"`
+}
+
+// InstrumentSource returns src, recording whether its polls succeed
+func (h *Health) InstrumentSource(src MessageSource) MessageSource {
+	if h == nil {
+		return src
+	}
+	return healthSource{src: src, health: h}
+}
+
+// SetDraining marks the consumer as not ready, as it stopped receiving
+func (h *Health) SetDraining() {
+	if h == nil {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.draining = true
+}
+
+// executionStarted records that a payload started to run, the returned func
+// records that it finished
+func (h *Health) executionStarted() func() {
+	if h == nil {
+		return func() {}
+	}
+	h.mu.Lock()
+	h.inFlight++
+	h.mu.Unlock()
+	return func() {
+		h.mu.Lock()
+		h.inFlight--
+		h.mu.Unlock()
+	}
+}
+
+func (h *Health) recordPoll(err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.lastPollAt = h.Now()
+	h.lastPollErr = err
+	if err != nil {
+		h.failedPolls++
+		return
+	}
+	h.failedPolls = 0
+	h.lastSuccessfulPoll = h.lastPollAt
+}
+
+// status returns the current status, with Status and Reason unset. It must
+// be called with h.mu held.
+func (h *Health) status() healthStatus {
+	s := healthStatus{
+		ConsecutiveFailedPolls: h.failedPolls,
+		InFlight:               h.inFlight,
+		Draining:               h.draining,
+	}
+	if !h.lastPollAt.IsZero() {
+		lastPollAt := h.lastPollAt
+		s.LastPollAt = &lastPollAt
+	}
+	if h.lastPollErr != nil {
+		s.LastPollError = h.lastPollErr.Error()
+	}
+	if !h.lastSuccessfulPoll.IsZero() {
+		lastSuccessfulPoll := h.lastSuccessfulPoll
+		s.LastSuccessfulPollAt = &lastSuccessfulPoll
+	}
+	return s
+}
+
+// Live returns the status for the liveness probe, and whether the consumer
+// is alive
+func (h *Health) Live() (healthStatus, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s := h.status()
+
+	since := h.lastSuccessfulPoll
+	if since.IsZero() {
+		since = h.startedAt
+	}
+	if age := h.Now().Sub(since); h.inFlight == 0 && age > h.MaxPollAge {
+		s.Reason = "no successful poll for " + age.Round(time.Second).String()
+	}
+	return h.conclude(s)
+}
+
+// Ready returns the status for the readiness probe, and whether the
+// consumer is ready
+func (h *Health) Ready() (healthStatus, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s := h.status()
+
+	switch {
+	case h.draining:
+		s.Reason = "draining"
+	case h.lastSuccessfulPoll.IsZero():
+		s.Reason = "no successful poll yet"
+	case h.MaxFailedPolls > 0 && h.failedPolls >= h.MaxFailedPolls:
+		s.Reason = "the last polls failed"
+	}
+	return h.conclude(s)
+}
+
+// conclude sets the status of s according to its reason
+func (h *Health) conclude(s healthStatus) (healthStatus, bool) {
+	if s.Reason != "" {
+		s.Status = "failing"
+		return s, false
+	}
+	s.Status = "ok"
+	return s, true
+}
+
+// Handler returns the handler which serves /healthz and /readyz
+func (h *Health) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		writeHealthStatus(w, h.Live)
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		writeHealthStatus(w, h.Ready)
+	})
+	return mux
+}
+
+func writeHealthStatus(w http.ResponseWriter, check func() (healthStatus, bool)) {
+	s, ok := check()
+	code := http.StatusOK
+	if !ok {
+		code = http.StatusServiceUnavailable
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(s)
+}
+
+type healthSource struct {
+	src    MessageSource
+	health *Health
+}
+
+func (hs healthSource) ReceiveMessageWithContext(ctx context.Context) (Message, error) {
+	msg, err := hs.src.ReceiveMessageWithContext(ctx)
+	switch {
+	case err != nil && msg != nil:
+		// messages handed out for dead-lettering were received all the
+		// same
+		hs.health.recordPoll(nil)
+	case err != nil && ctx.Err() != nil:
+		// polls cancelled on shutdown didn't fail
+	default:
+		hs.health.recordPoll(err)
+	}
+	return msg, err
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// sourceFunc is a MessageSource which calls itself to receive
+type sourceFunc func(context.Context) (Message, error)
+
+func (f sourceFunc) ReceiveMessageWithContext(ctx context.Context) (Message, error) {
+	return f(ctx)
+}
+
+func newTestHealth() (*Health, *fakeClock) {
+	clock := &fakeClock{t: time.Date(2018, time.June, 01, 0, 0, 0, 0, time.UTC)}
+	h := NewHealth(5*time.Minute, 2)
+	h.Now = clock.Now
+	h.startedAt = clock.Now()
+	return h, clock
+}
+
+func Test_Health_ReflectsPolls(t *testing.T) {
+	h, clock := newTestHealth()
+	var pollErr error
+	src := h.InstrumentSource(sourceFunc(func(context.Context) (Message, error) {
+		return nil, pollErr
+	}))
+	poll := func() { src.ReceiveMessageWithContext(context.TODO()) }
+
+	if _, ok := h.Live(); !ok {
+		t.Errorf("expected consumer to be alive after start")
+	}
+	if s, ok := h.Ready(); ok {
+		t.Errorf("expected consumer not to be ready before the first poll, got %+v", s)
+	}
+
+	poll()
+	if s, ok := h.Ready(); !ok {
+		t.Errorf("expected consumer to be ready after a successful poll, got %+v", s)
+	}
+
+	pollErr = errors.New("credentials expired")
+	poll()
+	if s, ok := h.Ready(); !ok || s.LastPollError != "credentials expired" {
+		t.Errorf("expected consumer to be ready after a single failed poll, got %+v", s)
+	}
+	poll()
+	if s, ok := h.Ready(); ok || s.ConsecutiveFailedPolls != 2 {
+		t.Errorf("expected consumer not to be ready after 2 failed polls, got %+v", s)
+	}
+
+	clock.Advance(6 * time.Minute)
+	if s, ok := h.Live(); ok {
+		t.Errorf("expected consumer to be dead without a successful poll for 6 minutes, got %+v", s)
+	}
+	finished := h.executionStarted()
+	if s, ok := h.Live(); !ok {
+		t.Errorf("expected consumer to be alive while a payload is running, got %+v", s)
+	}
+	finished()
+
+	pollErr = nil
+	poll()
+	if _, ok := h.Live(); !ok {
+		t.Errorf("expected consumer to be alive after a successful poll")
+	}
+	h.SetDraining()
+	if s, ok := h.Ready(); ok || s.Reason != "draining" {
+		t.Errorf("expected draining consumer not to be ready, got %+v", s)
+	}
+}
+
+func Test_Health_IgnoresPollsCancelledOnShutdown(t *testing.T) {
+	h, _ := newTestHealth()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	src := h.InstrumentSource(sourceFunc(func(ctx context.Context) (Message, error) {
+		return nil, ctx.Err()
+	}))
+	src.ReceiveMessageWithContext(ctx)
+
+	if s, _ := h.Ready(); s.LastPollAt != nil {
+		t.Errorf("expected cancelled poll not to be recorded, got %+v", s)
+	}
+}
+
+func Test_Health_ServesProbes(t *testing.T) {
+	h, _ := newTestHealth()
+	server := httptest.NewServer(h.Handler())
+	defer server.Close()
+
+	probe := func(path string) (int, healthStatus) {
+		t.Helper()
+		resp, err := http.Get(server.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var s healthStatus
+		if err := json.NewDecoder(resp.Body).Decode(&s); err != nil {
+			t.Fatal(err)
+		}
+		return resp.StatusCode, s
+	}
+
+	if code, s := probe("/healthz"); code != http.StatusOK || s.Status != "ok" {
+		t.Errorf("expected healthz to succeed, got %d %+v", code, s)
+	}
+	if code, s := probe("/readyz"); code != http.StatusServiceUnavailable || s.Status != "failing" {
+		t.Errorf("expected readyz to fail, got %d %+v", code, s)
+	}
+}
+
+func Test_Gantry_StopsReceivingWhenStopped(t *testing.T) {
+	q := NewMemoryQueue(time.Minute)
+	g := Gantry{
+		ctx:    context.TODO(),
+		src:    q,
+		stop:   make(chan struct{}),
+		logger: noopLogger{},
+	}
+
+	done := make(chan struct{})
+	go func() {
+		g.Run()
+		close(done)
+	}()
+	g.Stop()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected Run to return once stopped")
+	}
+
+	publishFixture(t, q, "./fixtures/greet", messageBody{})
+	g.drain()
+	if q.Len() != 1 {
+		t.Errorf("expected stopped gantry not to receive messages")
+	}
+}
@@ -0,0 +1,303 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/pkg/errors"
+	bolt "go.etcd.io/bbolt"
+)
+
+// maxHistoryOutput is the number of bytes of stdout and stderr each which
+// are kept per execution, earlier output is dropped
+const maxHistoryOutput = 4 << 10
+
+// historyBucket holds the executions, keyed by their big endian id
+var historyBucket = []byte("executions")
+
+// A HistoryEntry records an execution of a payload. Only the keys of the
+// env are kept, as its values may be sensitive.
+type HistoryEntry struct {
+	ID            uint64        `json:"id"`
+	MessageID     string        `json:"message_id"`
+	EnvKeys       []string      `json:"env_keys"`
+	PayloadDigest string        `json:"payload_digest"`
+	StartedAt     time.Time     `json:"started_at"`
+	Duration      time.Duration `json:"duration"`
+	Success       bool          `json:"success"`
+	// ExitStatus is the exit code of the entrypoint, -1 if it didn't run
+	// or was killed by a signal
+	ExitStatus int    `json:"exit_status"`
+	Error      string `json:"error,omitempty"`
+	// Artifacts are the references of the collected artifacts
+	Artifacts []string `json:"artifacts,omitempty"`
+	Stdout    string   `json:"stdout,omitempty"`
+	Stderr    string   `json:"stderr,omitempty"`
+}
+
+// Status is "succeeded" or "failed"
+func (e HistoryEntry) Status() string {
+	if e.Success {
+		return executionSucceeded
+	}
+	return executionFailed
+}
+
+// A HistoryFilter selects history entries, zero fields match all entries
+type HistoryFilter struct {
+	MessageID string
+	// Status is "succeeded" or "failed"
+	Status string
+	Since  time.Time
+	// Limit is the maximum number of entries, the latest are returned
+	Limit int
+}
+
+func (f HistoryFilter) matches(e HistoryEntry) bool {
+	switch {
+	case f.MessageID != "" && e.MessageID != f.MessageID:
+		return false
+	case f.Status != "" && e.Status() != f.Status:
+		return false
+	case !f.Since.IsZero() && e.StartedAt.Before(f.Since):
+		return false
+	}
+	return true
+}
+
+// A History records executions in a bbolt database. The database is only
+// opened while entries are written or read, as bbolt locks it, so that
+// `gantry history` can read it while a consumer is running. A nil *History
+// records nothing.
+type History struct {
+	path string
+	// MaxEntries is the number of entries kept, older ones are removed
+	// when recording, 0 keeps all
+	MaxEntries int
+
+	// mu serializes the opens of this process, which would wait for each
+	// other's lock otherwise
+	mu sync.Mutex
+}
+
+// NewHistory returns a History stored at path, the database is created
+// with the first entry
+func NewHistory(path string, maxEntries int) *History {
+	return &History{path: path, MaxEntries: maxEntries}
+}
+
+func (h *History) open(readOnly bool) (*bolt.DB, error) {
+	if readOnly {
+		if _, err := os.Stat(h.path); err != nil {
+			return nil, errors.Wrap(err, "no execution history")
+		}
+	}
+	db, err := bolt.Open(h.path, 0600, &bolt.Options{Timeout: 10 * time.Second, ReadOnly: readOnly})
+	if err != nil {
+		return nil, errors.Wrap(err, fmt.Sprintf("can not open execution history %s", h.path))
+	}
+	return db, nil
+}
+
+// Record adds e to the history, its ID is assigned
+func (h *History) Record(e HistoryEntry) error {
+	if h == nil {
+		return nil
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	db, err := h.open(false)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists(historyBucket)
+		if err != nil {
+			return err
+		}
+		if e.ID, err = b.NextSequence(); err != nil {
+			return err
+		}
+		v, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		if err := b.Put(historyKey(e.ID), v); err != nil {
+			return err
+		}
+
+		// ids are sequential, so entries older than the last MaxEntries
+		// ones are the first keys up to the cutoff
+		if h.MaxEntries <= 0 || e.ID <= uint64(h.MaxEntries) {
+			return nil
+		}
+		cutoff := e.ID - uint64(h.MaxEntries)
+		var expired [][]byte
+		c := b.Cursor()
+		for k, _ := c.First(); k != nil && binary.BigEndian.Uint64(k) <= cutoff; k, _ = c.Next() {
+			expired = append(expired, k)
+		}
+		for _, k := range expired {
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return errors.Wrap(err, "can not record execution")
+}
+
+// List returns the entries matching f, the latest first
+func (h *History) List(f HistoryFilter) ([]HistoryEntry, error) {
+	var entries []HistoryEntry
+	err := h.view(func(b *bolt.Bucket) error {
+		c := b.Cursor()
+		for k, v := c.Last(); k != nil; k, v = c.Prev() {
+			var e HistoryEntry
+			if err := json.Unmarshal(v, &e); err != nil {
+				return errors.Wrap(err, fmt.Sprintf("malformed execution %d", binary.BigEndian.Uint64(k)))
+			}
+			if !f.matches(e) {
+				continue
+			}
+			entries = append(entries, e)
+			if f.Limit > 0 && len(entries) == f.Limit {
+				break
+			}
+		}
+		return nil
+	})
+	return entries, err
+}
+
+// Get returns the entry with id
+func (h *History) Get(id uint64) (HistoryEntry, error) {
+	var e HistoryEntry
+	err := h.view(func(b *bolt.Bucket) error {
+		v := b.Get(historyKey(id))
+		if v == nil {
+			return errors.Errorf("no execution with id %d", id)
+		}
+		return errors.Wrap(json.Unmarshal(v, &e), fmt.Sprintf("malformed execution %d", id))
+	})
+	return e, err
+}
+
+// view calls fn with the executions bucket, if there is one
+func (h *History) view(fn func(*bolt.Bucket) error) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	db, err := h.open(true)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	return db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(historyBucket)
+		if b == nil {
+			return errors.New("no executions recorded yet")
+		}
+		return fn(b)
+	})
+}
+
+func historyKey(id uint64) []byte {
+	k := make([]byte, 8)
+	binary.BigEndian.PutUint64(k, id)
+	return k
+}
+
+// exitStatus returns the exit code of the entrypoint run with err
+func exitStatus(err error) int {
+	if err == nil {
+		return 0
+	}
+	if exitErr, ok := errors.Cause(err).(interface{ ExitCode() int }); ok {
+		return exitErr.ExitCode()
+	}
+	return -1
+}
+
+// tail returns the last max bytes of s
+func tail(s string, max int) string {
+	if len(s) <= max {
+		return s
+	}
+	return s[len(s)-max:]
+}
+
+// A tailBuffer is an io.Writer which keeps the last max bytes written to it
+type tailBuffer struct {
+	max int
+	b   []byte
+}
+
+func (tb *tailBuffer) Write(p []byte) (int, error) {
+	tb.b = append(tb.b, p...)
+	if len(tb.b) > tb.max {
+		tb.b = append(tb.b[:0], tb.b[len(tb.b)-tb.max:]...)
+	}
+	return len(p), nil
+}
+
+func (tb *tailBuffer) String() string {
+	return string(tb.b)
+}
+
+// printHistory writes entries as a table, or as JSON
+func printHistory(w io.Writer, entries []HistoryEntry, asJSON bool) error {
+	if asJSON {
+		if entries == nil {
+			entries = []HistoryEntry{}
+		}
+		return errors.Wrap(json.NewEncoder(w).Encode(entries), "can not write execution history")
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tSTARTED\tMESSAGE ID\tSTATUS\tEXIT\tDURATION\tDIGEST")
+	for _, e := range entries {
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%s\t%d\t%s\t%.12s\n",
+			e.ID, e.StartedAt.Format(time.RFC3339), e.MessageID, e.Status(),
+			e.ExitStatus, e.Duration.Round(time.Millisecond), e.PayloadDigest)
+	}
+	return errors.Wrap(tw.Flush(), "can not write execution history")
+}
+
+// printHistoryEntry writes all of e, or e as JSON
+func printHistoryEntry(w io.Writer, e HistoryEntry, asJSON bool) error {
+	if asJSON {
+		return errors.Wrap(json.NewEncoder(w).Encode(e), "can not write execution")
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	for _, field := range [][2]string{
+		{"ID", strconv.FormatUint(e.ID, 10)},
+		{"Message ID", e.MessageID},
+		{"Started", e.StartedAt.Format(time.RFC3339)},
+		{"Duration", e.Duration.String()},
+		{"Status", e.Status()},
+		{"Exit status", strconv.Itoa(e.ExitStatus)},
+		{"Error", e.Error},
+		{"Payload digest", e.PayloadDigest},
+		{"Env keys", fmt.Sprint(e.EnvKeys)},
+		{"Artifacts", strings.Join(e.Artifacts, " ")},
+	} {
+		fmt.Fprintf(tw, "%s:\t%s\n", field[0], field[1])
+	}
+	if err := tw.Flush(); err != nil {
+		return errors.Wrap(err, "can not write execution")
+	}
+	_, err := fmt.Fprintf(w, "\nStdout:\n%s\nStderr:\n%s\n", e.Stdout, e.Stderr)
+	return errors.Wrap(err, "can not write execution")
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestHistory(t *testing.T, maxEntries int) *History {
+	t.Helper()
+	return NewHistory(filepath.Join(helper{t}.tempDir(), "history.db"), maxEntries)
+}
+
+func Test_History_ListsAndFiltersExecutions(t *testing.T) {
+	h := newTestHistory(t, 3)
+	start := time.Date(2018, time.June, 01, 0, 0, 0, 0, time.UTC)
+	for i, e := range []HistoryEntry{
+		{MessageID: "a", Success: true},
+		{MessageID: "b", Success: false, ExitStatus: 1},
+		{MessageID: "c", Success: true},
+		{MessageID: "b", Success: true},
+	} {
+		e.StartedAt = start.Add(time.Duration(i) * time.Minute)
+		if err := h.Record(e); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, tc := range []struct {
+		name     string
+		filter   HistoryFilter
+		expected []uint64
+	}{
+		{"drops the oldest entries", HistoryFilter{}, []uint64{4, 3, 2}},
+		{"by message id", HistoryFilter{MessageID: "b"}, []uint64{4, 2}},
+		{"by status", HistoryFilter{Status: executionFailed}, []uint64{2}},
+		{"by start", HistoryFilter{Since: start.Add(2 * time.Minute)}, []uint64{4, 3}},
+		{"up to the limit", HistoryFilter{Limit: 1}, []uint64{4}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			entries, err := h.List(tc.filter)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var ids []uint64
+			for _, e := range entries {
+				ids = append(ids, e.ID)
+			}
+			if !reflect.DeepEqual(ids, tc.expected) {
+				t.Errorf("expected ids %v, got %v", tc.expected, ids)
+			}
+		})
+	}
+
+	t.Run("shows an entry", func(t *testing.T) {
+		e, err := h.Get(2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if e.MessageID != "b" || e.ExitStatus != 1 {
+			t.Errorf("expected the failed execution of b, got %+v", e)
+		}
+		if _, err := h.Get(1); err == nil {
+			t.Errorf("expected dropped entry to be missing")
+		}
+	})
+}
+
+func Test_History_FailsWithoutRecordedExecutions(t *testing.T) {
+	h := newTestHistory(t, 0)
+	if _, err := h.List(HistoryFilter{}); err == nil {
+		t.Errorf("expected listing a missing history to fail")
+	}
+}
+
+func Test_Gantry_RecordsExecutionsInHistory(t *testing.T) {
+	q, _ := newTestQueue(time.Now())
+	publishFixture(t, q, "./fixtures/greet", messageBody{Env: env{"B": "2", "A": "1"}})
+	publishFixture(t, q, "./fixtures/env-propagation", messageBody{})
+	h := newTestHistory(t, 0)
+
+	g := Gantry{
+		ctx:     context.TODO(),
+		src:     q,
+		history: h,
+		logger:  noopLogger{},
+	}
+	g.HandleMessageIfExists()
+	g.HandleMessageIfExists()
+
+	entries, err := h.List(HistoryFilter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("expected 2 executions, got %d", len(entries))
+	}
+
+	t.Run("records successful executions", func(t *testing.T) {
+		e := entries[1]
+		payload, err := Payloader{}.DirToTarGz("./fixtures/greet")
+		if err != nil {
+			t.Fatal(err)
+		}
+		digest := sha256.Sum256(payload)
+		expected := HistoryEntry{
+			ID:            1,
+			MessageID:     "mem-1",
+			EnvKeys:       []string{"A", "B"},
+			PayloadDigest: hex.EncodeToString(digest[:]),
+			Success:       true,
+			Stdout:        "Hello Fixture\n",
+			Stderr:        "Hello stderr\n",
+		}
+		e.StartedAt, e.Duration = time.Time{}, 0
+		if !reflect.DeepEqual(e, expected) {
+			t.Errorf("expected %+v, got %+v", expected, e)
+		}
+	})
+
+	t.Run("records the exit status of failed executions", func(t *testing.T) {
+		e := entries[0]
+		if e.Success || e.ExitStatus != 1 || e.Error != "exit status 1" {
+			t.Errorf("expected failure with exit status 1, got %+v", e)
+		}
+	})
+}
+
+func Test_Gantry_RecordsOnlyExecutionsWhichRan(t *testing.T) {
+	q, _ := newTestQueue(time.Now())
+	publishFixture(t, q, writePayloadDir(t, "entrypoint: bin/missing.sh", ""), messageBody{})
+	publishFixture(t, q, writePayloadDir(t, "entrypoint: bin/run.sh\nrequired_labels: {region: eu-west-1}", ""), messageBody{})
+	h := newTestHistory(t, 0)
+
+	g := Gantry{
+		ctx:     context.TODO(),
+		src:     q,
+		history: h,
+		logger:  noopLogger{},
+	}
+	for _, expected := range []string{statusCompleted, statusReleased} {
+		status, _, _ := g.HandleMessage(receive(t, q))
+		if status != expected {
+			t.Fatalf("expected status %s, got %s", expected, status)
+		}
+	}
+
+	if entries, err := h.List(HistoryFilter{}); err == nil {
+		t.Errorf("expected released and invalid payloads not to be recorded, got %+v", entries)
+	}
+}
+
+func Test_Gantry_RedactsOutputInHistory(t *testing.T) {
+	q, _ := newTestQueue(time.Now())
+	dir := writePayloadDir(t, "entrypoint: bin/run.sh", `echo "$API_TOKEN $PIN $REGION"; echo "pin $PIN" >&2`)
+	publishFixture(t, q, dir, messageBody{
+		Env:       env{"API_TOKEN": "t0ken", "PIN": "1234", "REGION": "eu-west-1"},
+		Sensitive: []string{"PIN"},
+	})
+	h := newTestHistory(t, 0)
+
+	g := Gantry{
+		ctx:            context.TODO(),
+		src:            q,
+		history:        h,
+		redactPatterns: defaultRedactPatterns,
+		logger:         noopLogger{},
+	}
+	if err := g.HandleMessageIfExists(); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := h.List(HistoryFilter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("expected 1 execution, got %d", len(entries))
+	}
+	if e := entries[0]; e.Stdout != "[redacted] [redacted] eu-west-1\n" || e.Stderr != "pin [redacted]\n" {
+		t.Errorf("expected sensitive env values to be redacted, got stdout %q, stderr %q", e.Stdout, e.Stderr)
+	}
+}
+
+func Test_TailBuffer_KeepsTheLastBytes(t *testing.T) {
+	tb := tailBuffer{max: 4}
+	for _, s := range []string{"ab", "cdef", "g"} {
+		tb.Write([]byte(s))
+	}
+	if tb.String() != "defg" {
+		t.Errorf("expected %q, got %q", "defg", tb.String())
+	}
+}
+
+func Test_PrintHistory(t *testing.T) {
+	entries := []HistoryEntry{{
+		ID:            2,
+		MessageID:     "mem-2",
+		PayloadDigest: "0123456789abcdef",
+		StartedAt:     time.Date(2018, time.June, 01, 0, 0, 0, 0, time.UTC),
+		Duration:      1500 * time.Millisecond,
+		ExitStatus:    1,
+	}}
+
+	var buf bytes.Buffer
+	if err := printHistory(&buf, entries, false); err != nil {
+		t.Fatal(err)
+	}
+	expected := strings.Join([]string{
+		"ID  STARTED               MESSAGE ID  STATUS  EXIT  DURATION  DIGEST",
+		"2   2018-06-01T00:00:00Z  mem-2       failed  1     1.5s      0123456789ab",
+		"",
+	}, "\n")
+	if buf.String() != expected {
+		t.Errorf("expected table\n%s\ngot\n%s", expected, buf.String())
+	}
+}
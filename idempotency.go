@@ -0,0 +1,176 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+	"github.com/pkg/errors"
+	bolt "go.etcd.io/bbolt"
+)
+
+// An IdempotencyStore records the idempotency keys of completed executions,
+// so that duplicate deliveries of a message are not executed again
+type IdempotencyStore interface {
+	// Completed reports whether an execution with key completed, and
+	// its record didn't expire yet
+	Completed(key string) (bool, error)
+	// Complete records that the execution with key completed, the record
+	// expires after ttl
+	Complete(key string, ttl time.Duration) error
+}
+
+// OpenIdempotencyStore returns the IdempotencyStore for rawURL, which is
+// file:///path/to/file for a local bbolt database or dynamodb://<table> for
+// a DynamoDB table
+func OpenIdempotencyStore(rawURL string) (IdempotencyStore, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, errors.Wrap(err, "idempotency: can not parse idempotency store url")
+	}
+	switch strings.ToLower(u.Scheme) {
+	case "file":
+		return NewBoltIdempotencyStore(u.Path)
+	case "dynamodb":
+		sess, err := session.NewSession()
+		if err != nil {
+			return nil, errors.Wrap(err, "idempotency: can not create aws session")
+		}
+		return NewDynamoDBIdempotencyStore(dynamodb.New(sess), u.Host), nil
+	}
+	return nil, errors.Errorf("idempotency: unsupported idempotency store url scheme %q, supported are file,dynamodb", u.Scheme)
+}
+
+// defaultIdempotencyKey returns the key of payload executed with e, it is
+// the digest of the payload and a hash of the env
+func defaultIdempotencyKey(e env, payload []byte) string {
+	digest := sha256.Sum256(payload)
+	h := sha256.New()
+	for _, k := range e.Keys() {
+		// keys and values are separated by NUL, which they can't contain
+		fmt.Fprintf(h, "%s\x00%s\x00", k, e[k])
+	}
+	return hex.EncodeToString(digest[:]) + "-" + hex.EncodeToString(h.Sum(nil))
+}
+
+// idempotencyBucket holds the keys, with their big endian unix expiry as
+// value
+var idempotencyBucket = []byte("completed")
+
+type boltIdempotencyStore struct {
+	db  *bolt.DB
+	now func() time.Time
+}
+
+// NewBoltIdempotencyStore returns an IdempotencyStore which keeps the keys in
+// a bbolt database at path. The database is locked while it is open, it
+// can't be shared by consumers.
+func NewBoltIdempotencyStore(path string) (IdempotencyStore, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 10 * time.Second})
+	if err != nil {
+		return nil, errors.Wrap(err, fmt.Sprintf("idempotency: can not open %s", path))
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(idempotencyBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, errors.Wrap(err, fmt.Sprintf("idempotency: can not open %s", path))
+	}
+	return &boltIdempotencyStore{db: db, now: time.Now}, nil
+}
+
+func (s *boltIdempotencyStore) Completed(key string) (bool, error) {
+	var completed bool
+	err := s.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(idempotencyBucket).Get([]byte(key))
+		completed = len(v) == 8 && s.now().Unix() < int64(binary.BigEndian.Uint64(v))
+		return nil
+	})
+	return completed, errors.Wrap(err, "idempotency: can not look up key")
+}
+
+func (s *boltIdempotencyStore) Complete(key string, ttl time.Duration) error {
+	now := s.now()
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(idempotencyBucket)
+		expiresAt := make([]byte, 8)
+		binary.BigEndian.PutUint64(expiresAt, uint64(now.Add(ttl).Unix()))
+		if err := b.Put([]byte(key), expiresAt); err != nil {
+			return err
+		}
+
+		// expired keys are removed on the way, there are as many as
+		// keys are recorded within a ttl
+		var expired [][]byte
+		b.ForEach(func(k, v []byte) error {
+			if len(v) != 8 || now.Unix() >= int64(binary.BigEndian.Uint64(v)) {
+				expired = append(expired, k)
+			}
+			return nil
+		})
+		for _, k := range expired {
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return errors.Wrap(err, "idempotency: can not record key")
+}
+
+type dynamoDBIdempotencyStore struct {
+	client dynamodbiface.DynamoDBAPI
+	table  string
+	now    func() time.Time
+}
+
+// NewDynamoDBIdempotencyStore returns an IdempotencyStore which keeps the
+// keys in a DynamoDB table, whose partition key is the string "key". The
+// expiry is stored as unix time in "expires_at", which should be enabled as
+// the TTL attribute of the table to remove expired keys.
+func NewDynamoDBIdempotencyStore(client dynamodbiface.DynamoDBAPI, table string) IdempotencyStore {
+	return dynamoDBIdempotencyStore{client: client, table: table, now: time.Now}
+}
+
+func (s dynamoDBIdempotencyStore) Completed(key string) (bool, error) {
+	out, err := s.client.GetItem(&dynamodb.GetItemInput{
+		TableName:      aws.String(s.table),
+		Key:            map[string]*dynamodb.AttributeValue{"key": {S: aws.String(key)}},
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return false, errors.Wrap(err, "idempotency: can not look up key")
+	}
+	expiresAt, ok := out.Item["expires_at"]
+	if !ok || expiresAt.N == nil {
+		return false, nil
+	}
+	// DynamoDB removes expired items eventually, not right away
+	unix, err := strconv.ParseInt(*expiresAt.N, 10, 64)
+	if err != nil {
+		return false, errors.Wrap(err, "idempotency: malformed expires_at")
+	}
+	return s.now().Unix() < unix, nil
+}
+
+func (s dynamoDBIdempotencyStore) Complete(key string, ttl time.Duration) error {
+	_, err := s.client.PutItem(&dynamodb.PutItemInput{
+		TableName: aws.String(s.table),
+		Item: map[string]*dynamodb.AttributeValue{
+			"key":        {S: aws.String(key)},
+			"expires_at": {N: aws.String(strconv.FormatInt(s.now().Add(ttl).Unix(), 10))},
+		},
+	})
+	return errors.Wrap(err, "idempotency: can not record key")
+}
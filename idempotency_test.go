@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// fakeDynamoDB keeps the items put into it by key
+type fakeDynamoDB struct {
+	dynamodbiface.DynamoDBAPI
+	items map[string]map[string]*dynamodb.AttributeValue
+}
+
+func (fd *fakeDynamoDB) GetItem(input *dynamodb.GetItemInput) (*dynamodb.GetItemOutput, error) {
+	return &dynamodb.GetItemOutput{Item: fd.items[aws.StringValue(input.Key["key"].S)]}, nil
+}
+
+func (fd *fakeDynamoDB) PutItem(input *dynamodb.PutItemInput) (*dynamodb.PutItemOutput, error) {
+	fd.items[aws.StringValue(input.Item["key"].S)] = input.Item
+	return &dynamodb.PutItemOutput{}, nil
+}
+
+func Test_IdempotencyStore_ExpiresKeys(t *testing.T) {
+	now := time.Date(2018, time.June, 01, 0, 0, 0, 0, time.UTC)
+	clock := func() time.Time { return now }
+
+	bolt, err := NewBoltIdempotencyStore(filepath.Join(helper{t}.tempDir(), "idempotency.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	bolt.(*boltIdempotencyStore).now = clock
+	dynamo := NewDynamoDBIdempotencyStore(&fakeDynamoDB{items: map[string]map[string]*dynamodb.AttributeValue{}}, "gantry").(dynamoDBIdempotencyStore)
+	dynamo.now = clock
+
+	for name, store := range map[string]IdempotencyStore{"bolt": bolt, "dynamodb": dynamo} {
+		t.Run(name, func(t *testing.T) {
+			now = time.Date(2018, time.June, 01, 0, 0, 0, 0, time.UTC)
+			if err := store.Complete("a", time.Hour); err != nil {
+				t.Fatal(err)
+			}
+			for _, tc := range []struct {
+				key      string
+				after    time.Duration
+				expected bool
+			}{
+				{"a", 0, true},
+				{"b", 0, false},
+				{"a", time.Hour - time.Second, true},
+				{"a", time.Hour, false},
+			} {
+				now = time.Date(2018, time.June, 01, 0, 0, 0, 0, time.UTC).Add(tc.after)
+				completed, err := store.Completed(tc.key)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if completed != tc.expected {
+					t.Errorf("expected %q to be completed after %s: %t", tc.key, tc.after, tc.expected)
+				}
+			}
+		})
+	}
+}
+
+func Test_DefaultIdempotencyKey(t *testing.T) {
+	key := defaultIdempotencyKey(env{"A": "1", "B": "2"}, []byte("payload"))
+	if other := defaultIdempotencyKey(env{"B": "2", "A": "1"}, []byte("payload")); other != key {
+		t.Errorf("expected key to be independent of env order, got %s and %s", key, other)
+	}
+	for _, other := range []string{
+		defaultIdempotencyKey(env{"A": "1", "B": "3"}, []byte("payload")),
+		defaultIdempotencyKey(env{"A": "1B\x002"}, []byte("payload")),
+		defaultIdempotencyKey(env{"A": "1", "B": "2"}, []byte("other payload")),
+	} {
+		if other == key {
+			t.Errorf("expected key to change with env and payload, got %s", key)
+		}
+	}
+}
+
+func Test_Gantry_SkipsDuplicateDeliveries(t *testing.T) {
+	q, _ := newTestQueue(time.Now())
+	body := messageBody{IdempotencyKey: "deploy-1"}
+	publishFixture(t, q, "./fixtures/greet", body)
+	publishFixture(t, q, "./fixtures/greet", body)
+	publishFixture(t, q, "./fixtures/greet", messageBody{IdempotencyKey: "deploy-2"})
+
+	store, err := NewBoltIdempotencyStore(filepath.Join(helper{t}.tempDir(), "idempotency.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	history := newTestHistory(t, 0)
+	metrics := NewMetrics()
+	g := Gantry{
+		ctx:            context.TODO(),
+		src:            q,
+		history:        history,
+		metrics:        metrics,
+		idempotency:    store,
+		idempotencyTTL: time.Hour,
+		logger:         noopLogger{},
+	}
+
+	var statuses []string
+	for i := 0; i < 3; i++ {
+		status, _, err := g.HandleMessage(receive(t, q))
+		if err != nil {
+			t.Fatal(err)
+		}
+		statuses = append(statuses, status)
+	}
+	if statuses[0] != statusCompleted || statuses[1] != statusDuplicate || statuses[2] != statusCompleted {
+		t.Errorf("expected the second delivery to be a duplicate, got %v", statuses)
+	}
+	if q.Len() != 0 {
+		t.Errorf("expected duplicate to be deleted")
+	}
+	if entries, _ := history.List(HistoryFilter{}); len(entries) != 2 {
+		t.Errorf("expected 2 executions, got %d", len(entries))
+	}
+	if n := testutil.ToFloat64(metrics.duplicates); n != 1 {
+		t.Errorf("expected 1 duplicate, got %v", n)
+	}
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/pkg/errors"
+)
+
+// A Locker grants leases on lock keys, so that payloads sharing a lock key
+// don't run at the same time, even on different consumers. Leases expire
+// unless they are renewed, so that the lock of a crashed consumer is freed.
+type Locker interface {
+	// Acquire acquires the lease of key for owner for ttl, it returns
+	// false if another owner holds it
+	Acquire(key, owner string, ttl time.Duration) (bool, error)
+	// Renew extends the lease of owner by ttl, it returns a LockLostError
+	// if owner doesn't hold it anymore
+	Renew(key, owner string, ttl time.Duration) error
+	// Release releases the lease of owner, if it still holds it
+	Release(key, owner string) error
+}
+
+// A LockLostError is returned when renewing a lease which expired or was
+// taken over by another owner
+type LockLostError struct {
+	Key string
+}
+
+func (e LockLostError) Error() string {
+	return fmt.Sprintf("lease of lock %q was lost", e.Key)
+}
+
+// OpenLocker returns the Locker for rawURL, which is
+// redis://[:password@]host[:port][/db] for a Redis server, rediss://
+// connects over TLS
+func OpenLocker(rawURL string) (Locker, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, errors.Wrap(err, "lock: can not parse lock store url")
+	}
+	switch strings.ToLower(u.Scheme) {
+	case "redis", "rediss":
+		pool := &redis.Pool{
+			MaxIdle:     2,
+			IdleTimeout: time.Minute,
+			Dial: func() (redis.Conn, error) {
+				return redis.DialURL(rawURL)
+			},
+		}
+		return NewRedisLocker(pool), nil
+	}
+	return nil, errors.Errorf("lock: unsupported lock store url scheme %q, supported are redis,rediss", u.Scheme)
+}
+
+// redisLockPrefix is prepended to the lock keys in redis
+const redisLockPrefix = "gantry:lock:"
+
+var (
+	// redisRenewScript extends the expiry of KEYS[1] to ARGV[2]
+	// milliseconds, if it is still held by the owner ARGV[1]
+	redisRenewScript = redis.NewScript(1, `
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("PEXPIRE", KEYS[1], ARGV[2])
+end
+return 0`)
+	// redisReleaseScript deletes KEYS[1], if it is still held by the
+	// owner ARGV[1]
+	redisReleaseScript = redis.NewScript(1, `
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0`)
+)
+
+type redisLocker struct {
+	pool *redis.Pool
+}
+
+// NewRedisLocker returns a Locker which keeps the leases as keys in redis,
+// whose value is the owner and which expire with the lease
+func NewRedisLocker(pool *redis.Pool) Locker {
+	return redisLocker{pool: pool}
+}
+
+func (rl redisLocker) Acquire(key, owner string, ttl time.Duration) (bool, error) {
+	conn := rl.pool.Get()
+	defer conn.Close()
+	_, err := redis.String(conn.Do("SET", redisLockPrefix+key, owner, "NX", "PX", int64(ttl/time.Millisecond)))
+	if err == redis.ErrNil {
+		return false, nil
+	}
+	if err != nil {
+		return false, errors.Wrap(err, fmt.Sprintf("lock: can not acquire %q", key))
+	}
+	return true, nil
+}
+
+func (rl redisLocker) Renew(key, owner string, ttl time.Duration) error {
+	conn := rl.pool.Get()
+	defer conn.Close()
+	renewed, err := redis.Int(redisRenewScript.Do(conn, redisLockPrefix+key, owner, int64(ttl/time.Millisecond)))
+	if err != nil {
+		return errors.Wrap(err, fmt.Sprintf("lock: can not renew %q", key))
+	}
+	if renewed == 0 {
+		return LockLostError{Key: key}
+	}
+	return nil
+}
+
+func (rl redisLocker) Release(key, owner string) error {
+	conn := rl.pool.Get()
+	defer conn.Close()
+	_, err := redisReleaseScript.Do(conn, redisLockPrefix+key, owner)
+	return errors.Wrap(err, fmt.Sprintf("lock: can not release %q", key))
+}
+
+// A lease is a held lock, which is renewed in the background until it is
+// released or lost
+type lease struct {
+	locker Locker
+	key    string
+	owner  string
+	ttl    time.Duration
+	logger Logger
+
+	stop chan struct{}
+	done sync.WaitGroup
+	// lost is closed when the lease was lost
+	lost chan struct{}
+}
+
+// acquireLease acquires the lock key and renews it every third of ttl until
+// it is released. It returns nil if another owner holds the lock.
+func acquireLease(locker Locker, key string, ttl time.Duration, logger Logger) (*lease, error) {
+	owner, err := randomID()
+	if err != nil {
+		return nil, err
+	}
+	acquired, err := locker.Acquire(key, owner, ttl)
+	if err != nil || !acquired {
+		return nil, err
+	}
+
+	l := &lease{
+		locker: locker,
+		key:    key,
+		owner:  owner,
+		ttl:    ttl,
+		logger: logger,
+		stop:   make(chan struct{}),
+		lost:   make(chan struct{}),
+	}
+	l.done.Add(1)
+	go l.renew()
+	return l, nil
+}
+
+func (l *lease) renew() {
+	defer l.done.Done()
+	ticker := time.NewTicker(l.ttl / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-l.stop:
+			return
+		case <-ticker.C:
+		}
+		err := l.locker.Renew(l.key, l.owner, l.ttl)
+		if _, lost := errors.Cause(err).(LockLostError); lost {
+			l.logger.WithFields(Fields{"lock": l.key}.logError(err)).Error("lost lock lease, killing the entrypoint")
+			close(l.lost)
+			return
+		}
+		if err != nil {
+			// the lease is still held until it expires, the next
+			// renewal may succeed
+			l.logger.WithFields(Fields{"lock": l.key}.logError(err)).Warn("can not renew lock lease")
+		}
+	}
+}
+
+// Done returns a channel which is closed when the lease was lost, it is
+// never closed for a nil *lease
+func (l *lease) Done() <-chan struct{} {
+	if l == nil {
+		return nil
+	}
+	return l.lost
+}
+
+// release stops renewing the lease and releases the lock
+func (l *lease) release() {
+	close(l.stop)
+	l.done.Wait()
+	if err := l.locker.Release(l.key, l.owner); err != nil {
+		l.logger.WithFields(Fields{"lock": l.key}.logError(err)).Warn("can not release lock, it is freed when its lease expires")
+	}
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/gomodule/redigo/redis"
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func newTestRedisLocker(t *testing.T) (Locker, *miniredis.Miniredis) {
+	t.Helper()
+	server, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := &redis.Pool{
+		Dial: func() (redis.Conn, error) {
+			return redis.Dial("tcp", server.Addr())
+		},
+	}
+	return NewRedisLocker(pool), server
+}
+
+// countingLocker counts the renewals of the leases it grants
+type countingLocker struct {
+	Locker
+	mu       sync.Mutex
+	renewals int
+}
+
+func (cl *countingLocker) Renew(key, owner string, ttl time.Duration) error {
+	cl.mu.Lock()
+	cl.renewals++
+	cl.mu.Unlock()
+	return cl.Locker.Renew(key, owner, ttl)
+}
+
+func Test_RedisLocker_GrantsLeases(t *testing.T) {
+	locker, server := newTestRedisLocker(t)
+	defer server.Close()
+
+	acquire := func(owner string) bool {
+		t.Helper()
+		acquired, err := locker.Acquire("cluster-1", owner, time.Minute)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return acquired
+	}
+
+	if !acquire("a") {
+		t.Fatal("expected free lock to be acquired")
+	}
+	if acquire("b") {
+		t.Error("expected held lock not to be acquired")
+	}
+
+	t.Run("renews leases of the owner only", func(t *testing.T) {
+		if err := locker.Renew("cluster-1", "a", 2*time.Minute); err != nil {
+			t.Fatal(err)
+		}
+		if ttl := server.TTL(redisLockPrefix + "cluster-1"); ttl != 2*time.Minute {
+			t.Errorf("expected lease to be extended to 2m, got %s", ttl)
+		}
+		if _, ok := locker.Renew("cluster-1", "b", time.Minute).(LockLostError); !ok {
+			t.Errorf("expected other owners to have lost the lease")
+		}
+	})
+
+	t.Run("releases leases of the owner only", func(t *testing.T) {
+		if err := locker.Release("cluster-1", "b"); err != nil {
+			t.Fatal(err)
+		}
+		if acquire("b") {
+			t.Fatal("expected lock to be held after release by other owner")
+		}
+		if err := locker.Release("cluster-1", "a"); err != nil {
+			t.Fatal(err)
+		}
+		if !acquire("b") {
+			t.Error("expected released lock to be acquired")
+		}
+	})
+
+	t.Run("frees expired leases", func(t *testing.T) {
+		server.FastForward(time.Minute)
+		if !acquire("c") {
+			t.Error("expected expired lock to be acquired")
+		}
+	})
+}
+
+func Test_Lease_RenewsUntilReleased(t *testing.T) {
+	redisLocker, server := newTestRedisLocker(t)
+	defer server.Close()
+	locker := &countingLocker{Locker: redisLocker}
+
+	l, err := acquireLease(locker, "cluster-1", 30*time.Millisecond, noopLogger{})
+	if err != nil || l == nil {
+		t.Fatalf("expected lease to be acquired, got %v", err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	l.release()
+
+	locker.mu.Lock()
+	renewals := locker.renewals
+	locker.mu.Unlock()
+	if renewals < 2 {
+		t.Errorf("expected lease to be renewed while held, got %d renewals", renewals)
+	}
+	if server.Exists(redisLockPrefix + "cluster-1") {
+		t.Errorf("expected lock to be released")
+	}
+}
+
+func Test_Gantry_KillsPayloadsWhoseLeaseIsLost(t *testing.T) {
+	q, _ := newTestQueue(time.Now())
+	dir := writePayloadDir(t, "entrypoint: bin/run.sh", "exec sleep 10")
+	publishFixture(t, q, dir, messageBody{Lock: "cluster-1"})
+	locker, server := newTestRedisLocker(t)
+	defer server.Close()
+
+	g := Gantry{
+		ctx:     context.TODO(),
+		src:     q,
+		locker:  locker,
+		lockTTL: 30 * time.Millisecond,
+		logger:  noopLogger{},
+	}
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		server.Del(redisLockPrefix + "cluster-1")
+	}()
+	start := time.Now()
+	status, _, err := g.HandleMessage(receive(t, q))
+	if _, lost := errors.Cause(err).(LockLostError); status != statusCompleted || !lost {
+		t.Fatalf("expected execution to fail with the lost lock, got %s %v", status, err)
+	}
+	if took := time.Since(start); took > 5*time.Second {
+		t.Errorf("expected entrypoint to be killed, took %s", took)
+	}
+}
+
+func Test_Gantry_PutsBackMessagesWhoseLockIsHeld(t *testing.T) {
+	q, clock := newTestQueue(time.Now())
+	publishFixture(t, q, "./fixtures/greet", messageBody{Lock: "cluster-1"})
+	locker, server := newTestRedisLocker(t)
+	defer server.Close()
+	metrics := NewMetrics()
+
+	if _, err := locker.Acquire("cluster-1", "other consumer", time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	g := Gantry{
+		ctx:       context.TODO(),
+		src:       q,
+		locker:    locker,
+		lockTTL:   time.Minute,
+		lockDelay: 30 * time.Second,
+		metrics:   metrics,
+		logger:    noopLogger{},
+	}
+	status, _, err := g.HandleMessage(receive(t, q))
+	if status != statusLocked || err != nil {
+		t.Fatalf("expected message to wait for the lock, got %s %v", status, err)
+	}
+	if n := testutil.ToFloat64(metrics.locked); n != 1 {
+		t.Errorf("expected 1 locked message, got %v", n)
+	}
+
+	clock.Advance(29 * time.Second)
+	if msg, _ := q.ReceiveMessageWithContext(context.TODO()); msg != nil {
+		t.Fatal("expected message to be hidden for the lock retry delay")
+	}
+
+	clock.Advance(time.Second)
+	if err := locker.Release("cluster-1", "other consumer"); err != nil {
+		t.Fatal(err)
+	}
+	status, _, err = g.HandleMessage(receive(t, q))
+	if status != statusCompleted || err != nil {
+		t.Fatalf("expected message to run with the lock, got %s %v", status, err)
+	}
+	if server.Exists(redisLockPrefix + "cluster-1") {
+		t.Errorf("expected lock to be released after the execution")
+	}
+}
+
+func Test_Gantry_ReleasesLockedMessagesWithoutLockStore(t *testing.T) {
+	q, _ := newTestQueue(time.Now())
+	publishFixture(t, q, "./fixtures/greet", messageBody{Lock: "cluster-1"})
+
+	g := Gantry{ctx: context.TODO(), src: q, logger: noopLogger{}}
+	status, _, err := g.HandleMessage(receive(t, q))
+	if status != statusReleased || err != nil {
+		t.Fatalf("expected message to be released, got %s %v", status, err)
+	}
+	if q.Len() != 1 {
+		t.Errorf("expected message to be left on the queue")
+	}
+}
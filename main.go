@@ -2,100 +2,672 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"flag"
 	"fmt"
+	"io/ioutil"
+	"net/http"
 	"net/url"
 	"os"
 	"os/signal"
+	"strconv"
 	"strings"
 	"syscall"
+	"time"
 
 	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
 )
 
 var (
 	// common concerns
-	queueURL   string
-	outputType string
-	debug      bool
+	queueURL       string
+	sqsQueueURL    string
+	outputType     string
+	debug          bool
+	redactPatterns stringSlice
+	traceExporter  string
+	otlpEndpoint   string
+	historyDB      string
 
 	// for consume
-	visibilityTimeout int64
+	visibilityTimeout   int64
+	maxMessageAge       time.Duration
+	deadLetterExpired   bool
+	workers             int
+	sqsBatchSize        int
+	redisMaxDeliveries  int
+	metricsAddr         string
+	healthAddr          string
+	healthMaxPollAge    time.Duration
+	readyMaxFailedPolls int
+	drainTimeout        time.Duration
+	historyMaxEntries   int
+	artifactStore       string
+	consumerLabels      labelSet
+	idemStore           string
+	idemTTL             time.Duration
+	lockStore           string
+	lockTTL             time.Duration
+	lockDelay           time.Duration
 
 	// for publish
-	sourceDir string
-	environ   env
+	sourceDirs    stringSlice
+	environ       env
+	secretEnviron env
+	envFiles      stringSlice
+	expandEnv     bool
+	ttl           time.Duration
+	notAfter      string
+	delay         time.Duration
+	notBefore     string
+	groupID       string
+	dedupID       string
+	artifacts     stringSlice
+	selector      string
+	idemKey       string
+	lockKey       string
+	correlationID string
+	noIdemKey     bool
+
+	// for serve
+	listenAddr      string
+	serveTokenFile  string
+	tlsCert         string
+	tlsKey          string
+	tlsClientCA     string
+	maxRequestBytes int64
+
+	// for history
+	historyMessageID string
+	historyStatus    string
+	historySince     time.Duration
+	historyLimit     int
 )
 
 func init() {
-	flag.StringVar(&queueURL, "sqs-queue-url", "", "The full SQS queue URL to use to receive messages")
+	flag.StringVar(&queueURL, "queue-url", "", "The URL of the queue to use, the scheme selects the transport: https://sqs.<region>.amazonaws.com/<account>/<name> or sqs://<name> for SQS, arn:aws:sns:<region>:<account>:<name> to publish to a SNS topic, file:///path/to/dir for a local directory, redis://<host>?stream=<name> for a Redis stream, amqp://<host>?queue=<name> for RabbitMQ, mem://<name> for an in-process queue")
+	flag.StringVar(&sqsQueueURL, "sqs-queue-url", "", "Deprecated: use -queue-url")
 	flag.StringVar(&outputType, "o", "", "set -o json to print output as JSON")
-	flag.StringVar(&sourceDir, "dir", "", "The directory to pack into the tarball and publish to sqs")
+	flag.Var(&sourceDirs, "dir", "The directory to pack into the tarball and publish, may be given multiple times or as a glob to publish a payload per directory")
 	flag.BoolVar(&debug, "debug", false, "Enable debug output")
+	flag.StringVar(&traceExporter, "trace-exporter", "", "Export OpenTelemetry traces with otlp or stdout, tracing is disabled if omitted")
+	flag.StringVar(&otlpEndpoint, "otlp-endpoint", "", "The URL of the OTLP/HTTP endpoint to export traces to, e.g. http://collector:4318 (default from OTEL_EXPORTER_OTLP_ENDPOINT)")
+	flag.StringVar(&historyDB, "history-db", "", "The bbolt file consume and serve record executions in, and history reads them from, executions are not recorded if omitted")
+	flag.IntVar(&historyMaxEntries, "history-max-entries", 10000, "The number of executions kept in -history-db, older ones are removed, 0 keeps all")
+	flag.Var(&artifacts, "artifact", "A glob of files in the payload directory which the consumer collects into its artifact store after the entrypoint ran, may be given multiple times")
+	flag.StringVar(&artifactStore, "artifact-store", "", "The store consume and serve put artifacts into: file:///path/to/dir for a local directory or s3://<bucket>/<prefix> for a S3 bucket")
+	flag.StringVar(&selector, "selector", "", "Only consumers whose -label match this selector run the payload, e.g. 'region=eu-west-1,tool in (helm,kubectl),!canary', others release it")
+	flag.StringVar(&idemKey, "idempotency-key", "", "The key consumers with an -idempotency-store skip the payload for, if an execution with it completed before (default digest of payload and hash of env)")
+	flag.BoolVar(&noIdemKey, "no-idempotency-key", false, "Publish without idempotency key, so that the payload runs even if the same payload and env completed before")
+	flag.StringVar(&idemStore, "idempotency-store", "", "The store consume and serve record the idempotency keys of completed executions in: file:///path/to/file for a local bbolt file or dynamodb://<table> for a DynamoDB table, keys are not checked if omitted")
+	flag.DurationVar(&idemTTL, "idempotency-ttl", 24*time.Hour, "The time for which completed idempotency keys are recorded")
+	flag.StringVar(&lockKey, "lock", "", "The key of a lock held while the payload runs, so that payloads with the same lock, e.g. deploys to the same cluster, don't run concurrently on any consumer")
+	flag.StringVar(&lockStore, "lock-store", "", "The store consume and serve acquire the locks of payloads in: redis://<host> for a Redis server, messages with a lock are released to other consumers if omitted")
+	flag.DurationVar(&lockTTL, "lock-ttl", time.Minute, "The lease of locks, it is renewed while the payload runs and frees the lock of crashed consumers")
+	flag.DurationVar(&lockDelay, "lock-retry-delay", 30*time.Second, "The time after which a message whose lock was held is received again")
+	flag.StringVar(&correlationID, "correlation-id", "", "The ID shared by the messages of a workflow, follow-ups of the payload carry it (default message ID of the payload)")
+	flag.Var(&consumerLabels, "label", "A key=value label of the consumer, messages whose -selector or manifest labels don't match are released to other consumers, may be given multiple times")
+	flag.StringVar(&historyMessageID, "history-message-id", "", "Only list the executions of this message id")
+	flag.StringVar(&historyStatus, "history-status", "", fmt.Sprintf("Only list executions which %s or %s", executionSucceeded, executionFailed))
+	flag.DurationVar(&historySince, "history-since", 0, "Only list executions started within this duration")
+	flag.IntVar(&historyLimit, "history-limit", 20, "The number of executions history lists, the latest first, 0 lists all")
 	flag.Int64Var(&visibilityTimeout, "sqs-visibility-timeout-sec", 300, "The number of seconds messages received by this working should be invisible to other workers (before deletion)")
+	flag.IntVar(&workers, "workers", 1, "The number of messages consume handles at the same time")
+	flag.IntVar(&redisMaxDeliveries, "redis-max-deliveries", 10, "The number of deliveries after which messages of Redis streams are moved to the stream <stream>:dead, like the redrive policy of SQS queues. 0 redelivers them for good")
+	flag.IntVar(&sqsBatchSize, "sqs-batch-size", 1, fmt.Sprintf("The number of messages received from SQS at once, at most %d. Received messages wait for a free worker, so it shouldn't exceed -workers", sqsMaxBatchSize))
+	flag.StringVar(&metricsAddr, "metrics-addr", "", "The address on which consume exposes prometheus metrics at /metrics, e.g. :9090, metrics are disabled if omitted")
+	flag.StringVar(&healthAddr, "health-addr", "", "The address on which consume serves the /healthz and /readyz probes, may equal -metrics-addr, probes are disabled if omitted")
+	flag.DurationVar(&healthMaxPollAge, "health-max-poll-age", 5*time.Minute, "/healthz fails if no poll succeeded for this long while no payload is running")
+	flag.IntVar(&readyMaxFailedPolls, "ready-max-failed-polls", 3, "/readyz fails after this many consecutive failed polls, 0 disables the check")
+	flag.DurationVar(&drainTimeout, "drain-timeout", 5*time.Minute, "On SIGINT or SIGTERM consume stops receiving and waits this long for running payloads before cancelling them")
+	flag.DurationVar(&maxMessageAge, "max-message-age", 0, "Messages sent longer ago than this are not executed, 0 disables the check")
+	flag.BoolVar(&deadLetterExpired, "dead-letter-expired", false, "Leave expired messages on the queue for its dead-letter policy, instead of deleting them")
+	flag.DurationVar(&ttl, "ttl", 0, "The duration after publishing after which the payload must not be executed anymore")
+	flag.StringVar(&notAfter, "not-after", "", "The RFC3339 time after which the payload must not be executed anymore")
+	flag.DurationVar(&delay, "delay", 0, "The duration after publishing before which the payload must not be executed. SQS delays delivery by up to 15m, beyond that consumers defer the message, and every deferral counts towards the maxReceiveCount of the redrive policy. On FIFO queues the deferral holds back the rest of the message group")
+	flag.StringVar(&notBefore, "not-before", "", "The RFC3339 time before which the payload must not be executed, see -delay for the limits of long delays")
+	flag.StringVar(&groupID, "group-id", "", fmt.Sprintf("The message group of the payload on FIFO queues, payloads of one group are executed in order (default %q)", defaultGroupID))
+	flag.StringVar(&dedupID, "dedup-id", "", "The deduplication id of the payload on FIFO queues (default hash of env and payload)")
 	flag.Var(&environ, "e", "The environment variables which will be injected to the executable payload")
+	flag.Var(&envFiles, "env-file", "A dotenv file with environment variables which will be injected to the executable payload, may be given multiple times. Later files override earlier ones, -e and -secret override all files")
+	flag.BoolVar(&expandEnv, "expand-env", false, "Expand ${VAR} references in -env-file values from the environment of the publisher, undefined references are an error")
+	flag.Var(&secretEnviron, "secret", "Like -e, but the value is marked as sensitive and will be redacted from the consumer logs and history")
+	flag.Var(&redactPatterns, "redact", fmt.Sprintf("Pattern of env keys whose values are redacted from the logs and history, may be given multiple times (default %s)", strings.Join(defaultRedactPatterns, ",")))
+	flag.StringVar(&listenAddr, "listen-addr", ":8080", "The address serve listens on")
+	flag.StringVar(&serveTokenFile, "serve-token-file", "", "A file with the bearer token clients of serve must send, if omitted clients must authenticate with a certificate signed by -tls-client-ca")
+	flag.StringVar(&tlsCert, "tls-cert", "", "The certificate file for serve to listen with TLS")
+	flag.StringVar(&tlsKey, "tls-key", "", "The key file of -tls-cert")
+	flag.StringVar(&tlsClientCA, "tls-client-ca", "", "A file with the CA certificates which sign the client certificates accepted by serve")
+	flag.Int64Var(&maxRequestBytes, "max-request-bytes", 10<<20, "The maximum size of payloads pushed to serve, including the message body")
 	flag.Parse()
 }
 
+// transportOptions returns the options for opening queues
+func transportOptions(logger Logger) TransportOptions {
+	return TransportOptions{
+		Logger:            logger,
+		VisibilityTimeout: visibilityTimeout,
+		Workers:           workers,
+		BatchSize:         sqsBatchSize,
+		MaxDeliveries:     redisMaxDeliveries,
+	}
+}
+
 func publish(logger Logger) {
-	p := Payloader{}
-	payload, err := p.DirToTarGz(sourceDir)
+	if len(sourceDirs) == 0 {
+		logger.Fatal("please specify the payload directory via -dir")
+	}
+	dirs, err := expandDirs(sourceDirs)
 	if err != nil {
-		logger.WithFields(ErrorFields(err)).Fatal("can not pack directory info tar archive")
+		logger.WithFields(ErrorFields(err)).Fatal("can not expand -dir")
+	}
+	if dedupID != "" && len(dirs) > 1 {
+		logger.Fatal("-dedup-id can only be given for a single payload, the others would be dropped as duplicates")
+	}
+	if idemKey != "" && len(dirs) > 1 {
+		logger.Fatal("-idempotency-key can only be given for a single payload, the others would be skipped as duplicates")
+	}
+	if idemKey != "" && noIdemKey {
+		logger.Fatal("only one of -idempotency-key or -no-idempotency-key may be given")
+	}
+	payloads, errs := packDirs(dirs)
+	for i, err := range errs {
+		if err != nil {
+			logger.WithFields(Fields{"dir": dirs[i]}.logError(err)).Fatal("can not pack directory info tar archive")
+		}
 	}
 
-	err = NewAWSSQS(queueURL, logger, visibilityTimeout).PublishPayload(environ, payload)
+	var lookup func(string) (string, bool)
+	if expandEnv {
+		lookup = os.LookupEnv
+	}
+	fileEnv, err := loadEnvFiles(envFiles, lookup)
 	if err != nil {
-		logger.WithFields(ErrorFields(err)).Fatal("can not publish payload")
+		logger.WithFields(ErrorFields(err)).Fatal("can not load env files")
+	}
+
+	// precedence: env files in order, then -e, then -secret
+	body := messageBody{Env: fileEnv}
+	for k, v := range environ {
+		body.Env[k] = v
+	}
+	for k, v := range secretEnviron {
+		body.Env[k] = v
+	}
+	body.Sensitive = secretEnviron.Keys()
+	body.GroupID = groupID
+	body.DeduplicationID = dedupID
+	if err := validateArtifactPatterns(artifacts); err != nil {
+		logger.WithFields(ErrorFields(err)).Fatal("malformed -artifact")
+	}
+	body.Artifacts = artifacts
+	if _, err := ParseSelector(selector); err != nil {
+		logger.WithFields(ErrorFields(err)).Fatal("malformed -selector")
+	}
+	body.Selector = selector
+	if selector != "" {
+		// consumers which don't know about selectors would run the
+		// payload anywhere
+		body.Required = append(body.Required, "selector")
+	}
+	body.Lock = lockKey
+	body.CorrelationID = correlationID
+	if lockKey != "" {
+		// consumers which don't know about locks would run the payload
+		// concurrently
+		body.Required = append(body.Required, "lock")
+	}
+
+	switch {
+	case ttl != 0 && notAfter != "":
+		logger.Fatal("only one of -ttl or -not-after may be given")
+	case ttl != 0:
+		t := time.Now().Add(ttl).UTC()
+		body.NotAfter = &t
+	case notAfter != "":
+		t, err := time.Parse(time.RFC3339, notAfter)
+		if err != nil {
+			logger.WithFields(ErrorFields(err)).Fatal("malformed -not-after")
+		}
+		body.NotAfter = &t
+	}
+	if body.NotAfter != nil {
+		// consumers which don't know about expiry must not run the payload
+		body.Required = append(body.Required, "not_after")
+	}
+
+	switch {
+	case delay != 0 && notBefore != "":
+		logger.Fatal("only one of -delay or -not-before may be given")
+	case delay != 0:
+		t := time.Now().Add(delay).UTC()
+		body.NotBefore = &t
+	case notBefore != "":
+		t, err := time.Parse(time.RFC3339, notBefore)
+		if err != nil {
+			logger.WithFields(ErrorFields(err)).Fatal("malformed -not-before")
+		}
+		body.NotBefore = &t
+	}
+	if body.NotBefore != nil {
+		// consumers which don't know about delays would run the payload early
+		body.Required = append(body.Required, "not_before")
+	}
+
+	// payloads are checked against their manifest before any is published
+	bodies := make([]messageBody, len(dirs))
+	for i, dir := range dirs {
+		if bodies[i], err = payloadBody(dir, body); err != nil {
+			logger.WithFields(Fields{"dir": dir}.logError(err)).Fatal("invalid payload")
+		}
+		switch {
+		case noIdemKey:
+		case idemKey != "":
+			bodies[i].IdempotencyKey = idemKey
+		default:
+			bodies[i].IdempotencyKey = defaultIdempotencyKey(body.Env, payloads[i])
+		}
+	}
+
+	sink, err := OpenSink(queueURL, transportOptions(logger))
+	if err != nil {
+		logger.WithFields(ErrorFields(err)).Fatal("can not open queue")
+	}
+
+	// every payload starts a trace of its own, which is continued by the
+	// consumer
+	ctx, span := tracer.Start(context.Background(), "publish", trace.WithSpanKind(trace.SpanKindProducer))
+	entries := make([]PublishEntry, len(payloads))
+	spans := make([]trace.Span, len(payloads))
+	for i, payload := range payloads {
+		var entryCtx context.Context
+		entryCtx, spans[i] = tracer.Start(ctx, "publish "+dirs[i],
+			trace.WithSpanKind(trace.SpanKindProducer),
+			trace.WithAttributes(attribute.String("gantry.dir", dirs[i]), attribute.Int("messaging.message.body.size", len(payload))),
+		)
+		entries[i] = PublishEntry{Body: injectTrace(entryCtx, bodies[i]), Payload: payload}
+	}
+	results := publishPayloads(sink, entries)
+
+	published := make([]publishedDir, len(dirs))
+	failed := 0
+	for i, result := range results {
+		spans[i].SetAttributes(semconv.MessagingMessageID(result.MessageID))
+		endSpan(spans[i], result.Err)
+		published[i] = publishedDir{Dir: dirs[i], MessageID: result.MessageID, Size: len(payloads[i])}
+		if result.Err != nil {
+			failed++
+			published[i].Error = result.Err.Error()
+			logger.WithFields(Fields{"dir": dirs[i]}.logError(result.Err)).Error("can not publish payload")
+		}
+	}
+	span.End()
+	if err := printPublishedDirs(os.Stdout, published, strings.ToLower(outputType) == "json"); err != nil {
+		logger.WithFields(ErrorFields(err)).Error("can not print published payloads")
+	}
+	if failed > 0 {
+		logger.Fatalf("%d of %d payloads could not be published", failed, len(dirs))
 	}
 }
 
 func consume(logger Logger) {
+	if workers < 1 {
+		logger.Fatal("-workers must be at least 1")
+	}
+	if sqsBatchSize < 1 || sqsBatchSize > sqsMaxBatchSize {
+		logger.Fatalf("-sqs-batch-size must be between 1 and %d", sqsMaxBatchSize)
+	}
+	if sqsBatchSize > workers {
+		logger.Warnf("-sqs-batch-size %d exceeds -workers %d, received messages wait for a worker while their visibility timeout runs", sqsBatchSize, workers)
+	}
+	if redisMaxDeliveries < 0 {
+		logger.Fatal("-redis-max-deliveries must not be negative")
+	}
+
+	src, err := OpenSource(queueURL, transportOptions(logger))
+	if err != nil {
+		logger.WithFields(ErrorFields(err)).Fatal("can not open queue")
+	}
+
+	// metrics and health checks share a listener if their addresses are
+	// the same
+	muxes := map[string]*http.ServeMux{}
+	muxFor := func(addr string) *http.ServeMux {
+		if _, ok := muxes[addr]; !ok {
+			muxes[addr] = http.NewServeMux()
+		}
+		return muxes[addr]
+	}
+
+	var metrics *Metrics
+	if metricsAddr != "" {
+		metrics = NewMetrics()
+		src = metrics.InstrumentSource(src)
+		muxFor(metricsAddr).Handle("/metrics", metrics.Handler())
+	}
+
+	var health *Health
+	if healthAddr != "" {
+		health = NewHealth(healthMaxPollAge, readyMaxFailedPolls)
+		src = health.InstrumentSource(src)
+		muxFor(healthAddr).Handle("/healthz", health.Handler())
+		muxFor(healthAddr).Handle("/readyz", health.Handler())
+	}
+
+	for addr, mux := range muxes {
+		go func(addr string, mux *http.ServeMux) {
+			logger.Infof("listening on %s", addr)
+			if err := http.ListenAndServe(addr, mux); err != nil {
+				logger.WithFields(ErrorFields(err)).Fatalf("can not listen on %s", addr)
+			}
+		}(addr, mux)
+	}
 
 	var ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
 
 	var g = Gantry{
-		logger: logger,
-		src:    NewAWSSQS(queueURL, logger, visibilityTimeout),
-		ctx:    ctx,
+		logger:            logger,
+		src:               src,
+		ctx:               ctx,
+		maxMessageAge:     maxMessageAge,
+		deadLetterExpired: deadLetterExpired,
+		workers:           workers,
+		metrics:           metrics,
+		health:            health,
+		history:           openHistory(),
+		artifacts:         openArtifactStore(logger),
+		labels:            consumerLabels,
+		redactPatterns:    redactPatterns,
+		idempotency:       openIdempotencyStore(logger),
+		idempotencyTTL:    idemTTL,
+		locker:            openLocker(logger),
+		lockTTL:           lockTTL,
+		lockDelay:         lockDelay,
+		openSink:          followUpSink(logger),
+		stop:              make(chan struct{}),
 	}
-	go g.Run()
+	var done = make(chan struct{})
+	go func() {
+		g.Run()
+		close(done)
+	}()
 
 	var sigs = make(chan os.Signal, 1)
 	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
 	var sig = <-sigs
+
+	// drain: let the running payloads finish, unless they take longer
+	// than -drain-timeout or another signal arrives
+	logger.Infof("draining on %s", sig)
+	health.SetDraining()
+	g.Stop()
+	select {
+	case <-done:
+	case sig = <-sigs:
+		logger.Warnf("cancelling running payloads on %s", sig)
+	case <-time.After(drainTimeout):
+		logger.Warnf("cancelling running payloads after -drain-timeout %s", drainTimeout)
+	}
 	cancel()
+	<-done
+	g.Close()
 	logger.Infof("exiting %s", sig)
 
 }
 
-func main() {
+func serve(logger Logger) {
+	var ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
 
-	logrus.SetLevel(logrus.DebugLevel)
+	var g = Gantry{
+		logger:            logger,
+		ctx:               ctx,
+		maxMessageAge:     maxMessageAge,
+		deadLetterExpired: deadLetterExpired,
+		history:           openHistory(),
+		artifacts:         openArtifactStore(logger),
+		labels:            consumerLabels,
+		redactPatterns:    redactPatterns,
+		idempotency:       openIdempotencyStore(logger),
+		idempotencyTTL:    idemTTL,
+		locker:            openLocker(logger),
+		lockTTL:           lockTTL,
+		lockDelay:         lockDelay,
+		openSink:          followUpSink(logger),
+	}
 
-	if strings.ToLower(outputType) == "json" {
-		logrus.SetFormatter(&logrus.JSONFormatter{})
+	var token string
+	if serveTokenFile != "" {
+		b, err := ioutil.ReadFile(serveTokenFile)
+		if err != nil {
+			logger.WithFields(ErrorFields(err)).Fatal("can not read -serve-token-file")
+		}
+		token = strings.TrimSpace(string(b))
+		if token == "" {
+			logger.Fatal("-serve-token-file is empty")
+		}
 	}
 
-	logger := NewLogrusLogger(
-		logrus.StandardLogger().WithField("component", "gantry"),
-	)
+	server := &http.Server{
+		Addr:    listenAddr,
+		Handler: NewPushServer(&g, token, maxRequestBytes, logger),
+	}
+	if tlsClientCA != "" {
+		pem, err := ioutil.ReadFile(tlsClientCA)
+		if err != nil {
+			logger.WithFields(ErrorFields(err)).Fatal("can not read -tls-client-ca")
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			logger.Fatal("-tls-client-ca contains no certificates")
+		}
+		server.TLSConfig = &tls.Config{
+			ClientCAs:  pool,
+			ClientAuth: tls.VerifyClientCertIfGiven,
+		}
+	}
+	if token == "" && server.TLSConfig == nil {
+		logger.Fatal("serve requires -serve-token-file or -tls-client-ca to authenticate clients")
+	}
+	if server.TLSConfig != nil && (tlsCert == "" || tlsKey == "") {
+		logger.Fatal("-tls-client-ca requires -tls-cert and -tls-key")
+	}
+
+	var shutdown = make(chan struct{})
+	go func() {
+		var sigs = make(chan os.Signal, 1)
+		signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
+		var sig = <-sigs
+		logger.Infof("exiting %s", sig)
+		server.Shutdown(context.Background())
+		close(shutdown)
+	}()
+
+	logger.Infof("listening on %s", listenAddr)
+	var err error
+	if tlsCert != "" {
+		err = server.ListenAndServeTLS(tlsCert, tlsKey)
+	} else {
+		err = server.ListenAndServe()
+	}
+	if err != http.ErrServerClosed {
+		logger.WithFields(ErrorFields(err)).Fatal("can not serve")
+	}
+	// Shutdown waits for the requests which are still executing
+	<-shutdown
+	g.Close()
+}
+
+// openHistory returns the History of -history-db, nil if it is omitted
+func openHistory() *History {
+	if historyDB == "" {
+		return nil
+	}
+	return NewHistory(historyDB, historyMaxEntries)
+}
+
+// openArtifactStore returns the ArtifactStore of -artifact-store, nil if it
+// is omitted
+func openArtifactStore(logger Logger) ArtifactStore {
+	if artifactStore == "" {
+		return nil
+	}
+	store, err := OpenArtifactStore(artifactStore)
+	if err != nil {
+		logger.WithFields(ErrorFields(err)).Fatal("can not open artifact store")
+	}
+	return store
+}
+
+// openIdempotencyStore returns the IdempotencyStore of -idempotency-store,
+// nil if it is omitted
+func openIdempotencyStore(logger Logger) IdempotencyStore {
+	if idemStore == "" {
+		return nil
+	}
+	store, err := OpenIdempotencyStore(idemStore)
+	if err != nil {
+		logger.WithFields(ErrorFields(err)).Fatal("can not open idempotency store")
+	}
+	return store
+}
+
+// openLocker returns the Locker of -lock-store, nil if it is omitted
+func openLocker(logger Logger) Locker {
+	if lockStore == "" {
+		return nil
+	}
+	if lockTTL <= 0 {
+		logger.Fatal("-lock-ttl must be positive")
+	}
+	locker, err := OpenLocker(lockStore)
+	if err != nil {
+		logger.WithFields(ErrorFields(err)).Fatal("can not open lock store")
+	}
+	return locker
+}
+
+// followUpSink returns the func opening the queues of follow-ups
+func followUpSink(logger Logger) func(string) (MessageSink, error) {
+	return func(queueURL string) (MessageSink, error) {
+		return OpenSink(queueURL, transportOptions(logger))
+	}
+}
 
+// history lists the recorded executions, or shows the one whose id is given
+// as argument
+func history(logger Logger) {
+	if historyDB == "" {
+		logger.Fatal("please specify the execution history via -history-db")
+	}
+	h := openHistory()
+	asJSON := strings.ToLower(outputType) == "json"
+
+	if flag.NArg() > 1 {
+		id, err := strconv.ParseUint(flag.Arg(1), 10, 64)
+		if err != nil {
+			logger.Fatalf("malformed execution id %q", flag.Arg(1))
+		}
+		e, err := h.Get(id)
+		if err != nil {
+			logger.WithFields(ErrorFields(err)).Fatal("can not read execution")
+		}
+		if err := printHistoryEntry(os.Stdout, e, asJSON); err != nil {
+			logger.WithFields(ErrorFields(err)).Fatal("can not print execution")
+		}
+		return
+	}
+
+	if historyStatus != "" && historyStatus != executionSucceeded && historyStatus != executionFailed {
+		logger.Fatalf("-history-status must be %s or %s", executionSucceeded, executionFailed)
+	}
+	f := HistoryFilter{
+		MessageID: historyMessageID,
+		Status:    historyStatus,
+		Limit:     historyLimit,
+	}
+	if historySince != 0 {
+		f.Since = time.Now().Add(-historySince)
+	}
+	entries, err := h.List(f)
+	if err != nil {
+		logger.WithFields(ErrorFields(err)).Fatal("can not read execution history")
+	}
+	if err := printHistory(os.Stdout, entries, asJSON); err != nil {
+		logger.WithFields(ErrorFields(err)).Fatal("can not print execution history")
+	}
+}
+
+// requireQueueURL exits unless a valid queue url was given
+func requireQueueURL(logger Logger) {
+	if len(sqsQueueURL) != 0 {
+		logger.Warn("-sqs-queue-url is deprecated, use -queue-url instead")
+		if len(queueURL) == 0 {
+			queueURL = sqsQueueURL
+		}
+	}
 	if len(queueURL) == 0 {
 		flag.PrintDefaults()
-		logger.Fatal("please specify queue url via -sqs-queue-url")
+		logger.Fatal("please specify queue url via -queue-url")
 	}
 	if _, err := url.Parse(queueURL); err != nil {
 		logger.WithFields(ErrorFields(err)).Fatalf("can't parse url, try again please")
 	}
+}
+
+func main() {
+
+	logrus.SetLevel(logrus.DebugLevel)
+
+	if strings.ToLower(outputType) == "json" {
+		logrus.SetFormatter(&logrus.JSONFormatter{})
+	}
+
+	if len(redactPatterns) == 0 {
+		redactPatterns = defaultRedactPatterns
+	}
+	logger, err := NewRedactingLogger(
+		NewLogrusLogger(logrus.StandardLogger().WithField("component", "gantry")),
+		redactPatterns,
+	)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "malformed -redact pattern: %s\n", err)
+		os.Exit(2)
+	}
+
+	if traceExporter != "" {
+		shutdownTracing, err := initTracing(traceExporter, otlpEndpoint)
+		if err != nil {
+			logger.WithFields(ErrorFields(err)).Fatal("can not set up tracing")
+		}
+		flushTracing := func() {
+			if err := shutdownTracing(context.Background()); err != nil {
+				logger.WithFields(ErrorFields(err)).Warn("can not flush traces")
+			}
+		}
+		// spans are flushed on fatal errors as well
+		logrus.RegisterExitHandler(flushTracing)
+		defer flushTracing()
+	}
 
 	switch flag.Arg(0) {
 	case "publish":
+		requireQueueURL(logger)
 		publish(logger.WithFields(Fields{"action": "publish"}))
 	case "consume":
+		requireQueueURL(logger)
 		consume(logger.WithFields(Fields{"action": "consume"}))
+	case "serve":
+		serve(logger.WithFields(Fields{"action": "serve"}))
+	case "history":
+		history(logger.WithFields(Fields{"action": "history"}))
 	default:
-		fmt.Fprintf(os.Stderr, "command must be set to one of either %q or %q\n", "publish", "consume")
+		fmt.Fprintf(os.Stderr, "command must be set to one of %q, %q, %q or %q\n", "publish", "consume", "serve", "history")
 		os.Exit(2)
 	}
 
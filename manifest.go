@@ -0,0 +1,295 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// manifestFile is the name of the optional manifest at the payload root
+const manifestFile = "gantry.yaml"
+
+// defaultEntrypoint is run for payloads without a manifest, or whose
+// manifest doesn't declare one
+const defaultEntrypoint = "entrypoint.sh"
+
+// A Manifest declares how a payload is executed, and what it requires of
+// the message and the consumer. It is read from gantry.yaml at the payload
+// root, payloads without one run entrypoint.sh.
+type Manifest struct {
+	// Entrypoint is the executable to run, relative to the payload root
+	Entrypoint string `yaml:"entrypoint"`
+	// Args are passed to the entrypoint
+	Args []string `yaml:"args"`
+	// Timeout kills the entrypoint if it runs longer, 0 disables it
+	Timeout time.Duration `yaml:"timeout"`
+	// RequiredEnv are the env keys which must be set in the message
+	RequiredEnv []string `yaml:"required_env"`
+	// RequiredLabels are the labels the consumer must have, see -label
+	RequiredLabels map[string]string `yaml:"required_labels"`
+	// Retry is the policy for failed executions
+	Retry RetryPolicy `yaml:"retry"`
+	// Artifacts are globs of files collected after the entrypoint ran,
+	// in addition to those of the message
+	Artifacts []string `yaml:"artifacts"`
+	// OnSuccess are published after the entrypoint succeeded
+	OnSuccess []FollowUp `yaml:"on_success"`
+	// OnFailure are published after the last attempt of the entrypoint
+	// failed
+	OnFailure []FollowUp `yaml:"on_failure"`
+}
+
+// A RetryPolicy retries failed executions, by making the message visible
+// again after a backoff instead of deleting it. The backoff doubles with
+// every attempt. The zero value doesn't retry.
+type RetryPolicy struct {
+	// MaxAttempts is the number of executions including the first one
+	MaxAttempts int           `yaml:"max_attempts"`
+	Backoff     time.Duration `yaml:"backoff"`
+}
+
+// A MissingEnvError is returned for messages which lack env keys required
+// by the manifest of their payload
+type MissingEnvError struct {
+	Keys []string
+}
+
+func (e MissingEnvError) Error() string {
+	return fmt.Sprintf("payload requires env %s, which is not set (see %s)", strings.Join(e.Keys, ", "), manifestFile)
+}
+
+// An UnsatisfiedLabelsError is returned by consumers which lack the labels
+// required by the manifest of a payload
+type UnsatisfiedLabelsError struct {
+	Labels map[string]string
+}
+
+func (e UnsatisfiedLabelsError) Error() string {
+	return fmt.Sprintf("payload requires consumer labels %s (see %s)", labelSet(e.Labels), manifestFile)
+}
+
+// loadManifest reads the manifest of the payload in dir, payloads without
+// one get the default manifest
+func loadManifest(dir string) (Manifest, error) {
+	var m Manifest
+	b, err := ioutil.ReadFile(filepath.Join(dir, manifestFile))
+	if os.IsNotExist(err) {
+		m.Entrypoint = defaultEntrypoint
+		return m, nil
+	}
+	if err != nil {
+		return m, errors.Wrap(err, fmt.Sprintf("can not read %s", manifestFile))
+	}
+	// unknown keys are most likely typos, which would silently change
+	// the execution
+	if err := yaml.UnmarshalStrict(b, &m); err != nil {
+		return m, errors.Wrap(err, fmt.Sprintf("malformed %s", manifestFile))
+	}
+	if m.Entrypoint == "" {
+		m.Entrypoint = defaultEntrypoint
+	}
+	return m, nil
+}
+
+// payloadBody returns body for the payload in dir. Payloads with a manifest
+// are validated against it and marked, so that consumers which don't read
+// manifests leave them for the dead-letter queue. The labels it requires are
+// added to the selector, so that consumers can release the message without
+// extracting the payload.
+func payloadBody(dir string, body messageBody) (messageBody, error) {
+	if _, err := os.Stat(filepath.Join(dir, manifestFile)); os.IsNotExist(err) {
+		return body, nil
+	}
+	m, err := loadManifest(dir)
+	if err != nil {
+		return body, err
+	}
+	if err := m.Validate(dir); err != nil {
+		return body, err
+	}
+	if err := m.CheckEnv(body.Env); err != nil {
+		return body, err
+	}
+	body.Manifest = true
+	body.Required = append(append([]string{}, body.Required...), "manifest")
+	if len(m.RequiredLabels) > 0 {
+		if body.Selector == "" {
+			body.Required = append(body.Required, "selector")
+		} else {
+			body.Selector += ","
+		}
+		body.Selector += labelsSelector(m.RequiredLabels)
+	}
+	return body, nil
+}
+
+// Validate returns an error if m is inconsistent, or doesn't fit the
+// payload in dir
+func (m Manifest) Validate(dir string) error {
+	if !isWithinRoot(m.Entrypoint) {
+		return errors.Errorf("%s: entrypoint %q must be relative to the payload root", manifestFile, m.Entrypoint)
+	}
+	fi, err := os.Stat(filepath.Join(dir, m.Entrypoint))
+	if err != nil {
+		return errors.Errorf("payload does not contain entrypoint %s", m.Entrypoint)
+	}
+	if fi.Mode()&0111 == 0 { // check for executable bit for owner
+		return errors.Errorf("expected payload to contain executable %s check the filemode", m.Entrypoint)
+	}
+
+	switch {
+	case m.Timeout < 0:
+		return errors.Errorf("%s: timeout must not be negative", manifestFile)
+	case m.Retry.MaxAttempts < 0:
+		return errors.Errorf("%s: retry max_attempts must not be negative", manifestFile)
+	case m.Retry.Backoff < 0:
+		return errors.Errorf("%s: retry backoff must not be negative", manifestFile)
+	}
+	for _, key := range m.RequiredEnv {
+		if key == "" {
+			return errors.Errorf("%s: required_env must not contain empty keys", manifestFile)
+		}
+	}
+	// required labels are added to the selector of messages, so they must
+	// fit into it
+	labelKeys := make([]string, 0, len(m.RequiredLabels))
+	for k := range m.RequiredLabels {
+		labelKeys = append(labelKeys, k)
+	}
+	sort.Strings(labelKeys)
+	for _, k := range labelKeys {
+		if !selectorKey.MatchString(k) {
+			return errors.Errorf("%s: invalid required_labels key %q", manifestFile, k)
+		}
+		if v := m.RequiredLabels[k]; !selectorValue.MatchString(v) {
+			return errors.Errorf("%s: invalid required_labels value %q of %s", manifestFile, v, k)
+		}
+	}
+	if err := validateArtifactPatterns(m.Artifacts); err != nil {
+		return errors.Wrap(err, manifestFile)
+	}
+	for i, f := range m.OnSuccess {
+		if err := f.validate(dir); err != nil {
+			return errors.Wrap(err, fmt.Sprintf("%s: %s[%d]", manifestFile, followUpOnSuccess, i))
+		}
+	}
+	for i, f := range m.OnFailure {
+		if err := f.validate(dir); err != nil {
+			return errors.Wrap(err, fmt.Sprintf("%s: %s[%d]", manifestFile, followUpOnFailure, i))
+		}
+	}
+	return nil
+}
+
+// isWithinRoot reports whether path is relative and doesn't leave the
+// directory it is relative to
+func isWithinRoot(path string) bool {
+	path = filepath.Clean(path)
+	return !filepath.IsAbs(path) && path != ".." && !strings.HasPrefix(path, ".."+string(filepath.Separator))
+}
+
+// CheckEnv returns a MissingEnvError unless e has all the required env keys
+func (m Manifest) CheckEnv(e env) error {
+	var missing []string
+	for _, key := range m.RequiredEnv {
+		if _, ok := e[key]; !ok {
+			missing = append(missing, key)
+		}
+	}
+	if len(missing) > 0 {
+		sort.Strings(missing)
+		return MissingEnvError{Keys: missing}
+	}
+	return nil
+}
+
+// CheckLabels returns an UnsatisfiedLabelsError unless labels has all the
+// required labels
+func (m Manifest) CheckLabels(labels labelSet) error {
+	unsatisfied := map[string]string{}
+	for k, v := range m.RequiredLabels {
+		if actual, ok := labels[k]; !ok || actual != v {
+			unsatisfied[k] = v
+		}
+	}
+	if len(unsatisfied) > 0 {
+		return UnsatisfiedLabelsError{Labels: unsatisfied}
+	}
+	return nil
+}
+
+// retryAfter returns the backoff before the next attempt of a message
+// whose entrypoint ran attempt times, and whether it is retried at all
+func (rp RetryPolicy) retryAfter(attempt int) (time.Duration, bool) {
+	if attempt >= rp.MaxAttempts {
+		return 0, false
+	}
+	backoff := rp.Backoff
+	for i := 1; i < attempt && backoff < maxRetryBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > maxRetryBackoff {
+		backoff = maxRetryBackoff
+	}
+	return backoff, true
+}
+
+// maxRetryBackoff is the longest backoff of retries, it is the maximum
+// visibility timeout of SQS
+const maxRetryBackoff = 12 * time.Hour
+
+// attemptMemory is the time a consumer remembers the attempts of a message
+// after the last one, it outlasts the longest backoff
+const attemptMemory = 2 * maxRetryBackoff
+
+// attemptTracker counts the attempts of messages whose entrypoint ran on a
+// consumer. The receive count of a message can't be used, as it includes
+// the receives which were deferred, released or waited for a lock. Attempts
+// on other consumers, or before the consumer restarted, are not counted, a
+// redrive policy bounds the attempts of messages which move between
+// consumers. The zero value is ready to use.
+type attemptTracker struct {
+	mu       sync.Mutex
+	attempts map[string]attempt
+}
+
+type attempt struct {
+	count int
+	at    time.Time
+}
+
+// attempt records that the entrypoint of the message with id ran at now,
+// it returns the number of the attempt
+func (at *attemptTracker) attempt(id string, now time.Time) int {
+	at.mu.Lock()
+	defer at.mu.Unlock()
+	if at.attempts == nil {
+		at.attempts = map[string]attempt{}
+	}
+	for attemptedID, a := range at.attempts {
+		if now.Sub(a.at) > attemptMemory {
+			delete(at.attempts, attemptedID)
+		}
+	}
+
+	a := at.attempts[id]
+	a.count++
+	a.at = now
+	at.attempts[id] = a
+	return a.count
+}
+
+// forget drops the attempts of the message with id, once it isn't retried
+func (at *attemptTracker) forget(id string) {
+	at.mu.Lock()
+	defer at.mu.Unlock()
+	delete(at.attempts, id)
+}
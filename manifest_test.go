@@ -0,0 +1,265 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// writePayloadDir writes a payload dir with the manifest, if not empty, and
+// the entrypoint script at bin/run.sh
+func writePayloadDir(t *testing.T, manifest, script string) string {
+	t.Helper()
+	dir := helper{t}.tempDir()
+	if err := os.Mkdir(filepath.Join(dir, "bin"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "bin", "run.sh"), []byte("#!/bin/sh\n"+script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if manifest != "" {
+		if err := ioutil.WriteFile(filepath.Join(dir, manifestFile), []byte(manifest), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func Test_LoadManifest(t *testing.T) {
+	t.Run("defaults to entrypoint.sh", func(t *testing.T) {
+		m, err := loadManifest("./fixtures/greet")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(m, Manifest{Entrypoint: "entrypoint.sh"}) {
+			t.Errorf("expected default manifest, got %+v", m)
+		}
+	})
+
+	t.Run("reads all fields", func(t *testing.T) {
+		dir := writePayloadDir(t, strings.Join([]string{
+			"entrypoint: bin/run.sh",
+			"args: [--dry-run]",
+			"timeout: 10m",
+			"required_env: [KUBECONFIG]",
+			"required_labels: {region: eu-west-1}",
+			"retry: {max_attempts: 3, backoff: 30s}",
+			"artifacts: [rendered]",
+		}, "\n"), "")
+		m, err := loadManifest(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := Manifest{
+			Entrypoint:     "bin/run.sh",
+			Args:           []string{"--dry-run"},
+			Timeout:        10 * time.Minute,
+			RequiredEnv:    []string{"KUBECONFIG"},
+			RequiredLabels: map[string]string{"region": "eu-west-1"},
+			Retry:          RetryPolicy{MaxAttempts: 3, Backoff: 30 * time.Second},
+			Artifacts:      []string{"rendered"},
+		}
+		if !reflect.DeepEqual(m, expected) {
+			t.Errorf("expected %+v, got %+v", expected, m)
+		}
+	})
+
+	t.Run("rejects unknown keys", func(t *testing.T) {
+		dir := writePayloadDir(t, "entrypoint: bin/run.sh\ntimout: 10m\n", "")
+		if _, err := loadManifest(dir); err == nil {
+			t.Errorf("expected unknown key to be rejected")
+		}
+	})
+}
+
+func Test_PayloadBody_ValidatesManifestOnPublish(t *testing.T) {
+	for _, tc := range []struct {
+		name, manifest, err string
+	}{
+		{"missing entrypoint", "entrypoint: bin/missing.sh", "payload does not contain entrypoint bin/missing.sh"},
+		{"entrypoint outside payload", "entrypoint: ../run.sh", `gantry.yaml: entrypoint "../run.sh" must be relative to the payload root`},
+		{"negative timeout", "entrypoint: bin/run.sh\ntimeout: -1s", "gantry.yaml: timeout must not be negative"},
+		{"malformed artifacts", "entrypoint: bin/run.sh\nartifacts: ['[']", `gantry.yaml: malformed artifact pattern "[": syntax error in pattern`},
+		{"invalid required label key", "entrypoint: bin/run.sh\nrequired_labels: {'region,gpu': x}", `gantry.yaml: invalid required_labels key "region,gpu"`},
+		{"invalid required label value", "entrypoint: bin/run.sh\nrequired_labels: {region: 'eu,!canary'}", `gantry.yaml: invalid required_labels value "eu,!canary" of region`},
+		{"missing env", "entrypoint: bin/run.sh\nrequired_env: [B, A, SET]", "payload requires env A, B, which is not set (see gantry.yaml)"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			dir := writePayloadDir(t, tc.manifest, "")
+			_, err := payloadBody(dir, messageBody{Env: env{"SET": ""}})
+			if err == nil || err.Error() != tc.err {
+				t.Errorf("expected error %q, got %v", tc.err, err)
+			}
+		})
+	}
+
+	t.Run("marks payloads with a manifest", func(t *testing.T) {
+		dir := writePayloadDir(t, "entrypoint: bin/run.sh", "")
+		body, err := payloadBody(dir, messageBody{Required: []string{"not_after"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !body.Manifest || !reflect.DeepEqual(body.Required, []string{"not_after", "manifest"}) {
+			t.Errorf("expected body to require the manifest, got %+v", body)
+		}
+	})
+}
+
+func Test_Gantry_RunsEntrypointOfManifest(t *testing.T) {
+	q, _ := newTestQueue(time.Now())
+	dir := writePayloadDir(t, "entrypoint: bin/run.sh\nargs: [one, two words]\nrequired_env: [GREETING]", `echo "$GREETING $1|$2"`)
+	publishFixture(t, q, dir, messageBody{Env: env{"GREETING": "hello"}})
+	history := newTestHistory(t, 0)
+
+	g := Gantry{
+		ctx:     context.TODO(),
+		src:     q,
+		history: history,
+		logger:  noopLogger{},
+	}
+	if err := g.HandleMessageIfExists(); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := history.List(HistoryFilter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if entries[0].Stdout != "hello one|two words\n" {
+		t.Errorf("expected entrypoint to run with args, got output %q", entries[0].Stdout)
+	}
+}
+
+func Test_Gantry_EnforcesManifest(t *testing.T) {
+	t.Run("fails on missing env", func(t *testing.T) {
+		q, _ := newTestQueue(time.Now())
+		dir := writePayloadDir(t, "entrypoint: bin/run.sh\nrequired_env: [KUBECONFIG]", "")
+		publishFixture(t, q, dir, messageBody{})
+
+		g := Gantry{ctx: context.TODO(), src: q, logger: noopLogger{}}
+		err := g.HandleMessageIfExists()
+		if _, ok := errors.Cause(err).(MissingEnvError); !ok {
+			t.Fatalf("expected missing env error, got %v", err)
+		}
+		if q.Len() != 0 {
+			t.Errorf("expected message to be deleted")
+		}
+	})
+
+	t.Run("leaves payloads for consumers with the required labels", func(t *testing.T) {
+		q, clock := newTestQueue(time.Now())
+		dir := writePayloadDir(t, "entrypoint: bin/run.sh\nrequired_labels: {region: eu-west-1}", "")
+		publishFixture(t, q, dir, messageBody{})
+
+		g := Gantry{ctx: context.TODO(), src: q, labels: labelSet{"region": "us-east-1"}, logger: noopLogger{}}
+		err := g.HandleMessageIfExists()
+		if _, ok := errors.Cause(err).(UnsatisfiedLabelsError); !ok {
+			t.Fatalf("expected unsatisfied labels error, got %v", err)
+		}
+		if q.Len() != 1 {
+			t.Errorf("expected message to be left on the queue")
+		}
+
+		clock.Advance(time.Hour)
+		g.labels = labelSet{"region": "eu-west-1", "gpu": "true"}
+		if err := g.HandleMessageIfExists(); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("kills the entrypoint after the timeout", func(t *testing.T) {
+		q, _ := newTestQueue(time.Now())
+		dir := writePayloadDir(t, "entrypoint: bin/run.sh\ntimeout: 100ms", "exec sleep 10")
+		publishFixture(t, q, dir, messageBody{})
+
+		g := Gantry{ctx: context.TODO(), src: q, logger: noopLogger{}}
+		start := time.Now()
+		err := g.HandleMessageIfExists()
+		if err == nil || !strings.HasPrefix(err.Error(), "entrypoint timed out after 100ms") {
+			t.Errorf("expected time out, got %v", err)
+		}
+		if took := time.Since(start); took > 5*time.Second {
+			t.Errorf("expected entrypoint to be killed, took %s", took)
+		}
+	})
+}
+
+func Test_Gantry_RetriesFailedExecutions(t *testing.T) {
+	now := time.Date(2018, time.June, 01, 0, 0, 0, 0, time.UTC)
+	q, clock := newTestQueue(now)
+	dir := writePayloadDir(t, "entrypoint: bin/run.sh\nretry: {max_attempts: 3, backoff: 1m}", "exit 1")
+	publishFixture(t, q, dir, messageBody{})
+
+	g := Gantry{ctx: context.TODO(), src: q, logger: noopLogger{}}
+	for attempt, backoff := range []time.Duration{time.Minute, 2 * time.Minute} {
+		if err := g.HandleMessageIfExists(); err == nil {
+			t.Fatalf("expected attempt %d to fail", attempt+1)
+		}
+		clock.Advance(backoff - time.Second)
+		if msg, _ := q.ReceiveMessageWithContext(context.TODO()); msg != nil {
+			t.Fatalf("expected attempt %d to be retried after %s, got message", attempt+1, backoff)
+		}
+		clock.Advance(time.Second)
+	}
+
+	if err := g.HandleMessageIfExists(); err == nil {
+		t.Fatal("expected last attempt to fail")
+	}
+	if q.Len() != 0 {
+		t.Errorf("expected message to be deleted after the last attempt")
+	}
+}
+
+func Test_AttemptTracker_CountsAttemptsOfMessages(t *testing.T) {
+	var at attemptTracker
+	now := time.Date(2018, time.June, 01, 0, 0, 0, 0, time.UTC)
+
+	for i := 1; i <= 3; i++ {
+		if n := at.attempt("a", now); n != i {
+			t.Errorf("expected attempt %d, got %d", i, n)
+		}
+	}
+	if n := at.attempt("b", now); n != 1 {
+		t.Errorf("expected attempts of other messages to be counted on their own, got %d", n)
+	}
+	at.forget("b")
+	if n := at.attempt("b", now); n != 1 {
+		t.Errorf("expected attempts to be forgotten, got %d", n)
+	}
+	if n := at.attempt("a", now.Add(attemptMemory+time.Second)); n != 1 {
+		t.Errorf("expected attempts to be forgotten after %s, got %d", attemptMemory, n)
+	}
+}
+
+func Test_Gantry_CountsAttemptsWhichRan(t *testing.T) {
+	q, clock := newTestQueue(time.Now())
+	dir := writePayloadDir(t, "entrypoint: bin/run.sh\nretry: {max_attempts: 2, backoff: 1m}", "exit 1")
+	publishFixture(t, q, dir, messageBody{Selector: "region=eu-west-1"})
+
+	other := Gantry{ctx: context.TODO(), src: q, labels: labelSet{"region": "us-east-1"}, logger: noopLogger{}}
+	if status, _, _ := other.HandleMessage(receive(t, q)); status != statusReleased {
+		t.Fatalf("expected message to be released, got %s", status)
+	}
+
+	g := Gantry{ctx: context.TODO(), src: q, labels: labelSet{"region": "eu-west-1"}, logger: noopLogger{}}
+	if err := g.HandleMessageIfExists(); err == nil {
+		t.Fatal("expected first attempt to fail")
+	}
+	if q.Len() != 1 {
+		t.Fatal("expected message to be retried, as the release is no attempt")
+	}
+
+	clock.Advance(time.Minute)
+	if err := g.HandleMessageIfExists(); err == nil {
+		t.Fatal("expected last attempt to fail")
+	}
+	if q.Len() != 0 {
+		t.Errorf("expected message to be deleted after the last attempt")
+	}
+}
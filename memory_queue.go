@@ -0,0 +1,207 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var _ MessageQueue = &MemoryQueue{}
+
+// memoryQueues are the queues opened with mem://name URLs, so that publishers
+// and consumers within the same process share them
+var (
+	memoryQueuesMu sync.Mutex
+	memoryQueues   = map[string]*MemoryQueue{}
+)
+
+func init() {
+	RegisterTransport("mem", newQueueTransport(func(u *url.URL, opts TransportOptions) (MessageQueue, error) {
+		memoryQueuesMu.Lock()
+		defer memoryQueuesMu.Unlock()
+		q, ok := memoryQueues[u.Host]
+		if !ok {
+			q = NewMemoryQueue(time.Duration(opts.VisibilityTimeout) * time.Second)
+			memoryQueues[u.Host] = q
+		}
+		return q, nil
+	}))
+}
+
+// NewMemoryQueue returns an empty MemoryQueue which hides received messages
+// for visibilityTimeout.
+func NewMemoryQueue(visibilityTimeout time.Duration) *MemoryQueue {
+	return &MemoryQueue{
+		VisibilityTimeout: visibilityTimeout,
+		Now:               time.Now,
+	}
+}
+
+// A MemoryQueue is a MessageQueue which keeps its messages in memory. It
+// behaves like a SQS queue: received messages are invisible for the
+// visibility timeout and redelivered unless they are deleted, delayed
+// messages are invisible until they are due, and receive counts are tracked.
+// Visible messages are received in the order they were published, and message
+// ids are assigned sequentially, which makes it suitable for deterministic
+// tests. It is safe for concurrent use.
+type MemoryQueue struct {
+	// VisibilityTimeout is the time received messages are invisible for
+	VisibilityTimeout time.Duration
+	// Now returns the current time, it can be replaced to control time in
+	// tests
+	Now func() time.Time
+
+	mu       sync.Mutex
+	lastID   int
+	messages []*memoryQueueEntry
+}
+
+type memoryQueueEntry struct {
+	id           string
+	sentAt       time.Time
+	body         []byte
+	payload      []byte
+	visibleAt    time.Time
+	receiveCount int
+	// receipt identifies the latest receive, messages of earlier receives
+	// lost their lease and can not be deleted anymore
+	receipt int
+}
+
+// PublishPayload appends a message to the queue, messages with a NotBefore
+// time in the body are invisible until then.
+func (mq *MemoryQueue) PublishPayload(body messageBody, b []byte) error {
+	bodyBytes, err := encodeMessageBody(body)
+	if err != nil {
+		return err
+	}
+	var visibleAt time.Time
+	if body.NotBefore != nil {
+		visibleAt = *body.NotBefore
+	}
+	mq.publish(bodyBytes, b, visibleAt)
+	return nil
+}
+
+// publish appends a message with a raw body, which needn't be valid
+func (mq *MemoryQueue) publish(body, payload []byte, visibleAt time.Time) string {
+	mq.mu.Lock()
+	defer mq.mu.Unlock()
+
+	mq.lastID++
+	entry := &memoryQueueEntry{
+		id:        fmt.Sprintf("mem-%d", mq.lastID),
+		sentAt:    mq.Now(),
+		body:      body,
+		payload:   payload,
+		visibleAt: visibleAt,
+	}
+	mq.messages = append(mq.messages, entry)
+	return entry.id
+}
+
+// ReceiveMessageWithContext claims the first visible message for the
+// visibility timeout
+func (mq *MemoryQueue) ReceiveMessageWithContext(ctx context.Context) (Message, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	mq.mu.Lock()
+	defer mq.mu.Unlock()
+
+	now := mq.Now()
+	for _, entry := range mq.messages {
+		if entry.visibleAt.After(now) {
+			continue
+		}
+		entry.visibleAt = now.Add(mq.VisibilityTimeout)
+		entry.receiveCount++
+		entry.receipt++
+
+		msg := &memoryQueueMessage{
+			queue:        mq,
+			id:           entry.id,
+			sentAt:       entry.sentAt,
+			payload:      entry.payload,
+			receiveCount: entry.receiveCount,
+			receipt:      entry.receipt,
+		}
+		body, err := decodeMessageBody(entry.body)
+		msg.body = body
+		if err != nil {
+			return msg, errors.Wrap(err, fmt.Sprintf("can not decode body of message %s", entry.id))
+		}
+		return msg, nil
+	}
+	return nil, nil
+}
+
+// Len returns the number of messages in the queue, including those in flight
+// and delayed ones.
+func (mq *MemoryQueue) Len() int {
+	mq.mu.Lock()
+	defer mq.mu.Unlock()
+	return len(mq.messages)
+}
+
+// leased returns the index of the entry of msg, if msg still holds the lease
+// of its entry. It must be called with mq.mu held.
+func (mq *MemoryQueue) leased(msg *memoryQueueMessage) (int, error) {
+	for i, entry := range mq.messages {
+		if entry.id != msg.id {
+			continue
+		}
+		if entry.receipt != msg.receipt {
+			return 0, errors.Errorf("memory-queue-message: message with id %s was received again since", msg.id)
+		}
+		return i, nil
+	}
+	return 0, errors.Errorf("memory-queue-message: message with id %s was deleted", msg.id)
+}
+
+type memoryQueueMessage struct {
+	queue        *MemoryQueue
+	id           string
+	sentAt       time.Time
+	body         messageBody
+	payload      []byte
+	receiveCount int
+	receipt      int
+}
+
+func (mqm *memoryQueueMessage) ID() string        { return mqm.id }
+func (mqm *memoryQueueMessage) SentAt() time.Time { return mqm.sentAt }
+func (mqm *memoryQueueMessage) Body() messageBody { return mqm.body }
+func (mqm *memoryQueueMessage) Payload() []byte   { return mqm.payload }
+func (mqm *memoryQueueMessage) ReceiveCount() int { return mqm.receiveCount }
+
+func (mqm *memoryQueueMessage) Delete() error {
+	mq := mqm.queue
+	mq.mu.Lock()
+	defer mq.mu.Unlock()
+
+	i, err := mq.leased(mqm)
+	if err != nil {
+		return err
+	}
+	mq.messages = append(mq.messages[:i], mq.messages[i+1:]...)
+	return nil
+}
+
+func (mqm *memoryQueueMessage) ChangeVisibility(timeout time.Duration) error {
+	mq := mqm.queue
+	mq.mu.Lock()
+	defer mq.mu.Unlock()
+
+	i, err := mq.leased(mqm)
+	if err != nil {
+		return err
+	}
+	mq.messages[i].visibleAt = mq.Now().Add(timeout)
+	return nil
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+func Test_MemoryQueue_RedeliversMessagesAfterVisibilityTimeout(t *testing.T) {
+	q, clock := newTestQueue(time.Date(2018, time.June, 01, 0, 0, 0, 0, time.UTC))
+
+	if err := q.PublishPayload(messageBody{Env: env{"FOO": "bar"}}, []byte("payload")); err != nil {
+		t.Fatal(err)
+	}
+
+	first := receive(t, q)
+	if first == nil {
+		t.Fatalf("expected to receive a message")
+	}
+	if first.ID() != "mem-1" || first.ReceiveCount() != 1 || string(first.Payload()) != "payload" {
+		t.Errorf("unexpected message %s (receive count %d) with payload %q", first.ID(), first.ReceiveCount(), first.Payload())
+	}
+
+	if msg := receive(t, q); msg != nil {
+		t.Fatalf("expected no message while the first is in flight, got %s", msg.ID())
+	}
+
+	clock.Advance(time.Minute)
+
+	second := receive(t, q)
+	if second == nil || second.ID() != first.ID() {
+		t.Fatalf("expected message %s to be redelivered, got %v", first.ID(), second)
+	}
+	if second.ReceiveCount() != 2 {
+		t.Errorf("expected receive count to equal 2, got %d", second.ReceiveCount())
+	}
+
+	if err := first.Delete(); err == nil {
+		t.Errorf("expected delete with a lost lease to fail")
+	}
+	if err := first.ChangeVisibility(0); err == nil {
+		t.Errorf("expected change of visibility with a lost lease to fail")
+	}
+
+	if err := second.Delete(); err != nil {
+		t.Fatal(err)
+	}
+	if q.Len() != 0 {
+		t.Errorf("expected queue to be empty, got %d messages", q.Len())
+	}
+	if err := second.Delete(); err == nil {
+		t.Errorf("expected delete of a deleted message to fail")
+	}
+}
+
+func Test_MemoryQueue_ReceivesVisibleMessagesInOrder(t *testing.T) {
+	q, clock := newTestQueue(time.Date(2018, time.June, 01, 0, 0, 0, 0, time.UTC))
+
+	notBefore := clock.Now().Add(time.Hour)
+	bodies := []messageBody{
+		{Env: env{"N": "1"}},
+		{Env: env{"N": "2"}, NotBefore: &notBefore},
+		{Env: env{"N": "3"}},
+	}
+	for _, body := range bodies {
+		if err := q.PublishPayload(body, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	expectOrder := func(t *testing.T, expected ...string) {
+		t.Helper()
+		for _, n := range expected {
+			msg := receive(t, q)
+			if msg == nil {
+				t.Fatalf("expected message %s, got none", n)
+			}
+			if msg.Body().Env["N"] != n {
+				t.Fatalf("expected message %s, got %s", n, msg.Body().Env["N"])
+			}
+			if err := msg.Delete(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if msg := receive(t, q); msg != nil {
+			t.Fatalf("expected no more visible messages, got %s", msg.Body().Env["N"])
+		}
+	}
+
+	expectOrder(t, "1", "3")
+	clock.Advance(time.Hour)
+	expectOrder(t, "2")
+}
+
+func Test_MemoryQueue_ChangesVisibility(t *testing.T) {
+	q, clock := newTestQueue(time.Date(2018, time.June, 01, 0, 0, 0, 0, time.UTC))
+
+	if err := q.PublishPayload(messageBody{}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	msg := receive(t, q)
+	if err := msg.ChangeVisibility(time.Hour); err != nil {
+		t.Fatal(err)
+	}
+
+	clock.Advance(59 * time.Minute)
+	if msg := receive(t, q); msg != nil {
+		t.Fatalf("expected message to be invisible for an hour")
+	}
+
+	clock.Advance(time.Minute)
+	msg = receive(t, q)
+	if msg == nil {
+		t.Fatalf("expected message to be visible after an hour")
+	}
+
+	if err := msg.ChangeVisibility(0); err != nil {
+		t.Fatal(err)
+	}
+	if msg := receive(t, q); msg == nil {
+		t.Fatalf("expected message to be visible right away")
+	}
+}
+
+func Test_MemoryQueue_DeliversMessagesOnceToConcurrentConsumers(t *testing.T) {
+	q := NewMemoryQueue(time.Hour)
+
+	const n = 100
+	for i := 0; i < n; i++ {
+		if err := q.PublishPayload(messageBody{}, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var (
+		mu       sync.Mutex
+		received = map[string]int{}
+		wg       sync.WaitGroup
+	)
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				msg, err := q.ReceiveMessageWithContext(context.TODO())
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if msg == nil {
+					return
+				}
+				mu.Lock()
+				received[msg.ID()]++
+				mu.Unlock()
+				if err := msg.Delete(); err != nil {
+					t.Error(err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if len(received) != n {
+		t.Errorf("expected %d messages to be received, got %d", n, len(received))
+	}
+	for id, count := range received {
+		if count != 1 {
+			t.Errorf("expected message %s to be received once, got %d", id, count)
+		}
+	}
+	if q.Len() != 0 {
+		t.Errorf("expected queue to be empty, got %d messages", q.Len())
+	}
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// defaultGroupID is the message group of messages published without one to
+// transports which require it
+const defaultGroupID = "default"
+
+// messageVersion is the version of the messageBody schema published by this
+// gantry. Bodies without a version predate versioning, they are read as
+// version 1.
+const messageVersion = 1
+
+type messageBody struct {
+	// Version of the schema, consumers reject versions they do not support
+	Version int `json:"version"`
+
+	Env env `json:"env"`
+
+	// Sensitive lists the keys of Env whose values must not be logged
+	Sensitive []string `json:"sensitive,omitempty"`
+
+	// NotAfter is the time after which the message must not be executed
+	// anymore
+	NotAfter *time.Time `json:"not_after,omitempty"`
+
+	// NotBefore is the time before which the message must not be executed,
+	// consumers defer it until then
+	NotBefore *time.Time `json:"not_before,omitempty"`
+
+	// GroupID is the message group of FIFO transports, messages of the
+	// same group are delivered in order
+	GroupID string `json:"group_id,omitempty"`
+
+	// DeduplicationID identifies the message to FIFO transports, which drop
+	// duplicates with the same ID. Defaults to a hash of body and payload.
+	DeduplicationID string `json:"deduplication_id,omitempty"`
+
+	// Trace is the W3C trace context of the publisher, with the
+	// traceparent and tracestate keys
+	Trace map[string]string `json:"trace,omitempty"`
+
+	// Artifacts are globs of files in the payload directory which the
+	// consumer collects into the artifact store after the entrypoint ran
+	Artifacts []string `json:"artifacts,omitempty"`
+
+	// IdempotencyKey identifies the execution, consumers with an
+	// idempotency store skip messages whose key completed before
+	IdempotencyKey string `json:"idempotency_key,omitempty"`
+
+	// Lock is the key of a lock held while the payload runs, payloads
+	// with the same lock don't run at the same time
+	Lock string `json:"lock,omitempty"`
+
+	// CorrelationID is shared by the messages of a workflow, follow-ups
+	// carry the one of their parent, or its message ID
+	CorrelationID string `json:"correlation_id,omitempty"`
+
+	// Selector selects the consumers which run the message by their
+	// labels, see ParseSelector. Other consumers release it.
+	Selector string `json:"selector,omitempty"`
+
+	// Manifest is set if the payload has a manifest, consumers which don't
+	// read manifests must not run it
+	Manifest bool `json:"manifest,omitempty"`
+
+	// Required lists fields of the body a consumer must understand to
+	// handle the message. Unknown fields which are not required are ignored,
+	// so that newer publishers can add optional fields without breaking
+	// older consumers.
+	Required []string `json:"required,omitempty"`
+}
+
+// A deadLetterer is an error which marks a message as impossible to handle,
+// it must not be executed. Gantry leaves these messages on the queue without
+// deleting them, so that the redrive policy of the queue moves them to its
+// dead-letter queue.
+type deadLetterer interface {
+	DeadLetter() bool
+}
+
+func isDeadLetter(err error) bool {
+	dl, ok := errors.Cause(err).(deadLetterer)
+	return ok && dl.DeadLetter()
+}
+
+// An UnsupportedVersionError is returned when decoding a message body of a
+// version this consumer does not support
+type UnsupportedVersionError struct {
+	Version int
+}
+
+func (e UnsupportedVersionError) Error() string {
+	return fmt.Sprintf("unsupported message version %d, supported version is %d", e.Version, messageVersion)
+}
+
+// DeadLetter marks e as a dead-letter error
+func (e UnsupportedVersionError) DeadLetter() bool { return true }
+
+// A MalformedBodyError is returned when decoding a message body which is not
+// valid for its version
+type MalformedBodyError struct {
+	Reason string
+}
+
+func (e MalformedBodyError) Error() string {
+	return fmt.Sprintf("malformed message body: %s", e.Reason)
+}
+
+// DeadLetter marks e as a dead-letter error
+func (e MalformedBodyError) DeadLetter() bool { return true }
+
+// messageBodyFields returns the json names of all fields of messageBody
+func messageBodyFields() map[string]bool {
+	fields := map[string]bool{}
+	t := reflect.TypeOf(messageBody{})
+	for i := 0; i < t.NumField(); i++ {
+		name := strings.Split(t.Field(i).Tag.Get("json"), ",")[0]
+		if name != "" && name != "-" {
+			fields[name] = true
+		}
+	}
+	return fields
+}
+
+func (mb messageBody) validate() error {
+	for k, v := range mb.Env {
+		if !isEnvKey(k) {
+			return MalformedBodyError{fmt.Sprintf("invalid env key %q", k)}
+		}
+		if strings.IndexByte(v, 0) >= 0 {
+			return MalformedBodyError{fmt.Sprintf("env value of %q contains NUL", k)}
+		}
+	}
+	for _, k := range mb.Sensitive {
+		if _, ok := mb.Env[k]; !ok {
+			return MalformedBodyError{fmt.Sprintf("sensitive key %q not in env", k)}
+		}
+	}
+	if _, err := ParseSelector(mb.Selector); err != nil {
+		return MalformedBodyError{err.Error()}
+	}
+	return nil
+}
+
+// encodeMessageBody validates body and encodes it at the current version
+func encodeMessageBody(body messageBody) ([]byte, error) {
+	body.Version = messageVersion
+	if err := body.validate(); err != nil {
+		return nil, err
+	}
+	b, err := json.Marshal(body)
+	if err != nil {
+		return nil, errors.Wrap(err, "error while marshaling message body")
+	}
+	return b, nil
+}
+
+// decodeMessageBody decodes and validates b. Errors for bodies which can
+// never be handled by this consumer are dead-letter errors, see
+// isDeadLetter.
+func decodeMessageBody(b []byte) (messageBody, error) {
+	var body messageBody
+
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(b, &raw); err != nil {
+		return body, MalformedBodyError{err.Error()}
+	}
+
+	if v, ok := raw["version"]; ok {
+		if err := json.Unmarshal(v, &body.Version); err != nil {
+			return body, MalformedBodyError{fmt.Sprintf("version: %s", err)}
+		}
+	} else {
+		body.Version = 1
+	}
+	if body.Version != messageVersion {
+		return body, UnsupportedVersionError{body.Version}
+	}
+
+	known := messageBodyFields()
+	if err := json.Unmarshal(b, &body); err != nil {
+		return body, MalformedBodyError{err.Error()}
+	}
+
+	var unknown []string
+	for _, field := range body.Required {
+		if !known[field] {
+			unknown = append(unknown, field)
+		}
+	}
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		return body, MalformedBodyError{fmt.Sprintf("unknown required fields %s", strings.Join(unknown, ","))}
+	}
+
+	return body, body.validate()
+}
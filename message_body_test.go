@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func Test_DecodeMessageBody(t *testing.T) {
+	tests := []struct {
+		name       string
+		input      string
+		body       messageBody
+		err        string
+		deadLetter bool
+	}{
+		{
+			name:  "current version",
+			input: `{"version":1,"env":{"FOO":"bar"},"sensitive":["FOO"]}`,
+			body:  messageBody{Version: 1, Env: env{"FOO": "bar"}, Sensitive: []string{"FOO"}},
+			err:   "<nil>",
+		},
+		{
+			name:  "unversioned bodies are version 1",
+			input: `{"env":{"FOO":"bar"}}`,
+			body:  messageBody{Version: 1, Env: env{"FOO": "bar"}},
+			err:   "<nil>",
+		},
+		{
+			name:  "unknown optional fields are ignored",
+			input: `{"version":1,"env":{},"shiny_new_field":42}`,
+			body:  messageBody{Version: 1, Env: env{}},
+			err:   "<nil>",
+		},
+		{
+			name:       "unsupported version",
+			input:      `{"version":2,"env":{"FOO":"bar"}}`,
+			body:       messageBody{Version: 2},
+			err:        "unsupported message version 2, supported version is 1",
+			deadLetter: true,
+		},
+		{
+			name:       "unknown required fields",
+			input:      `{"version":1,"env":{},"shiny_new_field":42,"required":["env","shiny_new_field"]}`,
+			body:       messageBody{Version: 1, Env: env{}, Required: []string{"env", "shiny_new_field"}},
+			err:        "malformed message body: unknown required fields shiny_new_field",
+			deadLetter: true,
+		},
+		{
+			name:       "invalid json",
+			input:      `{"env":`,
+			err:        "malformed message body: unexpected end of JSON input",
+			deadLetter: true,
+		},
+		{
+			name:       "mistyped fields",
+			input:      `{"version":1,"env":["FOO=bar"]}`,
+			body:       messageBody{Version: 1},
+			err:        "malformed message body: json: cannot unmarshal array into Go struct field messageBody.env of type main.env",
+			deadLetter: true,
+		},
+		{
+			name:       "invalid env keys",
+			input:      `{"version":1,"env":{"FOO BAR":"baz"}}`,
+			body:       messageBody{Version: 1, Env: env{"FOO BAR": "baz"}},
+			err:        "malformed message body: invalid env key \"FOO BAR\"",
+			deadLetter: true,
+		},
+	}
+
+	for _, testCase := range tests {
+		t.Run(testCase.name, func(t *testing.T) {
+			body, err := decodeMessageBody([]byte(testCase.input))
+
+			errStr := fmt.Sprintf("%v", err)
+			if errStr != testCase.err {
+				t.Fatalf("expected error to equal %q, got %v", testCase.err, err)
+			}
+			if isDeadLetter(err) != testCase.deadLetter {
+				t.Errorf("expected error to be a dead-letter error (%t), got %t", testCase.deadLetter, isDeadLetter(err))
+			}
+
+			if !reflect.DeepEqual(testCase.body, body) {
+				t.Fatalf("expected body to equal '%+#v', got '%+#v'", testCase.body, body)
+			}
+		})
+	}
+}
+
+func Test_EncodeMessageBody(t *testing.T) {
+	t.Run("sets the current version", func(t *testing.T) {
+		b, err := encodeMessageBody(messageBody{Env: env{"FOO": "bar"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		expected := `{"version":1,"env":{"FOO":"bar"}}`
+		if string(b) != expected {
+			t.Fatalf("expected body to equal %q, got %q", expected, b)
+		}
+	})
+
+	t.Run("rejects invalid env keys", func(t *testing.T) {
+		_, err := encodeMessageBody(messageBody{Env: env{"1FOO": "bar"}})
+
+		expected := "malformed message body: invalid env key \"1FOO\""
+		if fmt.Sprintf("%v", err) != expected {
+			t.Fatalf("expected error to equal %q, got %v", expected, err)
+		}
+	})
+}
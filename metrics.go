@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Metrics are the prometheus metrics of a consumer. A nil *Metrics records
+// nothing, so that gantry can be run without them.
+type Metrics struct {
+	registry *prometheus.Registry
+
+	received           prometheus.Counter
+	executed           prometheus.Counter
+	failed             prometheus.Counter
+	deleted            prometheus.Counter
+	released           prometheus.Counter
+	duplicates         prometheus.Counter
+	locked             prometheus.Counter
+	releasedReceives   prometheus.Histogram
+	duration           prometheus.Histogram
+	payloadSize        prometheus.Histogram
+	queueLag           prometheus.Histogram
+	inFlight           prometheus.Gauge
+	lastSuccessfulPoll prometheus.Gauge
+}
+
+// NewMetrics returns Metrics registered with a registry of their own,
+// alongside the go runtime and process metrics
+func NewMetrics() *Metrics {
+	m := &Metrics{
+		registry: prometheus.NewRegistry(),
+		received: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "gantry_messages_received_total",
+			Help: "The number of messages received from the queue.",
+		}),
+		executed: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "gantry_messages_executed_total",
+			Help: "The number of payloads whose entrypoint was run.",
+		}),
+		failed: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "gantry_messages_failed_total",
+			Help: "The number of payloads which could not be run or whose entrypoint failed.",
+		}),
+		deleted: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "gantry_messages_deleted_total",
+			Help: "The number of messages deleted from the queue.",
+		}),
+		released: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "gantry_messages_released_total",
+			Help: "The number of messages released to other consumers, as their selector didn't match the labels of this one.",
+		}),
+		duplicates: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "gantry_messages_duplicate_total",
+			Help: "The number of messages skipped, as their idempotency key completed before.",
+		}),
+		locked: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "gantry_messages_locked_total",
+			Help: "The number of messages put back, as their lock was held by another execution.",
+		}),
+		releasedReceives: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "gantry_released_message_receive_count",
+			Help:    "The number of times released messages were received, high counts are messages bouncing between consumers which don't match them.",
+			Buckets: prometheus.ExponentialBuckets(1, 2, 10),
+		}),
+		duration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "gantry_execution_duration_seconds",
+			Help:    "The time payloads took to extract and run.",
+			Buckets: prometheus.ExponentialBuckets(0.1, 4, 9),
+		}),
+		payloadSize: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "gantry_payload_size_bytes",
+			Help:    "The size of the payloads of received messages.",
+			Buckets: prometheus.ExponentialBuckets(1024, 4, 8),
+		}),
+		queueLag: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "gantry_queue_lag_seconds",
+			Help:    "The time between sending and receiving messages.",
+			Buckets: prometheus.ExponentialBuckets(0.1, 4, 10),
+		}),
+		inFlight: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "gantry_executions_in_flight",
+			Help: "The number of payloads running at the moment.",
+		}),
+		lastSuccessfulPoll: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "gantry_last_successful_poll_timestamp_seconds",
+			Help: "The time of the last receive from the queue which didn't fail, as unix timestamp.",
+		}),
+	}
+	m.registry.MustRegister(
+		prometheus.NewGoCollector(),
+		prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}),
+		m.received, m.executed, m.failed, m.deleted,
+		m.released, m.releasedReceives, m.duplicates, m.locked,
+		m.duration, m.payloadSize, m.queueLag,
+		m.inFlight, m.lastSuccessfulPoll,
+	)
+	return m
+}
+
+// Handler returns the handler which exposes the metrics
+func (m *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+// InstrumentSource returns src, recording the messages it hands out and the
+// polls which didn't fail. Deletes of the messages are recorded as well.
+func (m *Metrics) InstrumentSource(src MessageSource) MessageSource {
+	if m == nil {
+		return src
+	}
+	return instrumentedSource{src: src, metrics: m}
+}
+
+// executionStarted records that a payload started to run, the returned func
+// records its outcome
+func (m *Metrics) executionStarted() func(err error) {
+	if m == nil {
+		return func(error) {}
+	}
+	m.inFlight.Inc()
+	start := time.Now()
+	return func(err error) {
+		m.inFlight.Dec()
+		m.duration.Observe(time.Since(start).Seconds())
+		m.executed.Inc()
+		if err != nil {
+			m.failed.Inc()
+		}
+	}
+}
+
+// messageReleased records that a message received receiveCount times was
+// released to other consumers
+func (m *Metrics) messageReleased(receiveCount int) {
+	if m == nil {
+		return
+	}
+	m.released.Inc()
+	m.releasedReceives.Observe(float64(receiveCount))
+}
+
+// messageDuplicate records that a message was skipped as duplicate
+func (m *Metrics) messageDuplicate() {
+	if m == nil {
+		return
+	}
+	m.duplicates.Inc()
+}
+
+// messageLocked records that a message was put back as its lock was held
+func (m *Metrics) messageLocked() {
+	if m == nil {
+		return
+	}
+	m.locked.Inc()
+}
+
+type instrumentedSource struct {
+	src     MessageSource
+	metrics *Metrics
+}
+
+func (is instrumentedSource) ReceiveMessageWithContext(ctx context.Context) (Message, error) {
+	msg, err := is.src.ReceiveMessageWithContext(ctx)
+	// messages handed out for dead-lettering were received all the same
+	if err == nil || msg != nil {
+		is.metrics.lastSuccessfulPoll.SetToCurrentTime()
+	}
+	if msg == nil {
+		return nil, err
+	}
+
+	is.metrics.received.Inc()
+	is.metrics.payloadSize.Observe(float64(len(msg.Payload())))
+	if sentAt := msg.SentAt(); !sentAt.IsZero() {
+		is.metrics.queueLag.Observe(time.Since(sentAt).Seconds())
+	}
+	return instrumentedMessage{Message: msg, metrics: is.metrics}, err
+}
+
+// instrumentedMessage records its deletion
+type instrumentedMessage struct {
+	Message
+	metrics *Metrics
+}
+
+func (im instrumentedMessage) Delete() error {
+	err := im.Message.Delete()
+	if err == nil {
+		im.metrics.deleted.Inc()
+	}
+	return err
+}
+
+// Finish forwards to the wrapped message, which may be a finisher
+func (im instrumentedMessage) Finish() { finishMessage(im.Message) }
+
+// Reject forwards to the wrapped message, which may be a rejecter
+func (im instrumentedMessage) Reject() error { return rejectMessage(im.Message) }
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func Test_Metrics_RecordsMessagesAndExecutions(t *testing.T) {
+	q, _ := newTestQueue(time.Now().Add(-time.Minute))
+	publishFixture(t, q, "./fixtures/env-propagation", messageBody{Env: env{"TEST_VAR": "is set"}})
+	publishFixture(t, q, "./fixtures/env-propagation", messageBody{Env: env{}})
+	q.publish([]byte(`{"version":42,"env":{}}`), nil, time.Time{})
+
+	metrics := NewMetrics()
+	g := Gantry{
+		ctx:     context.TODO(),
+		src:     metrics.InstrumentSource(q),
+		metrics: metrics,
+		logger:  noopLogger{},
+	}
+	for i := 0; i < 4; i++ {
+		g.HandleMessageIfExists()
+	}
+
+	expected := map[string]float64{
+		"received": 3,
+		"executed": 2,
+		"failed":   1,
+		"deleted":  2,
+		"inFlight": 0,
+	}
+	actual := map[string]float64{
+		"received": testutil.ToFloat64(metrics.received),
+		"executed": testutil.ToFloat64(metrics.executed),
+		"failed":   testutil.ToFloat64(metrics.failed),
+		"deleted":  testutil.ToFloat64(metrics.deleted),
+		"inFlight": testutil.ToFloat64(metrics.inFlight),
+	}
+	for name, v := range expected {
+		if actual[name] != v {
+			t.Errorf("expected %s to equal %v, got %v", name, v, actual[name])
+		}
+	}
+	if lastPoll := testutil.ToFloat64(metrics.lastSuccessfulPoll); time.Since(time.Unix(int64(lastPoll), 0)) > time.Minute {
+		t.Errorf("expected last successful poll to be recent, got %v", lastPoll)
+	}
+	if n := testutil.CollectAndCount(metrics.queueLag); n != 1 {
+		t.Errorf("expected queue lag to be observed, got %d series", n)
+	}
+
+	recorder := httptest.NewRecorder()
+	metrics.Handler().ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+	body, _ := ioutil.ReadAll(recorder.Body)
+	for _, name := range []string{"gantry_messages_received_total 3", "gantry_execution_duration_seconds_count 2", "gantry_payload_size_bytes_count 3"} {
+		if !strings.Contains(string(body), name) {
+			t.Errorf("expected metrics to contain %q", name)
+		}
+	}
+}
+
+func Test_Metrics_NilMetricsRecordNothing(t *testing.T) {
+	var metrics *Metrics
+	q := NewMemoryQueue(time.Minute)
+	if src := metrics.InstrumentSource(q); src != q {
+		t.Errorf("expected source not to be instrumented")
+	}
+	metrics.executionStarted()(nil)
+}
+
+// finishingMessage records whether it was finished
+type finishingMessage struct {
+	Message
+	finished *bool
+}
+
+func (fm finishingMessage) Finish() { *fm.finished = true }
+
+func Test_InstrumentedMessage_ForwardsFinish(t *testing.T) {
+	var finished bool
+	msg := instrumentedMessage{Message: finishingMessage{finished: &finished}, metrics: NewMetrics()}
+	finishMessage(msg)
+	if !finished {
+		t.Error("expected Finish to reach the wrapped message")
+	}
+}
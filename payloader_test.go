@@ -51,7 +51,7 @@ func (h helper) assertDirectoryContentsEqual(src, dest string) {
 		}
 
 		if srcFI.Size() != destFI.Size() {
-			h.t.Errorf("assertDirectoryContentsEqual: source file %q size (%q) did not match dest file size %q (%q)", srcPath, srcFI.Size(), destPath, destFI.Size())
+			h.t.Errorf("assertDirectoryContentsEqual: source file %q size (%d) did not match dest file size %q (%d)", srcPath, srcFI.Size(), destPath, destFI.Size())
 		}
 
 		return nil
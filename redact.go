@@ -0,0 +1,153 @@
+package main
+
+import (
+	"path"
+	"sort"
+	"strings"
+)
+
+const redactedValue = "[redacted]"
+
+// defaultRedactPatterns are the env key patterns which are masked in the logs
+// unless others are configured with -redact
+var defaultRedactPatterns = []string{"*_TOKEN", "*_PASSWORD", "*SECRET*"}
+
+// A redactor masks env values in log fields whose keys either match one of
+// the patterns, or were marked as sensitive by the publisher of a message.
+type redactor struct {
+	patterns  []string
+	sensitive map[string]bool
+}
+
+func (r redactor) isSensitive(key string) bool {
+	if r.sensitive[key] {
+		return true
+	}
+	for _, pattern := range r.patterns {
+		// keys are matched case insensitive, path.Match only errs on
+		// malformed patterns which are rejected by NewRedactingLogger
+		if ok, _ := path.Match(strings.ToUpper(pattern), strings.ToUpper(key)); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// withSensitiveKeys returns a copy of r which additionally masks keys
+func (r redactor) withSensitiveKeys(keys []string) redactor {
+	if len(keys) == 0 {
+		return r
+	}
+	sensitive := make(map[string]bool, len(r.sensitive)+len(keys))
+	for k := range r.sensitive {
+		sensitive[k] = true
+	}
+	for _, k := range keys {
+		sensitive[k] = true
+	}
+	return redactor{patterns: r.patterns, sensitive: sensitive}
+}
+
+func (r redactor) redactEnv(e map[string]string) map[string]string {
+	if e == nil {
+		return nil
+	}
+	out := make(map[string]string, len(e))
+	for k, v := range e {
+		if r.isSensitive(k) {
+			v = redactedValue
+		}
+		out[k] = v
+	}
+	return out
+}
+
+// redactOutput returns s with the sensitive values of e masked, as
+// entrypoints may print their env. Longer values are masked first, so that
+// values containing others are masked as a whole.
+func (r redactor) redactOutput(s string, e map[string]string) string {
+	var values []string
+	for k, v := range e {
+		if v != "" && r.isSensitive(k) {
+			values = append(values, v)
+		}
+	}
+	sort.Slice(values, func(i, j int) bool { return len(values[i]) > len(values[j]) })
+	for _, v := range values {
+		s = strings.Replace(s, v, redactedValue, -1)
+	}
+	return s
+}
+
+// redact returns a copy of v with sensitive env values masked. Values are
+// never modified in place, as they are shared with the caller.
+func (r redactor) redact(v interface{}) interface{} {
+	switch t := v.(type) {
+	case messageBody:
+		t.Env = r.redactEnv(t.Env)
+		return t
+	case env:
+		return env(r.redactEnv(t))
+	case map[string]string:
+		return r.redactEnv(t)
+	case Fields:
+		return Fields(r.redactMap(t))
+	case map[string]interface{}:
+		return r.redactMap(t)
+	}
+	return v
+}
+
+func (r redactor) redactMap(m map[string]interface{}) map[string]interface{} {
+	out := make(map[string]interface{}, len(m))
+	for k, v := range m {
+		out[k] = r.redact(v)
+	}
+	return out
+}
+
+// sensitiveKeys collects the keys marked as sensitive by any message body
+// contained in the fields.
+func sensitiveKeys(v interface{}) []string {
+	var keys []string
+	switch t := v.(type) {
+	case messageBody:
+		keys = append(keys, t.Sensitive...)
+	case Fields:
+		for _, fv := range t {
+			keys = append(keys, sensitiveKeys(fv)...)
+		}
+	case map[string]interface{}:
+		for _, fv := range t {
+			keys = append(keys, sensitiveKeys(fv)...)
+		}
+	}
+	return keys
+}
+
+// NewRedactingLogger returns a Logger which masks sensitive env values in
+// all fields before handing them to next. Keys are matched against the
+// given glob patterns (see path.Match), and against all keys marked sensitive
+// by a message body which was added to the fields of this logger or any of
+// its parents.
+func NewRedactingLogger(next Logger, patterns []string) (Logger, error) {
+	for _, pattern := range patterns {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, err
+		}
+	}
+	return redactingLogger{Logger: next, redactor: redactor{patterns: patterns}}, nil
+}
+
+type redactingLogger struct {
+	Logger
+	redactor redactor
+}
+
+func (rl redactingLogger) WithFields(fields Fields) Logger {
+	r := rl.redactor.withSensitiveKeys(sensitiveKeys(fields))
+	return redactingLogger{
+		Logger:   rl.Logger.WithFields(r.redactMap(fields)),
+		redactor: r,
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func Test_RedactingLogger_MasksEnvMatchingPatterns(t *testing.T) {
+	recorder := NewRecorder()
+	logger, err := NewRedactingLogger(recorder, defaultRedactPatterns)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	commandEnv := map[string]string{
+		"GITHUB_TOKEN":    "ghp-123",
+		"db_password":     "hunter2",
+		"MY_SECRET_THING": "42",
+		"REGION":          "eu-west-1",
+	}
+
+	logger.WithFields(Fields{"command_env": commandEnv}).Info("executed entrypoint")
+
+	if len(recorder.Logs) != 1 {
+		t.Fatalf("expected 1 log entry, got %d", len(recorder.Logs))
+	}
+
+	expected := map[string]string{
+		"GITHUB_TOKEN":    redactedValue,
+		"db_password":     redactedValue,
+		"MY_SECRET_THING": redactedValue,
+		"REGION":          "eu-west-1",
+	}
+	actual := recorder.Logs[0].Fields()["command_env"]
+	if !reflect.DeepEqual(expected, actual) {
+		t.Errorf("expected log field 'command_env' to equal '%v', got '%v'", expected, actual)
+	}
+
+	if commandEnv["GITHUB_TOKEN"] != "ghp-123" {
+		t.Errorf("expected logged env not to be modified in place, got %v", commandEnv)
+	}
+}
+
+func Test_RedactingLogger_MasksKeysMarkedSensitiveByPublisher(t *testing.T) {
+	recorder := NewRecorder()
+	logger, err := NewRedactingLogger(recorder, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body := messageBody{
+		Env:       env{"API_KEY": "abc", "STAGE": "prod"},
+		Sensitive: []string{"API_KEY"},
+	}
+
+	messageLogger := logger.WithFields(Fields{
+		"message": map[string]interface{}{"body": body, "id": "mock-msg-id-123"},
+	})
+	messageLogger.Info("message received")
+	messageLogger.WithFields(Fields{
+		"command_env": map[string]string(body.Env),
+	}).Info("executed entrypoint")
+
+	if len(recorder.Logs) != 2 {
+		t.Fatalf("expected 2 log entries, got %d", len(recorder.Logs))
+	}
+
+	t.Run("in the message body", func(t *testing.T) {
+		message := recorder.Logs[0].Fields()["message"].(map[string]interface{})
+		expected := messageBody{
+			Env:       env{"API_KEY": redactedValue, "STAGE": "prod"},
+			Sensitive: []string{"API_KEY"},
+		}
+		if !reflect.DeepEqual(expected, message["body"]) {
+			t.Errorf("expected logged body to equal '%+#v', got '%+#v'", expected, message["body"])
+		}
+		if message["id"] != "mock-msg-id-123" {
+			t.Errorf("expected logged message id to be kept, got %v", message["id"])
+		}
+	})
+
+	t.Run("in fields of derived loggers", func(t *testing.T) {
+		expected := map[string]string{"API_KEY": redactedValue, "STAGE": "prod"}
+		actual := recorder.Logs[1].Fields()["command_env"]
+		if !reflect.DeepEqual(expected, actual) {
+			t.Errorf("expected log field 'command_env' to equal '%v', got '%v'", expected, actual)
+		}
+	})
+
+	if body.Env["API_KEY"] != "abc" {
+		t.Errorf("expected message body not to be modified in place, got %v", body.Env)
+	}
+}
+
+func Test_RedactingLogger_RejectsMalformedPatterns(t *testing.T) {
+	if _, err := NewRedactingLogger(NewRecorder(), []string{"[A-"}); err == nil {
+		t.Fatalf("expected malformed pattern to raise an error")
+	}
+}
@@ -0,0 +1,396 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/pkg/errors"
+)
+
+func init() {
+	redisTransport := newQueueTransport(openRedisStream)
+	RegisterTransport("redis", redisTransport)
+	RegisterTransport("rediss", redisTransport)
+}
+
+const (
+	defaultRedisStream = "gantry"
+	defaultRedisGroup  = "gantry"
+)
+
+// openRedisStream opens redis streams by URLs of the form
+// redis://[:password@]host[:port][/db]?stream=name&group=name&consumer=name,
+// rediss:// connects over TLS. The stream and consumer group default to
+// gantry, the consumer name to the hostname and pid of the process.
+func openRedisStream(u *url.URL, opts TransportOptions) (MessageQueue, error) {
+	query := u.Query()
+	stream := query.Get("stream")
+	if stream == "" {
+		stream = defaultRedisStream
+	}
+	group := query.Get("group")
+	if group == "" {
+		group = defaultRedisGroup
+	}
+	consumer := query.Get("consumer")
+	if consumer == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return nil, errors.Wrap(err, "redis-stream: can not determine consumer name")
+		}
+		consumer = fmt.Sprintf("%s-%d", hostname, os.Getpid())
+	}
+
+	// the query is ours, the redis client only knows about host, auth and db
+	dialURL := *u
+	dialURL.RawQuery = ""
+	pool := &redis.Pool{
+		MaxIdle:     2,
+		IdleTimeout: time.Minute,
+		Dial: func() (redis.Conn, error) {
+			return redis.DialURL(dialURL.String())
+		},
+	}
+
+	return NewRedisStream(pool, stream, group, consumer, opts.Logger, opts.VisibilityTimeout, opts.MaxDeliveries)
+}
+
+// NewRedisStream returns a MessageQueue backed by a redis stream. Messages are
+// added with XADD and consumed through a consumer group with XREADGROUP, which
+// is created if it doesn't exist yet. Received messages are pending until
+// they are deleted with XACK, pending messages which were idle for longer
+// than the visibility timeout are claimed with XCLAIM by the next consumer.
+// Messages which were delivered maxDeliveries times are moved to the stream
+// <stream>:dead instead, 0 claims them for good.
+func NewRedisStream(pool *redis.Pool, stream, group, consumer string, logger Logger, visibilityTimeout int64, maxDeliveries int) (MessageQueue, error) {
+	rs := &redisStream{
+		pool:              pool,
+		stream:            stream,
+		group:             group,
+		consumer:          consumer,
+		visibilityTimeout: time.Duration(visibilityTimeout) * time.Second,
+		maxDeliveries:     maxDeliveries,
+		logger:            logger.WithFields(Fields{"component": "redis-stream"}),
+	}
+
+	conn := pool.Get()
+	defer conn.Close()
+	// consume the stream from its start, so that messages published before
+	// the first consumer ever started are not skipped
+	_, err := conn.Do("XGROUP", "CREATE", stream, group, "0", "MKSTREAM")
+	if err != nil && !strings.HasPrefix(err.Error(), "BUSYGROUP") {
+		return nil, errors.Wrap(err, fmt.Sprintf("redis-stream: can not create consumer group %s of stream %s", group, stream))
+	}
+	return rs, nil
+}
+
+type redisStream struct {
+	pool     *redis.Pool
+	stream   string
+	group    string
+	consumer string
+
+	visibilityTimeout time.Duration
+	maxDeliveries     int
+
+	logger Logger
+}
+
+// redisDeadStreamSuffix is appended to the stream name for the stream of
+// its dead letters
+const redisDeadStreamSuffix = ":dead"
+
+// Close closes the connections of the stream
+func (rs *redisStream) Close() error {
+	return errors.Wrap(rs.pool.Close(), "redis-stream: can not close connections")
+}
+
+// redis stream entry fields, named like the SQS message attributes
+const (
+	redisFieldBody = "body"
+	redisFieldData = "data"
+)
+
+// PublishPayload adds a message to the stream. Redis has no delayed
+// delivery, messages with a NotBefore time are deferred by the consumer.
+func (rs *redisStream) PublishPayload(body messageBody, b []byte) error {
+	bodyBytes, err := encodeMessageBody(body)
+	if err != nil {
+		return err
+	}
+
+	conn := rs.pool.Get()
+	defer conn.Close()
+	id, err := redis.String(conn.Do("XADD", rs.stream, "*", redisFieldBody, bodyBytes, redisFieldData, b))
+	if err != nil {
+		return errors.Wrap(err, "redis-stream: can not add message")
+	}
+
+	rs.logger.Infof("published payload with message id %s", id)
+
+	return nil
+}
+
+// ReceiveMessageWithContext claims a pending message whose visibility
+// timeout expired, or else reads the next new message of the group
+func (rs *redisStream) ReceiveMessageWithContext(ctx context.Context) (Message, error) {
+	rs.logger.Debugf("checking for single message on redis stream %s", rs.stream)
+
+	conn, err := rs.pool.GetContext(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "redis-stream: can not connect")
+	}
+	defer conn.Close()
+
+	msg, err := rs.claimIdle(conn)
+	if msg != nil || err != nil {
+		return msg, err
+	}
+
+	reply, err := redis.Values(conn.Do("XREADGROUP", "GROUP", rs.group, rs.consumer, "COUNT", 1, "STREAMS", rs.stream, ">"))
+	if err == redis.ErrNil {
+		rs.logger.Debugf("no messages on queue")
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "redis-stream: can not read from consumer group")
+	}
+	// the reply holds the stream name and its entries
+	if len(reply) == 0 {
+		rs.logger.Debugf("no messages on queue")
+		return nil, nil
+	}
+	streamReply, err := redis.Values(reply[0], nil)
+	if err != nil || len(streamReply) != 2 {
+		return nil, errors.Errorf("redis-stream: malformed XREADGROUP reply %v", reply)
+	}
+	entries, err := redis.Values(streamReply[1], nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "redis-stream: malformed XREADGROUP reply")
+	}
+	if len(entries) == 0 {
+		rs.logger.Debugf("no messages on queue")
+		return nil, nil
+	}
+	return rs.message(entries[0], 1)
+}
+
+// claimIdle claims the oldest pending message which was idle for longer than
+// the visibility timeout. Only one of many competing consumers succeeds,
+// XCLAIM re-checks the idle time.
+func (rs *redisStream) claimIdle(conn redis.Conn) (Message, error) {
+	minIdle := int64(rs.visibilityTimeout / time.Millisecond)
+	pending, err := redis.Values(conn.Do("XPENDING", rs.stream, rs.group, "IDLE", minIdle, "-", "+", 1))
+	if err != nil {
+		return nil, errors.Wrap(err, "redis-stream: can not list pending messages")
+	}
+	if len(pending) == 0 {
+		return nil, nil
+	}
+	entry, err := parseRedisPendingEntry(pending[0])
+	if err != nil {
+		return nil, err
+	}
+	if rs.maxDeliveries > 0 && entry.deliveryCount >= rs.maxDeliveries {
+		return nil, rs.deadLetter(conn, entry, minIdle)
+	}
+
+	claimed, err := redis.Values(conn.Do("XCLAIM", rs.stream, rs.group, rs.consumer, minIdle, entry.id))
+	if err != nil {
+		return nil, errors.Wrap(err, fmt.Sprintf("redis-stream: can not claim message %s", entry.id))
+	}
+	if len(claimed) == 0 || claimed[0] == nil {
+		// claimed by another consumer in the meantime, or deleted
+		return nil, nil
+	}
+	rs.logger.Debugf("claimed message %s after %d deliveries", entry.id, entry.deliveryCount)
+	return rs.message(claimed[0], entry.deliveryCount+1)
+}
+
+// deadLetter moves the pending entry, which was delivered too often, to the
+// dead-letter stream. Like claiming, only one of many competing consumers
+// succeeds.
+func (rs *redisStream) deadLetter(conn redis.Conn, entry redisPendingEntry, minIdle int64) error {
+	claimed, err := redis.Values(conn.Do("XCLAIM", rs.stream, rs.group, rs.consumer, minIdle, entry.id))
+	if err != nil {
+		return errors.Wrap(err, fmt.Sprintf("redis-stream: can not claim message %s", entry.id))
+	}
+	if len(claimed) == 0 || claimed[0] == nil {
+		return nil
+	}
+	values, err := redis.Values(claimed[0], nil)
+	if err != nil || len(values) != 2 {
+		return errors.Errorf("redis-stream: malformed stream entry %v", claimed[0])
+	}
+	fields, err := redis.Values(values[1], nil)
+	if err != nil {
+		return errors.Wrap(err, fmt.Sprintf("redis-stream: malformed fields of message %s", entry.id))
+	}
+
+	deadStream := rs.stream + redisDeadStreamSuffix
+	conn.Send("MULTI")
+	conn.Send("XADD", append([]interface{}{deadStream, "*"}, fields...)...)
+	conn.Send("XACK", rs.stream, rs.group, entry.id)
+	conn.Send("XDEL", rs.stream, entry.id)
+	if _, err := conn.Do("EXEC"); err != nil {
+		return errors.Wrap(err, fmt.Sprintf("redis-stream: can not move message %s to %s", entry.id, deadStream))
+	}
+	rs.logger.WithFields(Fields{
+		"message_id": entry.id,
+	}).Warnf("redis-stream: message was delivered %d times, moved it to %s", entry.deliveryCount, deadStream)
+	return nil
+}
+
+// message turns a stream entry into a Message
+func (rs *redisStream) message(reply interface{}, receiveCount int) (Message, error) {
+	values, err := redis.Values(reply, nil)
+	if err != nil || len(values) != 2 {
+		return nil, errors.Errorf("redis-stream: malformed stream entry %v", reply)
+	}
+	id, err := redis.String(values[0], nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "redis-stream: malformed stream entry id")
+	}
+	fields, err := redis.StringMap(values[1], nil)
+	if err != nil {
+		return nil, errors.Wrap(err, fmt.Sprintf("redis-stream: malformed fields of message %s", id))
+	}
+
+	msg := &redisStreamMessage{
+		stream:       rs,
+		id:           id,
+		sentAt:       redisStreamIDTime(id),
+		receiveCount: receiveCount,
+		payload:      []byte(fields[redisFieldData]),
+	}
+	rs.logger.Debugf("got message, this message will be invisible to other clients for %s", rs.visibilityTimeout)
+
+	rawBody, ok := fields[redisFieldBody]
+	if !ok {
+		return msg, MalformedBodyError{fmt.Sprintf("redis-stream: message %s has no %s field", id, redisFieldBody)}
+	}
+	body, err := decodeMessageBody([]byte(rawBody))
+	msg.body = body
+	if err != nil {
+		return msg, errors.Wrap(err, fmt.Sprintf("can not decode body of message %s", id))
+	}
+	return msg, nil
+}
+
+// redisStreamIDTime returns the time a stream entry was added, which is the
+// first part of its id in milliseconds
+func redisStreamIDTime(id string) time.Time {
+	ms, err := strconv.ParseInt(strings.SplitN(id, "-", 2)[0], 10, 64)
+	if err != nil {
+		return time.Time{}
+	}
+	return time.Unix(0, ms*int64(time.Millisecond))
+}
+
+// redisPendingEntry is an entry of the XPENDING reply
+type redisPendingEntry struct {
+	id            string
+	consumer      string
+	deliveryCount int
+}
+
+func parseRedisPendingEntry(reply interface{}) (redisPendingEntry, error) {
+	values, err := redis.Values(reply, nil)
+	if err != nil || len(values) != 4 {
+		return redisPendingEntry{}, errors.Errorf("redis-stream: malformed pending entry %v", reply)
+	}
+	var entry redisPendingEntry
+	var idle int64
+	if _, err := redis.Scan(values, &entry.id, &entry.consumer, &idle, &entry.deliveryCount); err != nil {
+		return redisPendingEntry{}, errors.Wrap(err, "redis-stream: malformed pending entry")
+	}
+	return entry, nil
+}
+
+// A redisStreamMessage is a pending entry of a redis stream
+type redisStreamMessage struct {
+	stream       *redisStream
+	id           string
+	sentAt       time.Time
+	body         messageBody
+	payload      []byte
+	receiveCount int
+}
+
+func (rsm *redisStreamMessage) ID() string        { return rsm.id }
+func (rsm *redisStreamMessage) SentAt() time.Time { return rsm.sentAt }
+func (rsm *redisStreamMessage) Body() messageBody { return rsm.body }
+func (rsm *redisStreamMessage) Payload() []byte   { return rsm.payload }
+func (rsm *redisStreamMessage) ReceiveCount() int { return rsm.receiveCount }
+
+// leased fails unless the message is still pending for this delivery. It was
+// claimed by another consumer if its delivery count changed.
+func (rsm *redisStreamMessage) leased(conn redis.Conn) error {
+	rs := rsm.stream
+	pending, err := redis.Values(conn.Do("XPENDING", rs.stream, rs.group, rsm.id, rsm.id, 1))
+	if err != nil {
+		return errors.Wrap(err, fmt.Sprintf("redis-stream-message: can not look up message with id %s", rsm.id))
+	}
+	if len(pending) == 0 {
+		return errors.Errorf("redis-stream-message: message with id %s was deleted", rsm.id)
+	}
+	entry, err := parseRedisPendingEntry(pending[0])
+	if err != nil {
+		return err
+	}
+	if entry.consumer != rs.consumer || entry.deliveryCount != rsm.receiveCount {
+		return errors.Errorf("redis-stream-message: message with id %s was received again since", rsm.id)
+	}
+	return nil
+}
+
+// Delete acknowledges the message and removes it from the stream. It fails if
+// the visibility timeout expired and the message was claimed by another
+// consumer since.
+func (rsm *redisStreamMessage) Delete() error {
+	rs := rsm.stream
+	conn := rs.pool.Get()
+	defer conn.Close()
+
+	if err := rsm.leased(conn); err != nil {
+		return err
+	}
+	conn.Send("MULTI")
+	conn.Send("XACK", rs.stream, rs.group, rsm.id)
+	conn.Send("XDEL", rs.stream, rsm.id)
+	if _, err := conn.Do("EXEC"); err != nil {
+		return errors.Wrap(err, fmt.Sprintf("redis-stream-message: could not delete message with id %s", rsm.id))
+	}
+	rs.logger.WithFields(Fields{
+		"message_id": rsm.id,
+	}).Infof("redis-stream-message: deleted message")
+	return nil
+}
+
+// ChangeVisibility hides the message for timeout from now on, by setting its
+// idle time so that it can be claimed after timeout. Pending messages can't
+// be hidden for longer than the visibility timeout.
+func (rsm *redisStreamMessage) ChangeVisibility(timeout time.Duration) error {
+	rs := rsm.stream
+	conn := rs.pool.Get()
+	defer conn.Close()
+
+	if err := rsm.leased(conn); err != nil {
+		return err
+	}
+	if timeout > rs.visibilityTimeout {
+		timeout = rs.visibilityTimeout
+	}
+	idle := int64((rs.visibilityTimeout - timeout) / time.Millisecond)
+	// RETRYCOUNT keeps the delivery count, this is no new delivery
+	if _, err := conn.Do("XCLAIM", rs.stream, rs.group, rs.consumer, 0, rsm.id, "IDLE", idle, "RETRYCOUNT", rsm.receiveCount, "JUSTID"); err != nil {
+		return errors.Wrap(err, fmt.Sprintf("redis-stream-message: could not change visibility of message with id %s", rsm.id))
+	}
+	return nil
+}
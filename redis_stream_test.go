@@ -0,0 +1,237 @@
+package main
+
+import (
+	"context"
+	"net/url"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/gomodule/redigo/redis"
+)
+
+// miniredisClock sets the time of a miniredis server, which it uses for
+// stream ids and idle times of pending messages
+type miniredisClock struct {
+	server *miniredis.Miniredis
+	t      time.Time
+}
+
+func (mc *miniredisClock) Advance(d time.Duration) {
+	mc.t = mc.t.Add(d)
+	mc.server.SetTime(mc.t)
+}
+
+func newTestRedisStream(t *testing.T) (*redisStream, *miniredis.Miniredis, *miniredisClock) {
+	t.Helper()
+	server, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	clock := &miniredisClock{server: server, t: time.Date(2018, time.June, 01, 0, 0, 0, 0, time.UTC)}
+	clock.Advance(0)
+
+	pool := &redis.Pool{
+		Dial: func() (redis.Conn, error) {
+			return redis.Dial("tcp", server.Addr())
+		},
+	}
+	q, err := NewRedisStream(pool, "gantry-test", "consumers", "consumer-1", noopLogger{}, 30, 3)
+	if err != nil {
+		server.Close()
+		t.Fatal(err)
+	}
+	return q.(*redisStream), server, clock
+}
+
+func Test_RedisStream_PublishesAndReceivesMessages(t *testing.T) {
+	q, server, clock := newTestRedisStream(t)
+	defer server.Close()
+
+	body := messageBody{Env: env{"FOO": "bar"}}
+	if err := q.PublishPayload(body, []byte("payload")); err != nil {
+		t.Fatal(err)
+	}
+
+	first := receive(t, q)
+	if first == nil {
+		t.Fatalf("expected to receive a message")
+	}
+
+	expectedBody := messageBody{Version: messageVersion, Env: env{"FOO": "bar"}}
+	if !reflect.DeepEqual(expectedBody, first.Body()) {
+		t.Errorf("expected body to equal '%+#v', got '%+#v'", expectedBody, first.Body())
+	}
+	if string(first.Payload()) != "payload" {
+		t.Errorf("expected payload to equal %q, got %q", "payload", first.Payload())
+	}
+	if !first.SentAt().Equal(time.Date(2018, time.June, 01, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("expected message to be sent at the time of XADD, got %s", first.SentAt())
+	}
+	if first.ReceiveCount() != 1 {
+		t.Errorf("expected receive count to equal 1, got %d", first.ReceiveCount())
+	}
+
+	if msg := receive(t, q); msg != nil {
+		t.Fatalf("expected no message while the first is pending, got %s", msg.ID())
+	}
+
+	clock.Advance(30 * time.Second)
+
+	second := receive(t, q)
+	if second == nil || second.ID() != first.ID() {
+		t.Fatalf("expected message %s to be claimed again, got %v", first.ID(), second)
+	}
+	if second.ReceiveCount() != 2 {
+		t.Errorf("expected receive count to equal 2, got %d", second.ReceiveCount())
+	}
+
+	if err := first.Delete(); err == nil {
+		t.Errorf("expected delete with a lost lease to fail")
+	}
+	if err := second.Delete(); err != nil {
+		t.Fatal(err)
+	}
+
+	clock.Advance(time.Minute)
+	if msg := receive(t, q); msg != nil {
+		t.Fatalf("expected deleted message not to be received again, got %s", msg.ID())
+	}
+	if entries, _ := server.Stream(q.stream); len(entries) != 0 {
+		t.Errorf("expected deleted message to be removed from the stream, got %d entries", len(entries))
+	}
+}
+
+func Test_RedisStream_ChangesVisibility(t *testing.T) {
+	q, server, clock := newTestRedisStream(t)
+	defer server.Close()
+
+	if err := q.PublishPayload(messageBody{}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	msg := receive(t, q)
+	if err := msg.ChangeVisibility(0); err != nil {
+		t.Fatal(err)
+	}
+	msg = receive(t, q)
+	if msg == nil {
+		t.Fatalf("expected message to be visible again")
+	}
+	if msg.ReceiveCount() != 2 {
+		t.Errorf("expected receive count to equal 2, got %d", msg.ReceiveCount())
+	}
+
+	if err := msg.ChangeVisibility(10 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+	clock.Advance(9 * time.Second)
+	if msg := receive(t, q); msg != nil {
+		t.Fatalf("expected message to be invisible for 10s")
+	}
+	clock.Advance(time.Second)
+	if msg := receive(t, q); msg == nil {
+		t.Fatalf("expected message to be visible after 10s")
+	}
+}
+
+func Test_RedisStream_HandsOutMalformedMessagesForDeadLettering(t *testing.T) {
+	q, server, _ := newTestRedisStream(t)
+	defer server.Close()
+
+	id, err := server.XAdd(q.stream, "*", []string{redisFieldBody, "{", redisFieldData, ""})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg, err := q.ReceiveMessageWithContext(context.TODO())
+	if msg == nil || msg.ID() != id {
+		t.Fatalf("expected malformed message to be returned, got %v", msg)
+	}
+	if !isDeadLetter(err) {
+		t.Fatalf("expected dead-letter error, got %v", err)
+	}
+}
+
+func Test_RedisStream_MovesMessagesDeliveredTooOftenToDeadStream(t *testing.T) {
+	q, server, clock := newTestRedisStream(t)
+	defer server.Close()
+
+	id, err := server.XAdd(q.stream, "*", []string{redisFieldBody, "{", redisFieldData, "payload"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= 3; i++ {
+		msg, err := q.ReceiveMessageWithContext(context.TODO())
+		if msg == nil || msg.ReceiveCount() != i || !isDeadLetter(err) {
+			t.Fatalf("expected delivery %d of the dead letter, got %v %v", i, msg, err)
+		}
+		clock.Advance(30 * time.Second)
+	}
+
+	if msg := receive(t, q); msg != nil {
+		t.Fatalf("expected message not to be delivered a 4th time, got %s", msg.ID())
+	}
+	if entries, _ := server.Stream(q.stream); len(entries) != 0 {
+		t.Errorf("expected message to be removed from the stream, got %d entries", len(entries))
+	}
+	dead, err := server.Stream(q.stream + redisDeadStreamSuffix)
+	if err != nil || len(dead) != 1 {
+		t.Fatalf("expected message to be moved to the dead stream, got %v %v", dead, err)
+	}
+	if expected := []string{redisFieldBody, "{", redisFieldData, "payload"}; !reflect.DeepEqual(dead[0].Values, expected) {
+		t.Errorf("expected dead letter to keep the fields of %s, got %v", id, dead[0].Values)
+	}
+	conn := q.pool.Get()
+	defer conn.Close()
+	if pending, err := redis.Values(conn.Do("XPENDING", q.stream, q.group)); err != nil || len(pending) == 0 || pending[0] != int64(0) {
+		t.Errorf("expected message to be acknowledged, got %v %v", pending, err)
+	}
+}
+
+func Test_Gantry_RunsPayloadsFromRedisStream(t *testing.T) {
+	server, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	queueURL := (&url.URL{
+		Scheme:   "redis",
+		Host:     server.Addr(),
+		RawQuery: "stream=gantry-test&consumer=consumer-1",
+	}).String()
+	opts := TransportOptions{Logger: noopLogger{}, VisibilityTimeout: 30}
+
+	sink, err := OpenSink(queueURL, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	src, err := OpenSource(queueURL, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	payload, err := Payloader{}.DirToTarGz("./fixtures/env-propagation")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sink.PublishPayload(messageBody{Env: env{"TEST_VAR": "is set"}}, payload); err != nil {
+		t.Fatal(err)
+	}
+
+	g := Gantry{
+		ctx:    context.TODO(),
+		src:    src,
+		logger: noopLogger{},
+	}
+	if err := g.HandleMessageIfExists(); err != nil {
+		t.Fatal(err)
+	}
+
+	server.SetTime(time.Now().Add(time.Hour))
+	if msg := receive(t, src); msg != nil {
+		t.Fatalf("expected executed message to be deleted, got %s", msg.ID())
+	}
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// A Selector matches the labels of consumers, see -label. It is parsed from
+// a comma separated list of requirements which must all be met:
+//
+//	key=value       the label is set to value
+//	key!=value      the label is not set to value, or not set at all
+//	key in (a,b)    the label is set to one of the values
+//	key notin (a,b) the label is not set to any of the values
+//	key             the label is set
+//	!key            the label is not set
+type Selector []selectorRequirement
+
+type selectorRequirement struct {
+	key    string
+	op     string
+	values []string
+}
+
+// The operators of selector requirements
+const (
+	selectorEquals    = "="
+	selectorNotEquals = "!="
+	selectorIn        = "in"
+	selectorNotIn     = "notin"
+	selectorExists    = "exists"
+	selectorNotExists = "!"
+)
+
+var (
+	selectorKey   = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_./-]*$`)
+	selectorValue = regexp.MustCompile(`^[A-Za-z0-9_./-]*$`)
+	selectorSet   = regexp.MustCompile(`^(\S+)\s+(in|notin)\s*\((.*)\)$`)
+)
+
+// ParseSelector parses s, an empty s matches all consumers
+func ParseSelector(s string) (Selector, error) {
+	var sel Selector
+	for _, term := range splitSelector(s) {
+		term = strings.TrimSpace(term)
+		if term == "" {
+			return nil, errors.Errorf("malformed selector %q: empty requirement", s)
+		}
+
+		var r selectorRequirement
+		switch {
+		case selectorSet.MatchString(term):
+			m := selectorSet.FindStringSubmatch(term)
+			r = selectorRequirement{key: m[1], op: m[2]}
+			for _, v := range strings.Split(m[3], ",") {
+				r.values = append(r.values, strings.TrimSpace(v))
+			}
+		case strings.HasPrefix(term, "!") && !strings.Contains(term, "="):
+			r = selectorRequirement{key: strings.TrimSpace(term[1:]), op: selectorNotExists}
+		case strings.Contains(term, "!="):
+			kv := strings.SplitN(term, "!=", 2)
+			r = selectorRequirement{key: strings.TrimSpace(kv[0]), op: selectorNotEquals, values: []string{strings.TrimSpace(kv[1])}}
+		case strings.Contains(term, "="):
+			kv := strings.SplitN(strings.Replace(term, "==", "=", 1), "=", 2)
+			r = selectorRequirement{key: strings.TrimSpace(kv[0]), op: selectorEquals, values: []string{strings.TrimSpace(kv[1])}}
+		default:
+			r = selectorRequirement{key: term, op: selectorExists}
+		}
+
+		if !selectorKey.MatchString(r.key) {
+			return nil, errors.Errorf("malformed selector %q: invalid label key %q", s, r.key)
+		}
+		for _, v := range r.values {
+			if !selectorValue.MatchString(v) {
+				return nil, errors.Errorf("malformed selector %q: invalid label value %q", s, v)
+			}
+		}
+		sel = append(sel, r)
+	}
+	return sel, nil
+}
+
+// splitSelector splits s at the commas which are not within parentheses
+func splitSelector(s string) []string {
+	if strings.TrimSpace(s) == "" {
+		return nil
+	}
+	var (
+		terms []string
+		depth int
+		start int
+	)
+	for i, c := range s {
+		switch c {
+		case '(':
+			depth++
+		case ')':
+			depth--
+		case ',':
+			if depth == 0 {
+				terms = append(terms, s[start:i])
+				start = i + 1
+			}
+		}
+	}
+	return append(terms, s[start:])
+}
+
+// Matches reports whether labels meet all requirements of sel
+func (sel Selector) Matches(labels labelSet) bool {
+	for _, r := range sel {
+		if !r.matches(labels) {
+			return false
+		}
+	}
+	return true
+}
+
+func (r selectorRequirement) matches(labels labelSet) bool {
+	v, ok := labels[r.key]
+	switch r.op {
+	case selectorEquals:
+		return ok && v == r.values[0]
+	case selectorNotEquals:
+		return !ok || v != r.values[0]
+	case selectorIn, selectorNotIn:
+		in := false
+		for _, value := range r.values {
+			in = in || ok && v == value
+		}
+		return in == (r.op == selectorIn)
+	case selectorExists:
+		return ok
+	case selectorNotExists:
+		return !ok
+	}
+	return false
+}
+
+// labelsSelector returns the selector which requires labels
+func labelsSelector(labels map[string]string) string {
+	terms := make([]string, 0, len(labels))
+	for k, v := range labels {
+		terms = append(terms, k+"="+v)
+	}
+	sort.Strings(terms)
+	return strings.Join(terms, ",")
+}
+
+// A SelectorMismatchError is returned for messages whose selector doesn't
+// match the labels of the consumer
+type SelectorMismatchError struct {
+	Selector string
+	Labels   labelSet
+}
+
+func (e SelectorMismatchError) Error() string {
+	return fmt.Sprintf("selector %q does not match consumer labels %q", e.Selector, e.Labels.String())
+}
+
+const (
+	// maxBounceBackoff is the longest a message which keeps bouncing
+	// back to the same consumer is hidden from it
+	maxBounceBackoff = time.Minute
+	// bounceMemory is the time a consumer remembers the messages it released
+	bounceMemory = 10 * time.Minute
+)
+
+// bounceTracker remembers the messages a consumer released, so that
+// messages which no other consumer takes don't bounce back to it in a busy
+// loop. Messages are released with visibility 0 the first time, and with a
+// backoff doubling from one second every time they come back. The zero value
+// is ready to use.
+type bounceTracker struct {
+	mu       sync.Mutex
+	released map[string]bounce
+}
+
+type bounce struct {
+	count int
+	at    time.Time
+}
+
+// release records that the message with id is released at now, it returns
+// its visibility timeout
+func (bt *bounceTracker) release(id string, now time.Time) time.Duration {
+	bt.mu.Lock()
+	defer bt.mu.Unlock()
+	if bt.released == nil {
+		bt.released = map[string]bounce{}
+	}
+	for releasedID, b := range bt.released {
+		if now.Sub(b.at) > bounceMemory {
+			delete(bt.released, releasedID)
+		}
+	}
+
+	b := bt.released[id]
+	b.count++
+	b.at = now
+	bt.released[id] = b
+
+	if b.count == 1 {
+		return 0
+	}
+	backoff := time.Second
+	for i := 2; i < b.count && backoff < maxBounceBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > maxBounceBackoff {
+		backoff = maxBounceBackoff
+	}
+	return backoff
+}
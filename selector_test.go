@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func Test_ParseSelector_RejectsMalformedSelectors(t *testing.T) {
+	for _, s := range []string{
+		"region=eu-west-1,",
+		"region=eu west",
+		"=eu-west-1",
+		"!=eu-west-1",
+		"tool in (helm,kube ctl)",
+		"re gion",
+		"!",
+	} {
+		if _, err := ParseSelector(s); err == nil {
+			t.Errorf("expected selector %q to be rejected", s)
+		}
+	}
+}
+
+func Test_Selector_Matches(t *testing.T) {
+	labels := labelSet{"region": "eu-west-1", "tool": "helm", "gpu": ""}
+	for s, expected := range map[string]bool{
+		"":                                true,
+		"region=eu-west-1":                true,
+		"region==eu-west-1":               true,
+		"region=us-east-1":                false,
+		"region!=us-east-1":               true,
+		"cluster!=prod":                   true,
+		"tool in (helm, kubectl)":         true,
+		"tool notin (helm,kubectl)":       false,
+		"cluster notin (prod)":            true,
+		"cluster in (prod)":               false,
+		"gpu":                             true,
+		"!gpu":                            false,
+		"!canary":                         true,
+		"region=eu-west-1,tool in (helm)": true,
+		"region=eu-west-1,!gpu":           false,
+	} {
+		sel, err := ParseSelector(s)
+		if err != nil {
+			t.Errorf("can not parse %q: %s", s, err)
+			continue
+		}
+		if sel.Matches(labels) != expected {
+			t.Errorf("expected %q to match %v: %t", s, labels, expected)
+		}
+	}
+}
+
+func Test_BounceTracker_BacksOffMessagesBouncingBack(t *testing.T) {
+	var bt bounceTracker
+	now := time.Date(2018, time.June, 01, 0, 0, 0, 0, time.UTC)
+
+	var visibilities []time.Duration
+	for i := 0; i < 9; i++ {
+		visibilities = append(visibilities, bt.release("a", now))
+	}
+	expected := []time.Duration{0, 1, 2, 4, 8, 16, 32, 60, 60}
+	for i, v := range expected {
+		if visibilities[i] != v*time.Second {
+			t.Errorf("expected release %d to hide message for %ds, got %s", i+1, v, visibilities[i])
+		}
+	}
+
+	if v := bt.release("b", now); v != 0 {
+		t.Errorf("expected other messages to be released right away, got %s", v)
+	}
+	if v := bt.release("a", now.Add(bounceMemory+time.Second)); v != 0 {
+		t.Errorf("expected message to be forgotten after %s, got %s", bounceMemory, v)
+	}
+}
+
+func Test_Gantry_ReleasesMessagesForOtherConsumers(t *testing.T) {
+	q, clock := newTestQueue(time.Now())
+	publishFixture(t, q, "./fixtures/greet", messageBody{Selector: "region=eu-west-1"})
+	metrics := NewMetrics()
+
+	g := Gantry{
+		ctx:     context.TODO(),
+		src:     q,
+		labels:  labelSet{"region": "us-east-1"},
+		metrics: metrics,
+		logger:  noopLogger{},
+	}
+	// the first release makes the message visible right away
+	for i := 0; i < 2; i++ {
+		msg := receive(t, q)
+		status, _, err := g.HandleMessage(msg)
+		if status != statusReleased || err != nil {
+			t.Fatalf("expected message to be released, got %s %v", status, err)
+		}
+	}
+
+	t.Run("hides the message bouncing back", func(t *testing.T) {
+		if msg, _ := q.ReceiveMessageWithContext(context.TODO()); msg != nil {
+			t.Errorf("expected message bouncing back to be hidden")
+		}
+	})
+
+	t.Run("records the bounces", func(t *testing.T) {
+		if n := testutil.ToFloat64(metrics.released); n != 2 {
+			t.Errorf("expected 2 releases, got %v", n)
+		}
+		if n := testutil.CollectAndCount(metrics.releasedReceives); n != 1 {
+			t.Errorf("expected receive counts to be observed, got %d series", n)
+		}
+	})
+
+	t.Run("runs the message on matching consumers", func(t *testing.T) {
+		clock.Advance(time.Minute)
+		g.labels = labelSet{"region": "eu-west-1"}
+		if err := g.HandleMessageIfExists(); err != nil {
+			t.Fatal(err)
+		}
+		if q.Len() != 0 {
+			t.Errorf("expected message to be deleted")
+		}
+	})
+}
+
+func Test_PayloadBody_AddsRequiredLabelsToSelector(t *testing.T) {
+	dir := writePayloadDir(t, "entrypoint: bin/run.sh\nrequired_labels: {tool: helm, region: eu-west-1}", "")
+
+	for _, tc := range []struct {
+		selector, expected string
+	}{
+		{"", "region=eu-west-1,tool=helm"},
+		{"!canary", "!canary,region=eu-west-1,tool=helm"},
+	} {
+		body, err := payloadBody(dir, messageBody{Selector: tc.selector})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if body.Selector != tc.expected {
+			t.Errorf("expected selector %q, got %q", tc.expected, body.Selector)
+		}
+	}
+}
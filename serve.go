@@ -0,0 +1,333 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// maxPushBodyBytes limits the JSON message body part of a push
+	maxPushBodyBytes = 1 << 20
+	// maxFinishedExecutions is the number of finished executions whose
+	// status is kept for async requests
+	maxFinishedExecutions = 1000
+)
+
+// The status of pushed executions, besides the outcomes of HandleMessage
+const (
+	executionRunning   = "running"
+	executionSucceeded = "succeeded"
+	executionFailed    = "failed"
+)
+
+// A PushServer accepts payloads over HTTP and hands them to the same handler
+// as messages received from a queue, for producers which can't publish to a
+// queue. Payloads are POSTed to /executions as multipart/form-data, with the
+// JSON message body in the "body" part and the tar.gz payload in the
+// "payload" part. They are executed right away, the response waits for the
+// execution unless ?async=true is given, in which case the status can be
+// polled from /executions/<id>.
+//
+// Requests must carry the bearer token if one is configured, or else a
+// verified client certificate. Requests larger than maxRequestBytes are
+// rejected before anything is extracted.
+type PushServer struct {
+	gantry          *Gantry
+	token           string
+	maxRequestBytes int64
+
+	mu         sync.Mutex
+	executions map[string]*execution
+	finished   []string
+
+	logger Logger
+}
+
+// NewPushServer returns a PushServer which executes payloads with g
+func NewPushServer(g *Gantry, token string, maxRequestBytes int64, logger Logger) *PushServer {
+	return &PushServer{
+		gantry:          g,
+		token:           token,
+		maxRequestBytes: maxRequestBytes,
+		executions:      map[string]*execution{},
+		logger:          logger.WithFields(Fields{"component": "push-server"}),
+	}
+}
+
+// execution is the status of a pushed payload
+type execution struct {
+	ID         string     `json:"id"`
+	Status     string     `json:"status"`
+	Error      string     `json:"error,omitempty"`
+	StartedAt  time.Time  `json:"started_at"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+	// Artifacts are the references of the artifacts collected from the
+	// payload
+	Artifacts []string `json:"artifacts,omitempty"`
+	// RetryAfter is the number of seconds after which the payload should
+	// be pushed again, if it was released, waited for a lock or is retried
+	RetryAfter *int64 `json:"retry_after,omitempty"`
+}
+
+func (ps *PushServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if err := ps.authenticate(r); err != nil {
+		ps.logger.WithFields(Fields{"remote_addr": r.RemoteAddr}.logError(err)).Warn("rejected unauthenticated request")
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		ps.writeError(w, http.StatusUnauthorized, err)
+		return
+	}
+
+	switch {
+	case r.URL.Path == "/executions" && r.Method == http.MethodPost:
+		ps.push(w, r)
+	case strings.HasPrefix(r.URL.Path, "/executions/") && r.Method == http.MethodGet:
+		ps.status(w, strings.TrimPrefix(r.URL.Path, "/executions/"))
+	default:
+		ps.writeError(w, http.StatusNotFound, errors.Errorf("no route for %s %s", r.Method, r.URL.Path))
+	}
+}
+
+// authenticate checks the bearer token, or the client certificate if no
+// token is configured
+func (ps *PushServer) authenticate(r *http.Request) error {
+	if ps.token == "" {
+		if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+			return errors.New("a verified client certificate is required")
+		}
+		return nil
+	}
+	const prefix = "Bearer "
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, prefix) {
+		return errors.New("a bearer token is required")
+	}
+	if subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(auth, prefix)), []byte(ps.token)) != 1 {
+		return errors.New("invalid bearer token")
+	}
+	return nil
+}
+
+func (ps *PushServer) push(w http.ResponseWriter, r *http.Request) {
+	if r.ContentLength > ps.maxRequestBytes {
+		ps.writeError(w, http.StatusRequestEntityTooLarge, errors.Errorf("request is larger than %d bytes", ps.maxRequestBytes))
+		return
+	}
+	// the content length may be unknown, or a lie
+	body := &limitedBody{ReadCloser: r.Body, remaining: ps.maxRequestBytes}
+	r.Body = body
+
+	msg, err := ps.readMessage(r)
+	if err != nil {
+		code := http.StatusBadRequest
+		if body.exceeded {
+			code = http.StatusRequestEntityTooLarge
+		}
+		ps.logger.WithFields(Fields{"remote_addr": r.RemoteAddr}.logError(err)).Warn("rejected malformed push")
+		ps.writeError(w, code, err)
+		return
+	}
+
+	exec := &execution{ID: msg.id, Status: executionRunning, StartedAt: msg.sentAt}
+	ps.mu.Lock()
+	ps.executions[exec.ID] = exec
+	ps.mu.Unlock()
+
+	ps.logger.WithFields(Fields{"remote_addr": r.RemoteAddr}).Infof("accepted pushed payload with execution id %s", msg.id)
+
+	if r.URL.Query().Get("async") == "true" {
+		go ps.execute(exec, msg)
+		w.Header().Set("Location", "/executions/"+exec.ID)
+		ps.writeJSON(w, http.StatusAccepted, ps.snapshot(exec))
+		return
+	}
+	ps.execute(exec, msg)
+	snapshot := ps.snapshot(exec)
+	if snapshot.RetryAfter != nil {
+		w.Header().Set("Retry-After", strconv.FormatInt(*snapshot.RetryAfter, 10))
+		ps.writeJSON(w, http.StatusServiceUnavailable, snapshot)
+		return
+	}
+	ps.writeJSON(w, http.StatusOK, snapshot)
+}
+
+// readMessage reads the body and payload parts of a push
+func (ps *PushServer) readMessage(r *http.Request) (*pushMessage, error) {
+	mr, err := r.MultipartReader()
+	if err != nil {
+		return nil, errors.Wrap(err, "expected a multipart/form-data request")
+	}
+
+	var (
+		rawBody, payload []byte
+		hasBody          bool
+	)
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, errors.Wrap(err, "can not read multipart request")
+		}
+		switch part.FormName() {
+		case "body":
+			rawBody, err = ioutil.ReadAll(io.LimitReader(part, maxPushBodyBytes+1))
+			if err == nil && len(rawBody) > maxPushBodyBytes {
+				err = errors.Errorf("body part is larger than %d bytes", maxPushBodyBytes)
+			}
+			hasBody = true
+		case "payload":
+			payload, err = ioutil.ReadAll(part)
+		default:
+			err = errors.Errorf("unexpected part %q", part.FormName())
+		}
+		part.Close()
+		if err != nil {
+			return nil, errors.Wrap(err, fmt.Sprintf("can not read %s part", part.FormName()))
+		}
+	}
+	if payload == nil {
+		return nil, errors.New("missing payload part")
+	}
+
+	body := messageBody{Version: messageVersion}
+	if hasBody {
+		if body, err = decodeMessageBody(rawBody); err != nil {
+			return nil, err
+		}
+	}
+	if body.NotBefore != nil && time.Now().Before(*body.NotBefore) {
+		return nil, errors.New("delayed payloads can not be pushed, publish them to a queue instead")
+	}
+
+	id, err := randomID()
+	if err != nil {
+		return nil, err
+	}
+	return &pushMessage{
+		id:      id,
+		sentAt:  time.Now(),
+		body:    body,
+		payload: payload,
+	}, nil
+}
+
+// execute runs msg and records its outcome in exec
+func (ps *PushServer) execute(exec *execution, msg *pushMessage) {
+	status, artifacts, err := ps.gantry.HandleMessage(msg)
+	if status == statusCompleted {
+		status = executionSucceeded
+		if err != nil {
+			status = executionFailed
+		}
+	}
+
+	finishedAt := time.Now()
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	exec.Status = status
+	exec.FinishedAt = &finishedAt
+	exec.Artifacts = artifacts
+	if err != nil {
+		exec.Error = err.Error()
+	}
+	if msg.requeued {
+		retryAfter := int64((msg.retryAfter + time.Second - 1) / time.Second)
+		exec.RetryAfter = &retryAfter
+	}
+
+	ps.finished = append(ps.finished, exec.ID)
+	if len(ps.finished) > maxFinishedExecutions {
+		delete(ps.executions, ps.finished[0])
+		ps.finished = ps.finished[1:]
+	}
+}
+
+// snapshot returns a copy of exec which is safe to encode
+func (ps *PushServer) snapshot(exec *execution) execution {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	return *exec
+}
+
+func (ps *PushServer) status(w http.ResponseWriter, id string) {
+	ps.mu.Lock()
+	exec, ok := ps.executions[id]
+	ps.mu.Unlock()
+	if !ok {
+		ps.writeError(w, http.StatusNotFound, errors.Errorf("no execution with id %s", id))
+		return
+	}
+	ps.writeJSON(w, http.StatusOK, ps.snapshot(exec))
+}
+
+func (ps *PushServer) writeError(w http.ResponseWriter, code int, err error) {
+	ps.writeJSON(w, code, map[string]string{"error": err.Error()})
+}
+
+func (ps *PushServer) writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		ps.logger.WithFields(ErrorFields(err)).Warn("can not write response")
+	}
+}
+
+// limitedBody fails reads beyond remaining bytes, and records that the
+// request was too large
+type limitedBody struct {
+	io.ReadCloser
+	remaining int64
+	exceeded  bool
+}
+
+func (lb *limitedBody) Read(p []byte) (int, error) {
+	// read one byte more than remaining to tell whether there is more
+	if int64(len(p)) > lb.remaining+1 {
+		p = p[:lb.remaining+1]
+	}
+	n, err := lb.ReadCloser.Read(p)
+	if int64(n) > lb.remaining {
+		lb.exceeded = true
+		return 0, errors.New("request body too large")
+	}
+	lb.remaining -= int64(n)
+	return n, err
+}
+
+// A pushMessage is a payload pushed over HTTP, it isn't queued anywhere
+type pushMessage struct {
+	id      string
+	sentAt  time.Time
+	body    messageBody
+	payload []byte
+
+	// requeued is set if the message should be pushed again after
+	// retryAfter, as it can't be put back on a queue
+	requeued   bool
+	retryAfter time.Duration
+}
+
+func (pm *pushMessage) ID() string        { return pm.id }
+func (pm *pushMessage) SentAt() time.Time { return pm.sentAt }
+func (pm *pushMessage) Body() messageBody { return pm.body }
+func (pm *pushMessage) Payload() []byte   { return pm.payload }
+func (pm *pushMessage) ReceiveCount() int { return 1 }
+func (pm *pushMessage) Delete() error     { return nil }
+
+// ChangeVisibility asks the client to push the message again after timeout
+func (pm *pushMessage) ChangeVisibility(timeout time.Duration) error {
+	pm.requeued = true
+	pm.retryAfter = timeout
+	return nil
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func newTestPushServer(t *testing.T, maxRequestBytes int64) *httptest.Server {
+	t.Helper()
+	g := &Gantry{
+		ctx:    context.TODO(),
+		logger: noopLogger{},
+	}
+	return httptest.NewServer(NewPushServer(g, "s3cret", maxRequestBytes, noopLogger{}))
+}
+
+// pushRequest returns a multipart request pushing the fixture dir with body
+func pushRequest(t *testing.T, url, dir, body string) *http.Request {
+	t.Helper()
+	payload, err := Payloader{}.DirToTarGz(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	if err := mw.WriteField("body", body); err != nil {
+		t.Fatal(err)
+	}
+	part, err := mw.CreateFormFile("payload", "payload.tar.gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	part.Write(payload)
+	if err := mw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	req, err := http.NewRequest(http.MethodPost, url, &buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	req.Header.Set("Authorization", "Bearer s3cret")
+	return req
+}
+
+func doPush(t *testing.T, req *http.Request) (int, execution) {
+	t.Helper()
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var exec execution
+	if err := json.NewDecoder(resp.Body).Decode(&exec); err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode, exec
+}
+
+func Test_PushServer_ExecutesPushedPayloads(t *testing.T) {
+	server := newTestPushServer(t, 1<<20)
+	defer server.Close()
+
+	code, exec := doPush(t, pushRequest(t, server.URL+"/executions", "./fixtures/env-propagation", `{"env":{"TEST_VAR":"is set"}}`))
+	if code != http.StatusOK || exec.Status != executionSucceeded {
+		t.Errorf("expected execution to succeed, got %d %+v", code, exec)
+	}
+	if exec.ID == "" || exec.FinishedAt == nil {
+		t.Errorf("expected finished execution with an id, got %+v", exec)
+	}
+
+	code, exec = doPush(t, pushRequest(t, server.URL+"/executions", "./fixtures/env-propagation", `{"env":{}}`))
+	if code != http.StatusOK || exec.Status != executionFailed || exec.Error != "exit status 1" {
+		t.Errorf("expected execution to fail, got %d %+v", code, exec)
+	}
+}
+
+func Test_PushServer_ExecutesPushedPayloadsAsynchronously(t *testing.T) {
+	server := newTestPushServer(t, 1<<20)
+	defer server.Close()
+
+	code, exec := doPush(t, pushRequest(t, server.URL+"/executions?async=true", "./fixtures/env-propagation", `{"env":{"TEST_VAR":"is set"}}`))
+	if code != http.StatusAccepted || exec.ID == "" {
+		t.Fatalf("expected execution to be accepted, got %d %+v", code, exec)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for exec.Status == executionRunning && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+		req, _ := http.NewRequest(http.MethodGet, server.URL+"/executions/"+exec.ID, nil)
+		req.Header.Set("Authorization", "Bearer s3cret")
+		code, exec = doPush(t, req)
+		if code != http.StatusOK {
+			t.Fatalf("expected status of execution, got %d", code)
+		}
+	}
+	if exec.Status != executionSucceeded {
+		t.Errorf("expected execution to succeed, got %+v", exec)
+	}
+}
+
+func Test_PushServer_AsksToRetryReleasedPayloads(t *testing.T) {
+	server := newTestPushServer(t, 1<<20)
+	defer server.Close()
+
+	resp, err := http.DefaultClient.Do(pushRequest(t, server.URL+"/executions", "./fixtures/env-propagation", `{"selector":"region=eu-west-1"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var exec execution
+	if err := json.NewDecoder(resp.Body).Decode(&exec); err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusServiceUnavailable || exec.Status != statusReleased {
+		t.Errorf("expected payload to be released, got %d %+v", resp.StatusCode, exec)
+	}
+	if exec.RetryAfter == nil || resp.Header.Get("Retry-After") != strconv.FormatInt(*exec.RetryAfter, 10) {
+		t.Errorf("expected Retry-After of the execution, got %q %+v", resp.Header.Get("Retry-After"), exec)
+	}
+}
+
+func Test_PushServer_RejectsUnauthenticatedRequests(t *testing.T) {
+	server := newTestPushServer(t, 1<<20)
+	defer server.Close()
+
+	for _, auth := range []string{"", "Bearer wrong", "s3cret"} {
+		req := pushRequest(t, server.URL+"/executions", "./fixtures/greet", `{}`)
+		req.Header.Set("Authorization", auth)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusUnauthorized {
+			t.Errorf("expected authorization %q to be rejected, got %d", auth, resp.StatusCode)
+		}
+	}
+}
+
+func Test_PushServer_RejectsOversizedRequests(t *testing.T) {
+	server := newTestPushServer(t, 256)
+	defer server.Close()
+
+	code, _ := doPush(t, pushRequest(t, server.URL+"/executions", "./fixtures/greet", `{}`))
+	if code != http.StatusRequestEntityTooLarge {
+		t.Errorf("expected oversized request to be rejected, got %d", code)
+	}
+}
+
+func Test_PushServer_RejectsInvalidPushes(t *testing.T) {
+	server := newTestPushServer(t, 1<<20)
+	defer server.Close()
+
+	tests := map[string]struct {
+		dir, body string
+		code      int
+	}{
+		"malformed":     {"./fixtures/greet", `{`, http.StatusBadRequest},
+		"invalid env":   {"./fixtures/greet", `{"env":{"A=B":"c"}}`, http.StatusBadRequest},
+		"delayed":       {"./fixtures/greet", `{"not_before":"2999-01-01T00:00:00Z"}`, http.StatusBadRequest},
+		"newer version": {"./fixtures/greet", `{"version":2}`, http.StatusBadRequest},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			req := pushRequest(t, server.URL+"/executions", test.dir, test.body)
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != test.code {
+				t.Errorf("expected status %d, got %d", test.code, resp.StatusCode)
+			}
+		})
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"os"
+
+	"github.com/pkg/errors"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracer creates the spans of gantry, they are dropped unless tracing was
+// set up with initTracing
+var tracer = otel.Tracer("github.com/costacruise/gantry")
+
+// tracePropagator carries the trace from the publisher over the message
+// body to the consumer, and on to the entrypoint
+var tracePropagator = propagation.TraceContext{}
+
+// initTracing sets up the export of spans with exporter, which is "otlp" to
+// export over OTLP/HTTP to endpoint, or the endpoint of the OTEL_EXPORTER_OTLP_*
+// env if it is empty, or "stdout". The returned func flushes the remaining
+// spans.
+func initTracing(exporter, endpoint string) (func(context.Context) error, error) {
+	var (
+		spanExporter sdktrace.SpanExporter
+		err          error
+	)
+	switch exporter {
+	case "otlp":
+		var opts []otlptracehttp.Option
+		if endpoint != "" {
+			opts = append(opts, otlptracehttp.WithEndpointURL(endpoint))
+		}
+		spanExporter, err = otlptracehttp.New(context.Background(), opts...)
+	case "stdout":
+		spanExporter, err = stdouttrace.New(stdouttrace.WithWriter(os.Stdout))
+	default:
+		return nil, errors.Errorf("unknown trace exporter %q, supported are otlp and stdout", exporter)
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "can not create trace exporter")
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(spanExporter),
+		sdktrace.WithResource(resource.NewSchemaless(semconv.ServiceName("gantry"))),
+	)
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(tracePropagator)
+	return provider.Shutdown, nil
+}
+
+// injectTrace returns body carrying the trace context of ctx
+func injectTrace(ctx context.Context, body messageBody) messageBody {
+	carrier := propagation.MapCarrier{}
+	tracePropagator.Inject(ctx, carrier)
+	if len(carrier) > 0 {
+		body.Trace = carrier
+	}
+	return body
+}
+
+// extractTrace returns ctx carrying the trace context of body
+func extractTrace(ctx context.Context, body messageBody) context.Context {
+	return tracePropagator.Extract(ctx, propagation.MapCarrier(body.Trace))
+}
+
+// traceEnviron returns the TRACEPARENT and TRACESTATE env for the span of
+// ctx, for entrypoints to continue the trace
+func traceEnviron(ctx context.Context) []string {
+	carrier := propagation.MapCarrier{}
+	tracePropagator.Inject(ctx, carrier)
+	var environ []string
+	if traceparent := carrier.Get("traceparent"); traceparent != "" {
+		environ = append(environ, "TRACEPARENT="+traceparent)
+	}
+	if tracestate := carrier.Get("tracestate"); tracestate != "" {
+		environ = append(environ, "TRACESTATE="+tracestate)
+	}
+	return environ
+}
+
+// endSpan records err on span and ends it
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// messageAttributes are the span attributes of msg
+func messageAttributes(msg Message) []attribute.KeyValue {
+	return []attribute.KeyValue{
+		semconv.MessagingMessageID(msg.ID()),
+		attribute.Int("messaging.receive_count", msg.ReceiveCount()),
+		attribute.Int("messaging.message.body.size", len(msg.Payload())),
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var (
+	spanRecorderOnce sync.Once
+	spanRecorder     *tracetest.SpanRecorder
+)
+
+// testSpanRecorder returns the recorder of the spans of all tests, the
+// global tracer provider can only be set once
+func testSpanRecorder() *tracetest.SpanRecorder {
+	spanRecorderOnce.Do(func() {
+		spanRecorder = tracetest.NewSpanRecorder()
+		otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(spanRecorder)))
+	})
+	return spanRecorder
+}
+
+// endedSpans returns the ended spans of traceID by name
+func endedSpans(recorder *tracetest.SpanRecorder, traceID trace.TraceID) map[string]sdktrace.ReadOnlySpan {
+	spans := map[string]sdktrace.ReadOnlySpan{}
+	for _, span := range recorder.Ended() {
+		if span.SpanContext().TraceID() == traceID {
+			spans[span.Name()] = span
+		}
+	}
+	return spans
+}
+
+func Test_Gantry_ContinuesTraceOfPublisher(t *testing.T) {
+	recorder := testSpanRecorder()
+
+	ctx, publishSpan := tracer.Start(context.Background(), "publish")
+	traceID := publishSpan.SpanContext().TraceID()
+	q, _ := newTestQueue(time.Now())
+	publishFixture(t, q, "./fixtures/trace-propagation", injectTrace(ctx, messageBody{}))
+	publishSpan.End()
+
+	logger := NewRecorder()
+	g := Gantry{
+		ctx:    context.TODO(),
+		src:    q,
+		logger: logger,
+	}
+	if err := g.HandleMessageIfExists(); err != nil {
+		t.Fatal(err)
+	}
+
+	spans := endedSpans(recorder, traceID)
+	receive, ok := spans["receive"]
+	if !ok {
+		t.Fatalf("expected receive span in the trace of the publisher, got %v", spans)
+	}
+	if receive.Parent().SpanID() != publishSpan.SpanContext().SpanID() {
+		t.Errorf("expected receive span to be a child of the publish span")
+	}
+	for _, name := range []string{"extract", "execute", "delete"} {
+		span, ok := spans[name]
+		if !ok {
+			t.Errorf("expected %s span", name)
+			continue
+		}
+		if span.Parent().SpanID() != receive.SpanContext().SpanID() {
+			t.Errorf("expected %s span to be a child of the receive span", name)
+		}
+	}
+
+	var stderr string
+	for _, entry := range Logs(logger.Logs).ByLevel()["info"] {
+		if s, ok := entry.Fields()["command_stderr"].(string); ok {
+			stderr = s
+		}
+	}
+	if execute, ok := spans["execute"]; ok {
+		expected := "00-" + traceID.String() + "-" + execute.SpanContext().SpanID().String() + "-01"
+		if strings.TrimSpace(stderr) != expected {
+			t.Errorf("expected entrypoint to get TRACEPARENT %q, got %q", expected, stderr)
+		}
+	}
+}
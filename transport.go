@@ -0,0 +1,114 @@
+package main
+
+import (
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// TransportOptions are the settings passed to a transport when opening a
+// queue
+type TransportOptions struct {
+	Logger Logger
+	// VisibilityTimeout is the number of seconds received messages are
+	// invisible to other consumers
+	VisibilityTimeout int64
+	// Workers is the number of messages the consumer handles at the same
+	// time, transports which push messages to the consumer don't hand out
+	// more than that
+	Workers int
+	// BatchSize is the number of messages transports which poll for
+	// messages receive at once, up to their maximum
+	BatchSize int
+	// MaxDeliveries is the number of deliveries after which transports
+	// without a redrive policy move messages to their dead letters, 0
+	// never does
+	MaxDeliveries int
+}
+
+// A Transport opens message sources and sinks for queue URLs of a scheme.
+// Either func may be nil if the transport only supports one direction.
+type Transport struct {
+	Source func(u *url.URL, opts TransportOptions) (MessageSource, error)
+	Sink   func(u *url.URL, opts TransportOptions) (MessageSink, error)
+}
+
+var (
+	transportsMu sync.RWMutex
+	transports   = map[string]Transport{}
+)
+
+// RegisterTransport makes t available for queue URLs with scheme. It panics
+// if a transport is registered twice for the same scheme.
+func RegisterTransport(scheme string, t Transport) {
+	transportsMu.Lock()
+	defer transportsMu.Unlock()
+	scheme = strings.ToLower(scheme)
+	if _, ok := transports[scheme]; ok {
+		panic("gantry: transport registered twice for scheme " + scheme)
+	}
+	transports[scheme] = t
+}
+
+// queueTransport returns the transport for the scheme of rawURL
+func queueTransport(rawURL string) (*url.URL, Transport, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, Transport{}, errors.Wrap(err, "transport: can not parse queue url")
+	}
+
+	transportsMu.RLock()
+	defer transportsMu.RUnlock()
+	t, ok := transports[strings.ToLower(u.Scheme)]
+	if !ok {
+		schemes := make([]string, 0, len(transports))
+		for s := range transports {
+			schemes = append(schemes, s)
+		}
+		sort.Strings(schemes)
+		return nil, Transport{}, errors.Errorf("transport: unsupported queue url scheme %q, supported are %s", u.Scheme, strings.Join(schemes, ","))
+	}
+	return u, t, nil
+}
+
+// OpenSource returns the MessageSource for rawURL from the transport
+// registered for its scheme
+func OpenSource(rawURL string, opts TransportOptions) (MessageSource, error) {
+	u, t, err := queueTransport(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if t.Source == nil {
+		return nil, errors.Errorf("transport: can not consume from %s queues", u.Scheme)
+	}
+	return t.Source(u, opts)
+}
+
+// OpenSink returns the MessageSink for rawURL from the transport registered
+// for its scheme
+func OpenSink(rawURL string, opts TransportOptions) (MessageSink, error) {
+	u, t, err := queueTransport(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if t.Sink == nil {
+		return nil, errors.Errorf("transport: can not publish to %s queues", u.Scheme)
+	}
+	return t.Sink(u, opts)
+}
+
+// newQueueTransport returns a Transport which opens the same MessageQueue for
+// consuming and publishing
+func newQueueTransport(open func(u *url.URL, opts TransportOptions) (MessageQueue, error)) Transport {
+	return Transport{
+		Source: func(u *url.URL, opts TransportOptions) (MessageSource, error) {
+			return open(u, opts)
+		},
+		Sink: func(u *url.URL, opts TransportOptions) (MessageSink, error) {
+			return open(u, opts)
+		},
+	}
+}
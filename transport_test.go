@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+)
+
+func Test_OpenSourceAndSink_ShareMemoryQueuesByName(t *testing.T) {
+	opts := TransportOptions{Logger: noopLogger{}, VisibilityTimeout: 30}
+
+	sink, err := OpenSink("mem://transport-test", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	src, err := OpenSource("mem://transport-test", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := OpenSource("mem://other-transport-test", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := sink.PublishPayload(messageBody{}, []byte("payload")); err != nil {
+		t.Fatal(err)
+	}
+
+	if msg := receive(t, other); msg != nil {
+		t.Errorf("expected queues with different names to be distinct")
+	}
+	if msg := receive(t, src); msg == nil || string(msg.Payload()) != "payload" {
+		t.Errorf("expected message published to the sink to be received from the source, got %v", msg)
+	}
+}
+
+func Test_OpenSource_OpensFileQueues(t *testing.T) {
+	dir := helper{t}.tempDir()
+	defer os.RemoveAll(dir)
+
+	src, err := OpenSource("file://"+dir, TransportOptions{Logger: noopLogger{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := src.(*fileQueue); !ok {
+		t.Errorf("expected a file queue, got %T", src)
+	}
+}
+
+func Test_OpenSource_RejectsUnknownSchemes(t *testing.T) {
+	_, err := OpenSource("gopher://example.com/queue", TransportOptions{Logger: noopLogger{}})
+	if err == nil {
+		t.Fatalf("expected unknown scheme to raise an error")
+	}
+	if !strings.Contains(err.Error(), `unsupported queue url scheme "gopher"`) {
+		t.Errorf("expected error to name the scheme, got %v", err)
+	}
+}
+
+// unregisterTransport removes the transport of scheme, so that tests can
+// register theirs again when they run repeatedly
+func unregisterTransport(scheme string) {
+	transportsMu.Lock()
+	defer transportsMu.Unlock()
+	delete(transports, strings.ToLower(scheme))
+}
+
+func Test_OpenSource_RejectsSinkOnlyTransports(t *testing.T) {
+	RegisterTransport("test-sink-only", Transport{
+		Sink: func(u *url.URL, opts TransportOptions) (MessageSink, error) {
+			return NewMemoryQueue(0), nil
+		},
+	})
+	defer unregisterTransport("test-sink-only")
+
+	if _, err := OpenSink("test-sink-only://queue", TransportOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := OpenSource("test-sink-only://queue", TransportOptions{})
+	expected := "transport: can not consume from test-sink-only queues"
+	if fmt.Sprintf("%v", err) != expected {
+		t.Fatalf("expected error to equal %q, got %v", expected, err)
+	}
+}
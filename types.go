@@ -15,7 +15,43 @@ type Message interface {
 	SentAt() time.Time
 	Body() messageBody
 	Payload() []byte
+	// ReceiveCount is the number of times the message was received,
+	// including this time
+	ReceiveCount() int
 	Delete() error
+	// ChangeVisibility makes the message invisible to all consumers for
+	// the given duration from now, 0 makes it visible immediately
+	ChangeVisibility(time.Duration) error
+}
+
+// A finisher is a Message which holds back other messages of its source
+// until it is deleted or its visibility changed. Consumers call Finish once
+// they are done with the message, so that messages which are left on the
+// queue as they are don't hold back the others for good.
+type finisher interface {
+	Finish()
+}
+
+// finishMessage calls Finish of msg, if it is a finisher
+func finishMessage(msg Message) {
+	if f, ok := msg.(finisher); ok {
+		f.Finish()
+	}
+}
+
+// A rejecter is a Message of a source which dead-letters messages itself,
+// rather than by a redrive policy which counts their receives. Consumers
+// call Reject for messages which can not be handled.
+type rejecter interface {
+	Reject() error
+}
+
+// rejectMessage calls Reject of msg, if it is a rejecter
+func rejectMessage(msg Message) error {
+	if r, ok := msg.(rejecter); ok {
+		return r.Reject()
+	}
+	return nil
 }
 
 // A MessageQueue represents a queue to receive and publish messages
@@ -24,14 +60,40 @@ type MessageQueue interface {
 	MessageSink
 }
 
-// A MessageSource represents a source to retrieve a Message
+// A MessageSource represents a source to retrieve a Message. It returns a
+// nil Message and error if no message is available. If a message was received
+// which can not be handled, it returns the Message alongside a dead-letter
+// error (see isDeadLetter), such a Message must not be deleted.
 type MessageSource interface {
 	ReceiveMessageWithContext(context.Context) (Message, error)
 }
 
-// A MessageSink represents a channel to publish messages to
+// A MessageSink represents a channel to publish messages to. Sinks hold
+// back messages with a NotBefore time in the body from delivery as far as the
+// transport allows, consumers defer messages which are delivered early.
 type MessageSink interface {
-	PublishPayload(env map[string]string, data []byte) error
+	PublishPayload(body messageBody, data []byte) error
+}
+
+// A MessageBatchSink is a MessageSink which publishes several payloads in
+// fewer calls. It returns the result of every entry, in the order of
+// entries.
+type MessageBatchSink interface {
+	MessageSink
+	PublishPayloads(entries []PublishEntry) []PublishResult
+}
+
+// A PublishEntry is a payload to publish with its message body
+type PublishEntry struct {
+	Body    messageBody
+	Payload []byte
+}
+
+// A PublishResult is the outcome of publishing a PublishEntry, MessageID is
+// empty if the sink doesn't report the ids of published messages
+type PublishResult struct {
+	MessageID string
+	Err       error
 }
 
 // LogWriter represents a logger which can be used as io.Writer